@@ -16,14 +16,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/component-base/logs"
@@ -39,9 +42,11 @@ const (
 )
 
 var (
-	IPFIXAddr      string
-	IPFIXPort      uint16
-	IPFIXTransport string
+	IPFIXAddr        string
+	IPFIXPort        uint16
+	IPFIXTransport   string
+	MetricsAddr      string
+	TemplateStoreDir string
 )
 
 func initLoggingToFile(fs *pflag.FlagSet) {
@@ -58,6 +63,8 @@ func addIPFIXFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&IPFIXAddr, "ipfix.addr", "0.0.0.0", "IPFIX collector address")
 	fs.Uint16Var(&IPFIXPort, "ipfix.port", 4739, "IPFIX collector port")
 	fs.StringVar(&IPFIXTransport, "ipfix.transport", "tcp", "IPFIX collector transport layer")
+	fs.StringVar(&MetricsAddr, "metrics.addr", "", "Address to serve Prometheus metrics on /metrics, metrics are not served if empty")
+	fs.StringVar(&TemplateStoreDir, "template.store-dir", "", "Directory to save udp templates in across restarts, templates are not saved if empty")
 }
 
 func printIPFIXMessage(msg *entities.Message) {
@@ -67,21 +74,26 @@ func printIPFIXMessage(msg *entities.Message) {
 	fmt.Fprintf(&buf, "  Exported Time: %v (%v)\n", msg.GetExportTime(), time.Unix(int64(msg.GetExportTime()), 0))
 	fmt.Fprintf(&buf, "  Sequence No.: %v,  Observation Domain ID: %v\n", msg.GetSequenceNum(), msg.GetObsDomainID())
 
-	set := msg.GetSet()
-	if set.GetSetType() == entities.Template {
-		fmt.Fprint(&buf, "TEMPLATE SET:\n")
-		for i, record := range set.GetRecords() {
-			fmt.Fprintf(&buf, "  TEMPLATE RECORD-%d:\n", i)
-			for _, ie := range record.GetOrderedElementList() {
-				fmt.Fprintf(&buf, "    %s: len=%d (enterprise ID = %d) \n", ie.Element.Name, ie.Element.Len, ie.Element.EnterpriseId)
+	for _, set := range msg.GetSets() {
+		if set.GetSetType() == entities.Template || set.GetSetType() == entities.OptionsTemplate {
+			if set.GetSetType() == entities.Template {
+				fmt.Fprint(&buf, "TEMPLATE SET:\n")
+			} else {
+				fmt.Fprint(&buf, "OPTIONS TEMPLATE SET:\n")
 			}
-		}
-	} else {
-		fmt.Fprint(&buf, "DATA SET:\n")
-		for i, record := range set.GetRecords() {
-			fmt.Fprintf(&buf, "  DATA RECORD-%d:\n", i)
-			for _, ie := range record.GetOrderedElementList() {
-				fmt.Fprintf(&buf, "    %s: %v \n", ie.Element.Name, ie.Value)
+			for i, record := range set.GetRecords() {
+				fmt.Fprintf(&buf, "  TEMPLATE RECORD-%d: (scope field count = %d)\n", i, record.GetScopeFieldCount())
+				for _, ie := range record.GetOrderedElementList() {
+					fmt.Fprintf(&buf, "    %s: len=%d (enterprise ID = %d) \n", ie.Element.Name, ie.Element.Len, ie.Element.EnterpriseId)
+				}
+			}
+		} else {
+			fmt.Fprint(&buf, "DATA SET:\n")
+			for i, record := range set.GetRecords() {
+				fmt.Fprintf(&buf, "  DATA RECORD-%d:\n", i)
+				for _, ie := range record.GetOrderedElementList() {
+					fmt.Fprintf(&buf, "    %s: %v \n", ie.Element.Name, ie.Value)
+				}
 			}
 		}
 	}
@@ -96,6 +108,7 @@ func signalHandler(stopCh chan struct{}, messageReceived chan *entities.Message)
 		select {
 		case msg := <-messageReceived:
 			printIPFIXMessage(msg)
+			msg.Release()
 		case <-signalCh:
 			close(stopCh)
 			return
@@ -116,15 +129,34 @@ func run() error {
 		IsEncrypted:   false,
 		ServerCert:    nil,
 		ServerKey:     nil,
+
+		TemplateStoreDir: TemplateStoreDir,
+	}
+	if MetricsAddr != "" {
+		cpInput.MetricsRegistry = prometheus.NewRegistry()
 	}
 	cp, err := collector.InitCollectingProcess(cpInput)
 	if err != nil {
 		return err
 	}
+	if MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", cp.GetMetricsHandler())
+		metricsServer := &http.Server{Addr: MetricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				klog.Errorf("Error when serving metrics: %v", err)
+			}
+		}()
+		defer metricsServer.Close()
+	}
 	// Start listening to connections and receiving messages.
 	messageReceived := make(chan *entities.Message)
+	errCh := make(chan error, 1)
 	go func() {
-		go cp.Start()
+		go func() {
+			errCh <- cp.Start(context.Background())
+		}()
 		msgChan := cp.GetMsgChan()
 		for message := range msgChan {
 			klog.Info("Processing IPFIX message")
@@ -135,7 +167,13 @@ func run() error {
 	stopCh := make(chan struct{})
 	go signalHandler(stopCh, messageReceived)
 
-	<-stopCh
+	select {
+	case <-stopCh:
+	case err := <-errCh:
+		if err != nil {
+			return err
+		}
+	}
 	// Stop the collector process
 	cp.Stop()
 	klog.Info("Stopping IPFIX collector")
@@ -6,9 +6,12 @@ require (
 	github.com/Shopify/sarama v1.27.2
 	github.com/golang/mock v1.4.3
 	github.com/pion/dtls/v2 v2.0.3
+	github.com/pion/udp v0.1.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073
 	google.golang.org/protobuf v1.27.1
 	k8s.io/apimachinery v0.21.0
 	k8s.io/component-base v0.21.0
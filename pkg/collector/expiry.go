@@ -0,0 +1,205 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// TemplateExpiryCallBack is called when the lifetime of a template of an
+// exporter ends without the template being refreshed, and the template is
+// deleted (udp only).
+type TemplateExpiryCallBack func(sessionID string, obsDomainID uint32, templateID uint16)
+
+type templateKey struct {
+	sessionID   string
+	obsDomainID uint32
+	templateID  uint16
+}
+
+// expiryEntry is the expiry time of a template in the expiry heap.
+type expiryEntry struct {
+	key        templateKey
+	template   *templateValue
+	expiryTime time.Time
+	// index is the index of the entry in the heap, which is maintained by the
+	// heap so that the entry can be fixed or removed
+	index int
+}
+
+// expiryHeap is a min-heap of expiry entries, ordered by expiry time.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiryTime.Before(h[j].expiryTime) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// expiryScheduler expires the templates of udp transport sessions when their
+// lifetime ends. It has a single entry for each template, whose expiry time is
+// moved when the template is refreshed, and the entries are expired in order by
+// a single goroutine. The clock can be replaced by a fake clock in tests.
+type expiryScheduler struct {
+	clock        clock.Clock
+	mutex        sync.Mutex
+	entries      expiryHeap
+	entriesByKey map[templateKey]*expiryEntry
+	// wakeChan is signalled when the entries change, so that the goroutine
+	// waits for the new earliest expiry time
+	wakeChan chan struct{}
+}
+
+func newExpiryScheduler(clock clock.Clock) *expiryScheduler {
+	return &expiryScheduler{
+		clock:        clock,
+		entriesByKey: make(map[templateKey]*expiryEntry),
+		wakeChan:     make(chan struct{}, 1),
+	}
+}
+
+// now returns the current time of the clock of the scheduler, or the current
+// time if there is no scheduler.
+func (s *expiryScheduler) now() time.Time {
+	if s == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// schedule sets the expiry time of the template, replacing the expiry time of
+// the previous template with the same key.
+func (s *expiryScheduler) schedule(key templateKey, template *templateValue, expiryTime time.Time) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if entry, exists := s.entriesByKey[key]; exists {
+		entry.template = template
+		entry.expiryTime = expiryTime
+		heap.Fix(&s.entries, entry.index)
+	} else {
+		entry = &expiryEntry{key: key, template: template, expiryTime: expiryTime}
+		heap.Push(&s.entries, entry)
+		s.entriesByKey[key] = entry
+	}
+	s.mutex.Unlock()
+	s.wake()
+}
+
+// cancel removes the expiry time of the template, which is deleted before the
+// end of its lifetime.
+func (s *expiryScheduler) cancel(key templateKey) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	entry, exists := s.entriesByKey[key]
+	if exists {
+		heap.Remove(&s.entries, entry.index)
+		delete(s.entriesByKey, key)
+	}
+	s.mutex.Unlock()
+	if exists {
+		s.wake()
+	}
+}
+
+func (s *expiryScheduler) wake() {
+	select {
+	case s.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// count returns the number of templates with an expiry time.
+func (s *expiryScheduler) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries)
+}
+
+// popExpired removes the entries whose expiry time is not after now, and
+// returns them in order of expiry time with the next expiry time, if any.
+func (s *expiryScheduler) popExpired(now time.Time) ([]*expiryEntry, time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var expired []*expiryEntry
+	for len(s.entries) > 0 && !s.entries[0].expiryTime.After(now) {
+		entry := heap.Pop(&s.entries).(*expiryEntry)
+		delete(s.entriesByKey, entry.key)
+		expired = append(expired, entry)
+	}
+	if len(s.entries) == 0 {
+		return expired, time.Time{}, false
+	}
+	return expired, s.entries[0].expiryTime, true
+}
+
+// run calls expire for each template at the end of its lifetime, until ctx is
+// done. Templates whose lifetime ends while it is not running are expired when
+// it starts.
+func (s *expiryScheduler) run(ctx context.Context, expire func(key templateKey, template *templateValue)) {
+	for {
+		now := s.clock.Now()
+		expired, nextExpiryTime, ok := s.popExpired(now)
+		for _, entry := range expired {
+			expire(entry.key, entry.template)
+		}
+		var timer clock.Timer
+		var timerChan <-chan time.Time
+		if ok {
+			timer = s.clock.NewTimer(nextExpiryTime.Sub(now))
+			timerChan = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-s.wakeChan:
+		case <-timerChan:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+)
+
+const (
+	metricsNamespace = "ipfix"
+	metricsSubsystem = "collector"
+)
+
+// Reasons of decode errors, which are the values of the reason label of the
+// decode errors metric.
+const (
+	decodeErrorInvalidHeader      = "invalid_header"
+	decodeErrorUnsupportedVersion = "unsupported_version"
+	decodeErrorInvalidSet         = "invalid_set"
+	decodeErrorInvalidTemplate    = "invalid_template"
+	decodeErrorMissingTemplate    = "missing_template"
+	decodeErrorInvalidRecord      = "invalid_record"
+)
+
+// decodeError is an error in decoding a message, with the reason which is
+// counted in the metrics.
+type decodeError struct {
+	reason string
+	err    error
+}
+
+func newDecodeError(reason string, err error) error {
+	return &decodeError{reason, err}
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+// getDecodeErrorReason returns the reason of the decode error, which is an
+// invalid record if the error does not have a reason.
+func getDecodeErrorReason(err error) string {
+	if decodeErr, ok := err.(*decodeError); ok {
+		return decodeErr.reason
+	}
+	return decodeErrorInvalidRecord
+}
+
+// collectorMetrics are the Prometheus metrics of a collecting process. All its
+// methods can be called on a nil collectorMetrics, when metrics are disabled.
+type collectorMetrics struct {
+	// transport is the value of the transport label: tcp, tls, udp or dtls.
+	transport           string
+	messagesReceived    *prometheus.CounterVec
+	recordsReceived     *prometheus.CounterVec
+	bytesReceived       *prometheus.CounterVec
+	decodeErrors        *prometheus.CounterVec
+	droppedMessages     *prometheus.CounterVec
+	templateExpirations prometheus.Counter
+}
+
+// newCollectorMetrics creates the metrics of the collecting process, and
+// registers them with the registry.
+func newCollectorMetrics(cp *CollectingProcess, registry *prometheus.Registry) (*collectorMetrics, error) {
+	transport := cp.protocol
+	if cp.isEncrypted {
+		if cp.protocol == "tcp" {
+			transport = "tls"
+		} else {
+			transport = "dtls"
+		}
+	}
+	m := &collectorMetrics{
+		transport: transport,
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "messages_received_total",
+			Help:      "Number of messages received from each exporter, including the messages which cannot be decoded.",
+		}, []string{"exporter", "transport"}),
+		recordsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "records_received_total",
+			Help:      "Number of template and data records decoded from each exporter.",
+		}, []string{"exporter", "transport", "type"}),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "bytes_received_total",
+			Help:      "Number of bytes of the messages received from each exporter.",
+		}, []string{"exporter", "transport"}),
+		decodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "decode_errors_total",
+			Help:      "Number of messages which cannot be decoded, by reason.",
+		}, []string{"reason"}),
+		droppedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "messages_dropped_total",
+			Help:      "Number of decoded messages from each exporter dropped because the message queue is full.",
+		}, []string{"exporter"}),
+		templateExpirations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "template_expirations_total",
+			Help:      "Number of templates deleted because their lifetime ended.",
+		}),
+	}
+	collectors := []prometheus.Collector{
+		m.messagesReceived,
+		m.recordsReceived,
+		m.bytesReceived,
+		m.decodeErrors,
+		m.droppedMessages,
+		m.templateExpirations,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "active_clients",
+			Help:      "Number of exporters with an active connection or worker.",
+		}, func() float64 {
+			return float64(cp.getClientCount())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "templates",
+			Help:      "Number of templates of all the exporters.",
+		}, func() float64 {
+			return float64(cp.getTemplateCount())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "message_queue_length",
+			Help:      "Number of decoded messages waiting in the message queue.",
+		}, func() float64 {
+			return float64(len(cp.messageChan))
+		}),
+	}
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// addReceivedMessage counts a message received from the exporter.
+func (m *collectorMetrics) addReceivedMessage(exportAddress string, numBytes int) {
+	if m == nil {
+		return
+	}
+	m.messagesReceived.WithLabelValues(exportAddress, m.transport).Inc()
+	m.bytesReceived.WithLabelValues(exportAddress, m.transport).Add(float64(numBytes))
+}
+
+// addDecodedMessage counts the template and data records of a decoded message.
+func (m *collectorMetrics) addDecodedMessage(message *entities.Message) {
+	if m == nil {
+		return
+	}
+	var numTemplateRecords, numDataRecords uint32
+	for _, set := range message.GetSets() {
+		if set.GetSetType() == entities.Data {
+			numDataRecords += set.GetNumberOfRecords()
+		} else {
+			numTemplateRecords += set.GetNumberOfRecords()
+		}
+	}
+	m.recordsReceived.WithLabelValues(message.GetExportAddress(), m.transport, "template").Add(float64(numTemplateRecords))
+	m.recordsReceived.WithLabelValues(message.GetExportAddress(), m.transport, "data").Add(float64(numDataRecords))
+}
+
+func (m *collectorMetrics) addDecodeError(reason string) {
+	if m == nil {
+		return
+	}
+	m.decodeErrors.WithLabelValues(reason).Inc()
+}
+
+func (m *collectorMetrics) addDroppedMessage(exportAddress string) {
+	if m == nil {
+		return
+	}
+	m.droppedMessages.WithLabelValues(exportAddress).Inc()
+}
+
+func (m *collectorMetrics) addTemplateExpiration() {
+	if m == nil {
+		return
+	}
+	m.templateExpirations.Inc()
+}
+
+// GetMetricsHandler returns the HTTP handler which exposes the metrics of the
+// collecting process in the Prometheus format. It responds with 404 if the
+// collecting process has no metrics registry.
+func (cp *CollectingProcess) GetMetricsHandler() http.Handler {
+	if cp.metricsRegistry == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(cp.metricsRegistry, promhttp.HandlerOpts{})
+}
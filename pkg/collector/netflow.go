@@ -0,0 +1,233 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+	"github.com/vmware/go-ipfix/pkg/registry"
+	"github.com/vmware/go-ipfix/pkg/util"
+)
+
+const (
+	// netFlowV9HeaderLength is the length of the NetFlow v9 packet header
+	// (RFC3954 section 5.1).
+	netFlowV9HeaderLength = 20
+	// netFlowV9TemplateSetID is the flowset ID of NetFlow v9 template flowsets.
+	netFlowV9TemplateSetID uint16 = 0
+	// netFlowV9OptionsTemplateSetID is the flowset ID of NetFlow v9 options
+	// template flowsets.
+	netFlowV9OptionsTemplateSetID uint16 = 1
+	// netFlowV5HeaderLength is the length of the NetFlow v5 packet header.
+	netFlowV5HeaderLength = 24
+	// netFlowV5RecordLength is the length of a NetFlow v5 flow record.
+	netFlowV5RecordLength = 48
+	// netFlowV5TemplateID is the template ID of the data sets of NetFlow v5
+	// records, which do not have templates.
+	netFlowV5TemplateID uint16 = 256
+)
+
+// netFlowV9ScopeElements maps the scope field types of NetFlow v9 options
+// templates (RFC3954 section 6.2) to IPFIX information elements. Other field
+// types of NetFlow v9 are the same as the IANA information element IDs.
+var netFlowV9ScopeElements = map[uint16]string{
+	1: "observationDomainId", // System
+	2: "ingressInterface",    // Interface
+	3: "lineCardId",          // Line Card
+	4: "meteringProcessId",   // Cache
+	5: "templateId",          // Template
+}
+
+// netFlowV5Fields are the fields of NetFlow v5 flow records in order, with the
+// names of the equivalent IANA information elements. Fields without a name are
+// padding.
+var netFlowV5Fields = []templateField{
+	{"sourceIPv4Address", 4},
+	{"destinationIPv4Address", 4},
+	{"ipNextHopIPv4Address", 4},
+	{"ingressInterface", 2},
+	{"egressInterface", 2},
+	{"packetDeltaCount", 4},
+	{"octetDeltaCount", 4},
+	{"flowStartSysUpTime", 4},
+	{"flowEndSysUpTime", 4},
+	{"sourceTransportPort", 2},
+	{"destinationTransportPort", 2},
+	{"", 1},
+	{"tcpControlBits", 1},
+	{"protocolIdentifier", 1},
+	{"ipClassOfService", 1},
+	{"bgpSourceAsNumber", 2},
+	{"bgpDestinationAsNumber", 2},
+	{"sourceIPv4PrefixLength", 1},
+	{"destinationIPv4PrefixLength", 1},
+	{"", 2},
+}
+
+// decodeNetFlowV9Header decodes the header of a NetFlow v9 packet, and returns
+// the message with the header fields and the buffer of its flowsets. The header
+// does not have the packet length, so the whole buffer is decoded. The source
+// ID is used as the observation domain ID.
+func decodeNetFlowV9Header(packetBuffer *bytes.Buffer) (*entities.Message, *bytes.Buffer, error) {
+	msgLen := packetBuffer.Len()
+	if msgLen < netFlowV9HeaderLength || msgLen > entities.MaxTcpSocketMsgSize {
+		return nil, nil, fmt.Errorf("message length %d is invalid", msgLen)
+	}
+	var version, count uint16
+	var sysUpTime, exportTime, sequenceNum, sourceID uint32
+	// The record count is not needed as flowsets are walked using their lengths.
+	err := util.Decode(packetBuffer, binary.BigEndian, &version, &count, &sysUpTime, &exportTime, &sequenceNum, &sourceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	message := entities.NewMessage(true)
+	message.SetVersion(version)
+	message.SetMessageLen(uint16(msgLen))
+	message.SetSysUpTime(sysUpTime)
+	message.SetExportTime(exportTime)
+	message.SetSequenceNum(sequenceNum)
+	message.SetObsDomainID(sourceID)
+	return message, bytes.NewBuffer(packetBuffer.Next(packetBuffer.Len())), nil
+}
+
+// decodeNetFlowV9TemplateRecord decodes the fields of a NetFlow v9 template
+// record, or options template record, after its template ID. The second field
+// of the record header is the field count for templates, and the scope length
+// in bytes for options templates. It returns the elements and the scope field
+// count of the record.
+func decodeNetFlowV9TemplateRecord(templateBuffer *bytes.Buffer, templateID uint16, fieldCount uint16, isOptions bool, isLenient bool) ([]*entities.InfoElementWithValue, uint16, error) {
+	if templateID < minDataSetID {
+		return nil, 0, fmt.Errorf("template id %d is invalid", templateID)
+	}
+	var scopeFieldCount uint16
+	if isOptions {
+		scopeLength := fieldCount
+		var optionLength uint16
+		if err := util.Decode(templateBuffer, binary.BigEndian, &optionLength); err != nil {
+			return nil, 0, fmt.Errorf("options template %d is too short", templateID)
+		}
+		if scopeLength == 0 || scopeLength%4 != 0 || optionLength%4 != 0 {
+			return nil, 0, fmt.Errorf("scope length %d or option length %d of options template %d is invalid", scopeLength, optionLength, templateID)
+		}
+		scopeFieldCount = scopeLength / 4
+		fieldCount = scopeFieldCount + optionLength/4
+	}
+	if fieldCount == 0 {
+		return nil, 0, fmt.Errorf("template %d does not have any field", templateID)
+	}
+	if templateBuffer.Len() < 4*int(fieldCount) {
+		return nil, 0, fmt.Errorf("template %d is shorter than its %d fields", templateID, fieldCount)
+	}
+	elementsWithValue := make([]*entities.InfoElementWithValue, int(fieldCount))
+	for i := 0; i < int(fieldCount); i++ {
+		var fieldType, fieldLength uint16
+		if err := util.Decode(templateBuffer, binary.BigEndian, &fieldType, &fieldLength); err != nil {
+			return nil, 0, err
+		}
+		var element *entities.InfoElement
+		var err error
+		if i < int(scopeFieldCount) {
+			element, err = getNetFlowV9ScopeElement(fieldType, fieldLength, isLenient)
+		} else {
+			element, err = getInfoElement(fieldType, registry.IANAEnterpriseID, fieldLength, isLenient)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		element, err = getTemplateElement(element, fieldLength)
+		if err != nil {
+			return nil, 0, err
+		}
+		elementsWithValue[i] = entities.NewInfoElementWithValue(element, nil)
+	}
+	return elementsWithValue, scopeFieldCount, nil
+}
+
+// getNetFlowV9ScopeElement returns the IPFIX information element for the scope
+// field type of a NetFlow v9 options template.
+func getNetFlowV9ScopeElement(fieldType uint16, length uint16, isLenient bool) (*entities.InfoElement, error) {
+	name, exists := netFlowV9ScopeElements[fieldType]
+	if !exists {
+		if !isLenient {
+			return nil, fmt.Errorf("scope field type %d is not supported", fieldType)
+		}
+		return newUnknownInfoElement(fieldType, registry.IANAEnterpriseID, length), nil
+	}
+	return registry.GetInfoElement(name, registry.IANAEnterpriseID)
+}
+
+// decodeNetFlowV5Header decodes the header of a NetFlow v5 packet, and returns
+// the message with the header fields and the buffer of its flow records. The
+// engine type and engine ID are used as the observation domain ID, and the
+// sampling interval is not kept.
+func decodeNetFlowV5Header(packetBuffer *bytes.Buffer) (*entities.Message, *bytes.Buffer, error) {
+	if packetBuffer.Len() < netFlowV5HeaderLength {
+		return nil, nil, fmt.Errorf("message length %d is invalid", packetBuffer.Len())
+	}
+	var version, count, samplingInterval uint16
+	var sysUpTime, exportTime, exportNanoseconds, sequenceNum uint32
+	var engineType, engineID uint8
+	err := util.Decode(packetBuffer, binary.BigEndian, &version, &count, &sysUpTime, &exportTime, &exportNanoseconds, &sequenceNum, &engineType, &engineID, &samplingInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	recordsLen := int(count) * netFlowV5RecordLength
+	if count == 0 || recordsLen > packetBuffer.Len() {
+		return nil, nil, fmt.Errorf("record count %d is invalid, received %d bytes", count, packetBuffer.Len()+netFlowV5HeaderLength)
+	}
+	message := entities.NewMessage(true)
+	message.SetVersion(version)
+	message.SetMessageLen(uint16(netFlowV5HeaderLength + recordsLen))
+	message.SetSysUpTime(sysUpTime)
+	message.SetExportTime(exportTime)
+	message.SetSequenceNum(sequenceNum)
+	message.SetObsDomainID(uint32(engineType)<<8 | uint32(engineID))
+	return message, bytes.NewBuffer(packetBuffer.Next(recordsLen)), nil
+}
+
+// decodeNetFlowV5Set decodes all the NetFlow v5 flow records in the buffer into
+// a data set of the synthetic NetFlow v5 template.
+func (cp *CollectingProcess) decodeNetFlowV5Set(recordsBuffer *bytes.Buffer) (entities.Set, error) {
+	template, err := cp.getSyntheticTemplate(entities.NetFlowV5Version, netFlowV5TemplateID, netFlowV5Fields)
+	if err != nil {
+		return nil, err
+	}
+	dataSet := entities.NewSet(true)
+	if err = dataSet.PrepareSet(entities.Data, netFlowV5TemplateID); err != nil {
+		return nil, err
+	}
+	recordElements := getRecordElements(len(template))
+	defer recordElements.release()
+	for recordsBuffer.Len() >= netFlowV5RecordLength {
+		i := 0
+		for _, field := range netFlowV5Fields {
+			value := recordsBuffer.Next(int(field.length))
+			if field.name == "" {
+				continue
+			}
+			if err = recordElements.decode(i, template[i], value); err != nil {
+				return nil, err
+			}
+			i++
+		}
+		if err = dataSet.AddRecord(recordElements.elements, netFlowV5TemplateID); err != nil {
+			return nil, err
+		}
+	}
+	return dataSet, nil
+}
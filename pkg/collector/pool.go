@@ -0,0 +1,98 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+)
+
+// packet is a packet received from an exporter. Its buffer is taken from the
+// packet buffer pool, and is put back once the packet is dropped, or once the
+// message decoded from it is released by the consumer.
+type packet struct {
+	buffer *[]byte
+	length int
+}
+
+// getPacketBuffer returns a buffer of the given size from the packet buffer
+// pool, or a new buffer if the pool does not have a large enough buffer.
+func (cp *CollectingProcess) getPacketBuffer(size int) *[]byte {
+	if buffer, ok := cp.packetBuffers.Get().(*[]byte); ok && cap(*buffer) >= size {
+		*buffer = (*buffer)[:size]
+		return buffer
+	}
+	buffer := make([]byte, size)
+	return &buffer
+}
+
+func (cp *CollectingProcess) putPacketBuffer(buffer *[]byte) {
+	cp.packetBuffers.Put(buffer)
+}
+
+// recordElements are the elements of the data records being decoded. They are
+// reused for all the records of a set, as data records keep a copy of their
+// elements.
+type recordElements struct {
+	values   []entities.InfoElementWithValue
+	elements []*entities.InfoElementWithValue
+}
+
+var recordElementsPool sync.Pool
+
+// getRecordElements returns record elements for the given number of elements
+// from the pool.
+func getRecordElements(numElements int) *recordElements {
+	r, ok := recordElementsPool.Get().(*recordElements)
+	if !ok || cap(r.values) < numElements {
+		r = &recordElements{
+			values:   make([]entities.InfoElementWithValue, numElements),
+			elements: make([]*entities.InfoElementWithValue, numElements),
+		}
+		for i := range r.values {
+			r.elements[i] = &r.values[i]
+		}
+	}
+	r.values = r.values[:numElements]
+	r.elements = r.elements[:numElements]
+	return r
+}
+
+// set sets the element with the value at the given index.
+func (r *recordElements) set(i int, element *entities.InfoElement, value interface{}) {
+	r.values[i] = entities.InfoElementWithValue{Element: element, Value: value}
+}
+
+// decode decodes the raw bytes of the element at the index, and sets its value.
+// The bytes are decoded before they are added to the record, so that they are
+// not boxed into an interface value first.
+func (r *recordElements) decode(i int, element *entities.InfoElement, value []byte) error {
+	decodedValue, err := entities.DecodeBytesToIEDataType(element.DataType, value)
+	if err != nil {
+		return err
+	}
+	r.set(i, element, decodedValue)
+	return nil
+}
+
+// release clears the values, which may refer to a packet buffer, and puts the
+// record elements back to the pool.
+func (r *recordElements) release() {
+	for i := range r.values {
+		r.values[i] = entities.InfoElementWithValue{}
+	}
+	recordElementsPool.Put(r)
+}
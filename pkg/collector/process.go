@@ -16,6 +16,7 @@ package collector
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -23,6 +24,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/klog/v2"
 
 	"github.com/vmware/go-ipfix/pkg/entities"
@@ -30,9 +33,14 @@ import (
 	"github.com/vmware/go-ipfix/pkg/util"
 )
 
+// minDataSetID is the minimum set ID of data sets. Set IDs 4-255 are reserved
+// as per RFC7011 section 3.3.2.
+const minDataSetID uint16 = 256
+
 type CollectingProcess struct {
-	// for each obsDomainID, there is a map of templates
-	templatesMap map[uint32]map[uint16][]*entities.InfoElement
+	// for each transport session and obsDomainID, there is a map of templates
+	// (RFC7011 section 8). Sessions are identified by the exporter address.
+	templatesMap map[string]map[uint32]map[uint16]*templateValue
 	// mutex allows multiple readers or one writer at the same time
 	mutex sync.RWMutex
 	// template lifetime
@@ -45,10 +53,28 @@ type CollectingProcess struct {
 	netAddress net.Addr
 	// maximum buffer size to read the record
 	maxBufferSize uint16
-	// chanel to receive stop information
-	stopChan chan bool
+	// packetBuffers is the pool of the buffers which packets are received in
+	packetBuffers sync.Pool
+	// numUDPSockets is the number of udp sockets bound to the address, and
+	// numUDPWorkers is the size of the pool of udp decode workers, or 0 to
+	// decode the packets of each exporter in its own goroutine
+	numUDPSockets int
+	numUDPWorkers int
+	// idleTimeout is the time after which the workers of idle udp exporters
+	// are stopped and idle dtls associations are closed
+	idleTimeout time.Duration
+	// stopChan is closed when the collecting process is stopped
+	stopChan chan struct{}
+	stopOnce sync.Once
+	// isStarted indicates whether Start has been called
+	isStarted bool
 	// messageChan is the channel to output message
 	messageChan chan *entities.Message
+	// overflowPolicy is applied to decoded messages when messageChan is full
+	overflowPolicy OverflowPolicy
+	// droppedMessages counts the messages dropped by the overflow policy for
+	// each exporter address
+	droppedMessages map[string]uint64
 	// maps each client to its client handler (required channels)
 	clients map[string]*clientHandler
 	// isEncrypted indicates whether to use TLS/DTLS for communication
@@ -57,6 +83,42 @@ type CollectingProcess struct {
 	caCert     []byte
 	serverCert []byte
 	serverKey  []byte
+	// isLenient indicates whether to decode unknown information elements as
+	// octet arrays instead of dropping the template
+	isLenient bool
+	// isLazyDecoding indicates whether data records keep their raw bytes and
+	// decode their fields when they are requested
+	isLazyDecoding bool
+	// templateStoreDir is the directory of the template store, or empty if
+	// templates are not saved, and templatesChanged indicates whether the
+	// templates have changed since they were last saved
+	templateStoreDir string
+	templatesChanged bool
+	// templateExpiry expires the templates at the end of their lifetime (udp
+	// only), and templateExpiryCallBack is notified when a template expires
+	templateExpiry         *expiryScheduler
+	templateExpiryCallBack TemplateExpiryCallBack
+	// templateRedefinitionCallBack is notified when a template is redefined
+	templateRedefinitionCallBack TemplateRedefinitionCallBack
+	// sequenceStates tracks the expected sequence number for each transport
+	// session and obsDomainID. sequenceMutex protects sequenceStates and
+	// sequenceStats, which are updated for every decoded message, so that
+	// checking sequence numbers does not take the mutex of the templates and
+	// clients.
+	sequenceMutex  sync.Mutex
+	sequenceStates map[sequenceKey]*sequenceState
+	// sequenceStats counts sequence number anomalies of all the sessions
+	sequenceStats SequenceStats
+	// sequenceNumberCallBack is notified of sequence number anomalies
+	sequenceNumberCallBack SequenceNumberCallBack
+	// syntheticTemplates are the templates of NetFlow v5 and sFlow records,
+	// which do not have templates on the wire. They are created from the
+	// registry when the first record of each template is received.
+	syntheticTemplates map[syntheticTemplateKey][]*entities.InfoElement
+	// metricsRegistry is the registry of the Prometheus metrics, and metrics
+	// is nil if it is not set
+	metricsRegistry *prometheus.Registry
+	metrics         *collectorMetrics
 }
 
 type CollectorInput struct {
@@ -64,7 +126,9 @@ type CollectorInput struct {
 	Address string
 	// Protocol needs to be provided in lower case format.
 	// We support "tcp" and "udp" protocols.
-	Protocol      string
+	Protocol string
+	// MaxBufferSize is the size of the buffer to read messages, and the maximum
+	// length of tcp messages. Connections which send longer messages are closed.
 	MaxBufferSize uint16
 	TemplateTTL   uint32
 	IsEncrypted   bool
@@ -73,42 +137,249 @@ type CollectorInput struct {
 	ServerCert []byte
 	ServerKey  []byte
 	IsIPv6     bool
+	// IsLenient enables decoding templates with information elements that are
+	// not in the registry. Such elements are named unknown_<enterpriseID>_<elementID>
+	// and their values in data records are kept as raw bytes.
+	IsLenient bool
+	// TemplateRedefinitionCallBack is optional and is called when an existing
+	// template ID is redefined with a different layout.
+	TemplateRedefinitionCallBack TemplateRedefinitionCallBack
+	// TemplateExpiryCallBack is optional and is called when a template expires
+	// because it has not been refreshed within the template TTL (udp only).
+	TemplateExpiryCallBack TemplateExpiryCallBack
+	// SequenceNumberCallBack is optional and is called when a message has a
+	// gap, is reordered or resets the sequence number of its exporter.
+	SequenceNumberCallBack SequenceNumberCallBack
+	// MessageQueueDepth is the number of decoded messages which are buffered
+	// in the message channel until they are consumed. Defaults to 0, which
+	// means that the channel is unbuffered.
+	MessageQueueDepth int
+	// OverflowPolicy is applied to decoded messages when the message channel
+	// is full. Defaults to OverflowBlock. Dropped messages are counted for each
+	// exporter.
+	OverflowPolicy OverflowPolicy
+	// MetricsRegistry is optional, and the Prometheus metrics of the collecting
+	// process are registered with it. They can be exposed with GetMetricsHandler.
+	MetricsRegistry *prometheus.Registry
+	// NumUDPSockets is the number of sockets bound to the address with
+	// SO_REUSEPORT, so that the exporters are balanced across them by the
+	// kernel (Linux only). Defaults to 1. It only applies to udp without DTLS.
+	NumUDPSockets int
+	// NumUDPWorkers is the size of the pool of goroutines which decode the udp
+	// packets. The packets of an exporter are always decoded by the same
+	// worker. Defaults to 0, which means that each exporter has its own
+	// goroutine. It only applies to udp without DTLS.
+	NumUDPWorkers int
+	// LazyDecoding enables lazy decoding of data records. Data records keep
+	// their raw bytes with the offsets of their fields, and a field is only
+	// decoded when it is requested with GetInfoElementWithValue or
+	// GetOrderedElementList. The records implement entities.LazyRecord, which
+	// gives access to the raw bytes of a field. Records of templates with
+	// structured data types, and NetFlow v5 and sFlow records, are always
+	// decoded eagerly.
+	// Together with Message.Release, lazy decoding is the allocation-free
+	// mode: a field is only boxed into an interface value when it is
+	// requested. Eager decoding still allocates a decoded value for each field
+	// which does not fit in an interface value, e.g. integers of 256 or more,
+	// addresses and strings.
+	LazyDecoding bool
+	// TemplateStoreDir is optional. If it is set, the templates are saved to a
+	// file in the directory periodically and when the collecting process is
+	// stopped, and they are loaded again when it is started. Data records can
+	// then be decoded after a restart without waiting for the exporters to
+	// resend their templates. Templates are only loaded if their lifetime,
+	// which is the template TTL from the last time they were announced, has
+	// not ended. It only applies to udp without DTLS.
+	TemplateStoreDir string
+}
+
+// TemplateRedefinitionCallBack is called when an exporter redefines an existing
+// template ID with a different layout.
+type TemplateRedefinitionCallBack func(obsDomainID uint32, templateID uint16, oldElements, newElements []*entities.InfoElement)
+
+type templateValue struct {
+	elements []*entities.InfoElement
+	// scopeFieldCount is the number of scope fields for options templates,
+	// and 0 for templates.
+	scopeFieldCount uint16
+	// hasStructuredElements indicates whether the template has elements of
+	// structured data types, whose values are always decoded eagerly.
+	hasStructuredElements bool
+	// updateTime is the last time the template was announced by the exporter.
+	updateTime time.Time
+}
+
+// templateField is a field of the fixed record format of NetFlow v5 or sFlow,
+// with the name of the equivalent IANA information element.
+type templateField struct {
+	name   string
+	length uint16
+}
+
+type syntheticTemplateKey struct {
+	version    uint16
+	templateID uint16
+}
+
+// isSameLayout returns whether two templates have the same fields in the same order.
+func (t *templateValue) isSameLayout(other *templateValue) bool {
+	if t.scopeFieldCount != other.scopeFieldCount || len(t.elements) != len(other.elements) {
+		return false
+	}
+	for i, element := range t.elements {
+		otherElement := other.elements[i]
+		if element.ElementId != otherElement.ElementId || element.EnterpriseId != otherElement.EnterpriseId || element.Len != otherElement.Len {
+			return false
+		}
+	}
+	return true
 }
 
 type clientHandler struct {
-	packetChan chan *bytes.Buffer
+	packetChan chan packet
 	errChan    chan bool
+	// doneChan is closed when the handler of the client exits, so that the
+	// client is not sent packets or signalled anymore.
+	doneChan chan bool
 }
 
 func InitCollectingProcess(input CollectorInput) (*CollectingProcess, error) {
+	if input.MessageQueueDepth < 0 {
+		return nil, fmt.Errorf("message queue depth %d is invalid", input.MessageQueueDepth)
+	}
+	switch input.OverflowPolicy {
+	case OverflowBlock, OverflowDropNewest:
+	case OverflowDropOldest:
+		if input.MessageQueueDepth == 0 {
+			return nil, fmt.Errorf("overflow policy %s requires a message queue depth of at least 1", input.OverflowPolicy)
+		}
+	default:
+		return nil, fmt.Errorf("overflow policy %d is invalid", input.OverflowPolicy)
+	}
+	if input.NumUDPSockets < 0 || input.NumUDPWorkers < 0 {
+		return nil, fmt.Errorf("number of udp sockets %d or udp workers %d is invalid", input.NumUDPSockets, input.NumUDPWorkers)
+	}
+	if (input.NumUDPSockets > 1 || input.NumUDPWorkers > 0) && (input.Protocol != "udp" || input.IsEncrypted) {
+		return nil, fmt.Errorf("udp sockets and udp workers are only supported with udp without DTLS")
+	}
+	if input.TemplateStoreDir != "" && (input.Protocol != "udp" || input.IsEncrypted) {
+		return nil, fmt.Errorf("template store is only supported with udp without DTLS")
+	}
 	collectProc := &CollectingProcess{
-		templatesMap:  make(map[uint32]map[uint16][]*entities.InfoElement),
+		templatesMap:  make(map[string]map[uint32]map[uint16]*templateValue),
 		mutex:         sync.RWMutex{},
 		templateTTL:   input.TemplateTTL,
 		address:       input.Address,
 		protocol:      input.Protocol,
 		maxBufferSize: input.MaxBufferSize,
-		stopChan:      make(chan bool),
-		messageChan:   make(chan *entities.Message),
+		numUDPSockets: input.NumUDPSockets,
+		numUDPWorkers: input.NumUDPWorkers,
+		idleTimeout:   time.Duration(entities.TemplateRefreshTimeOut) * time.Second,
+		stopChan:      make(chan struct{}),
+		messageChan:   make(chan *entities.Message, input.MessageQueueDepth),
 		clients:       make(map[string]*clientHandler),
 		isEncrypted:   input.IsEncrypted,
 		caCert:        input.CACert,
 		serverCert:    input.ServerCert,
 		serverKey:     input.ServerKey,
+		isLenient:     input.IsLenient,
+
+		isLazyDecoding:   input.LazyDecoding,
+		templateStoreDir: input.TemplateStoreDir,
+
+		sequenceStates: make(map[sequenceKey]*sequenceState),
+
+		overflowPolicy:  input.OverflowPolicy,
+		droppedMessages: make(map[string]uint64),
+		metricsRegistry: input.MetricsRegistry,
+
+		templateExpiry:               newExpiryScheduler(clock.RealClock{}),
+		templateExpiryCallBack:       input.TemplateExpiryCallBack,
+		templateRedefinitionCallBack: input.TemplateRedefinitionCallBack,
+		sequenceNumberCallBack:       input.SequenceNumberCallBack,
+	}
+	if input.MetricsRegistry != nil {
+		metrics, err := newCollectorMetrics(collectProc, input.MetricsRegistry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot register metrics of collecting process: %v", err)
+		}
+		collectProc.metrics = metrics
 	}
 	return collectProc, nil
 }
 
-func (cp *CollectingProcess) Start() {
-	if cp.protocol == "tcp" {
-		cp.startTCPServer()
-	} else if cp.protocol == "udp" {
-		cp.startUDPServer()
+// Start starts the collecting process, and blocks until ctx is done or Stop is
+// called. It returns an error if the collecting process cannot listen on its
+// address, and it cannot be started more than once. When it stops, the
+// connections from the exporters are closed, and the message channel is closed
+// after the messages being decoded have been received from it.
+func (cp *CollectingProcess) Start(ctx context.Context) error {
+	cp.mutex.Lock()
+	if cp.isStarted {
+		cp.mutex.Unlock()
+		return fmt.Errorf("collecting process has already been started")
+	}
+	cp.isStarted = true
+	cp.mutex.Unlock()
+	defer close(cp.messageChan)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-cp.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	switch cp.protocol {
+	case "tcp":
+		return cp.startTCPServer(ctx)
+	case "udp":
+		if cp.templateStoreDir != "" {
+			// A template store which cannot be loaded is only logged, so that
+			// the collecting process starts without the stored templates.
+			if err := cp.loadTemplates(); err != nil {
+				klog.Errorf("Error in loading templates from %s: %v", cp.templateStoreDir, err)
+			}
+			storeCtx, cancelStore := context.WithCancel(context.Background())
+			storeDone := make(chan struct{})
+			go cp.runTemplateStore(storeCtx, storeDone)
+			// the templates are saved once all the packets are decoded
+			defer func() {
+				cancelStore()
+				<-storeDone
+			}()
+		}
+		// Templates expire while the collecting process is running.
+		expiryDone := make(chan struct{})
+		go func() {
+			defer close(expiryDone)
+			cp.templateExpiry.run(ctx, cp.deleteExpiredTemplate)
+		}()
+		defer func() {
+			cancel()
+			<-expiryDone
+		}()
+		return cp.startUDPServer(ctx)
+	default:
+		return fmt.Errorf("collecting process does not support protocol %s", cp.protocol)
 	}
 }
 
+// Stop stops the collecting process without waiting for Start to return. It can
+// be called more than once, and before Start.
 func (cp *CollectingProcess) Stop() {
-	cp.stopChan <- true
+	cp.stopOnce.Do(func() {
+		close(cp.stopChan)
+	})
+}
+
+// CloseMsgChan stops the collecting process, and the message channel is closed
+// when Start returns.
+//
+// Deprecated: Use Stop instead.
+func (cp *CollectingProcess) CloseMsgChan() {
+	cp.Stop()
 }
 
 func (cp *CollectingProcess) GetAddress() net.Addr {
@@ -117,20 +388,19 @@ func (cp *CollectingProcess) GetAddress() net.Addr {
 	return cp.netAddress
 }
 
+// GetMsgChan returns the channel of the decoded messages. The consumer can call
+// Release on each message once it is done with it, so that the memory of the
+// message is reused to decode the next messages. See LazyDecoding for the
+// allocations which remain when messages are released.
 func (cp *CollectingProcess) GetMsgChan() chan *entities.Message {
 	return cp.messageChan
 }
 
-func (cp *CollectingProcess) CloseMsgChan() {
-	cp.mutex.Lock()
-	defer cp.mutex.Unlock()
-	close(cp.messageChan)
-}
-
 func (cp *CollectingProcess) createClient() *clientHandler {
 	return &clientHandler{
-		packetChan: make(chan *bytes.Buffer),
+		packetChan: make(chan packet),
 		errChan:    make(chan bool),
+		doneChan:   make(chan bool),
 	}
 }
 
@@ -152,69 +422,253 @@ func (cp *CollectingProcess) getClientCount() int {
 	return len(cp.clients)
 }
 
-func (cp *CollectingProcess) closeAllClients() {
-	cp.mutex.Lock()
-	defer cp.mutex.Unlock()
-	for _, client := range cp.clients {
-		client.errChan <- true
+// decodeClientPacket decodes a packet received from the exporter. The packet is
+// dropped if it cannot be decoded, as the next packets can still be decoded.
+func (cp *CollectingProcess) decodeClientPacket(packet packet, address string) {
+	cp.metrics.addReceivedMessage(getExportAddress(address), packet.length)
+	message, err := cp.decodeMessage(bytes.NewBuffer((*packet.buffer)[:packet.length]), address)
+	if err != nil {
+		cp.putPacketBuffer(packet.buffer)
+		cp.metrics.addDecodeError(getDecodeErrorReason(err))
+		klog.Errorf("Dropping message from %s: %v", address, err)
+		return
 	}
+	// The packet buffer is put back to the pool when the consumer releases the
+	// message, which can happen as soon as it is sent.
+	message.SetPacketBuffer(packet.buffer, &cp.packetBuffers)
+	cp.metrics.addDecodedMessage(message)
+	klog.V(4).Infof("Processed message from exporter %v, number of records: %v, observation domain ID: %v",
+		message.GetExportAddress(), message.GetNumberOfRecords(), message.GetObsDomainID())
+	cp.sendMessage(message)
 }
 
+// decodePacket decodes the packet, and sends the decoded message to the message
+// channel.
 func (cp *CollectingProcess) decodePacket(packetBuffer *bytes.Buffer, exportAddress string) (*entities.Message, error) {
-	var version, msgLen, setID, setLen uint16
-	var exportTime, sequencNum, obsDomainID uint32
-	err := util.Decode(packetBuffer, binary.BigEndian, &version, &msgLen, &exportTime, &sequencNum, &obsDomainID, &setID, &setLen)
+	message, err := cp.decodeMessage(packetBuffer, exportAddress)
 	if err != nil {
 		return nil, err
 	}
-	if version != uint16(10) {
-		return nil, fmt.Errorf("collector only supports IPFIX (v10); invalid version %d received", version)
-	}
+	cp.sendMessage(message)
+	return message, nil
+}
 
-	message := entities.NewMessage(true)
-	message.SetVersion(version)
-	message.SetMessageLen(msgLen)
-	message.SetExportTime(exportTime)
-	message.SetSequenceNum(sequencNum)
-	message.SetObsDomainID(obsDomainID)
+func (cp *CollectingProcess) decodeMessage(packetBuffer *bytes.Buffer, exportAddress string) (*entities.Message, error) {
+	if packetBuffer.Len() < 2 {
+		return nil, newDecodeError(decodeErrorInvalidHeader, fmt.Errorf("message of %d bytes is too short", packetBuffer.Len()))
+	}
+	// IPFIX and NetFlow messages are received on the same listener, and are told
+	// apart by the version at the beginning of the message header.
+	version := binary.BigEndian.Uint16(packetBuffer.Bytes())
+	// sFlow datagrams start with a 32-bit version, whose upper 16 bits are zero.
+	if version == 0 && packetBuffer.Len() >= 4 && binary.BigEndian.Uint32(packetBuffer.Bytes()) == sFlowVersion {
+		version = entities.SFlowV5Version
+	}
+	var message *entities.Message
+	var setsBuffer *bytes.Buffer
+	var err error
+	templateSetID, optionsTemplateSetID := entities.TemplateSetID, entities.OptionsTemplateSetID
+	switch version {
+	case entities.IPFIXVersion:
+		message, setsBuffer, err = decodeIPFIXHeader(packetBuffer)
+	case entities.NetFlowV9Version:
+		message, setsBuffer, err = decodeNetFlowV9Header(packetBuffer)
+		templateSetID, optionsTemplateSetID = netFlowV9TemplateSetID, netFlowV9OptionsTemplateSetID
+	case entities.NetFlowV5Version:
+		message, setsBuffer, err = decodeNetFlowV5Header(packetBuffer)
+	case entities.SFlowV5Version:
+		message, setsBuffer, err = decodeSFlowHeader(packetBuffer)
+	default:
+		return nil, newDecodeError(decodeErrorUnsupportedVersion, fmt.Errorf("collector only supports IPFIX (v10), NetFlow v9, NetFlow v5 and sFlow v5; invalid version %d received", version))
+	}
+	if err != nil {
+		return nil, newDecodeError(decodeErrorInvalidHeader, err)
+	}
+	obsDomainID := message.GetObsDomainID()
+	// Templates are scoped to the transport session, which is identified by the
+	// address and port of the exporter.
+	sessionID := exportAddress
+	message.SetSessionID(sessionID)
 
-	// handle IPv6 address which may involve []
-	portIndex := strings.LastIndex(exportAddress, ":")
-	exportAddress = exportAddress[:portIndex]
-	exportAddress = strings.Replace(exportAddress, "[", "", -1)
-	exportAddress = strings.Replace(exportAddress, "]", "", -1)
-	message.SetExportAddress(exportAddress)
+	message.SetExportAddress(getExportAddress(sessionID))
 
-	var set entities.Set
-	if setID == entities.TemplateSetID {
-		set, err = cp.decodeTemplateSet(packetBuffer, obsDomainID)
+	// NetFlow v5 and sFlow records have a fixed format, and they are decoded
+	// with synthetic templates instead of the templates of the session.
+	switch version {
+	case entities.NetFlowV5Version:
+		set, err := cp.decodeNetFlowV5Set(setsBuffer)
 		if err != nil {
-			return nil, fmt.Errorf("error in decoding message: %v", err)
+			return nil, newDecodeError(decodeErrorInvalidRecord, fmt.Errorf("error in decoding message: %v", err))
 		}
-	} else {
-		set, err = cp.decodeDataSet(packetBuffer, obsDomainID, setID)
+		message.AddSet(set)
+	case entities.SFlowV5Version:
+		sets, err := cp.decodeSFlowSamples(setsBuffer)
 		if err != nil {
-			return nil, fmt.Errorf("error in decoding message: %v", err)
+			return nil, newDecodeError(decodeErrorInvalidRecord, fmt.Errorf("error in decoding message: %v", err))
+		}
+		for _, set := range sets {
+			message.AddSet(set)
 		}
 	}
-	message.AddSet(set)
-
-	// the thread(s)/client(s) executing the code will get blocked until the message is consumed/read in other goroutines.
-	cp.messageChan <- message
+	// Data sets which cannot be decoded are skipped, so that the other sets of
+	// the message are still decoded (RFC7011 section 8).
+	var skippedSetErrs []error
+	// Walk all the sets in the message using the length in each set header.
+	for setsBuffer.Len() > 0 {
+		var setID, setLen uint16
+		if err = util.Decode(setsBuffer, binary.BigEndian, &setID, &setLen); err != nil {
+			return nil, newDecodeError(decodeErrorInvalidSet, fmt.Errorf("error in decoding set header: %v", err))
+		}
+		if int(setLen) < entities.SetHeaderLen || int(setLen)-entities.SetHeaderLen > setsBuffer.Len() {
+			return nil, newDecodeError(decodeErrorInvalidSet, fmt.Errorf("set length %d of set with id %d is invalid", setLen, setID))
+		}
+		setBuffer := bytes.NewBuffer(setsBuffer.Next(int(setLen) - entities.SetHeaderLen))
+		var set entities.Set
+		if setID == templateSetID || setID == optionsTemplateSetID {
+			set, err = cp.decodeTemplateSet(setBuffer, sessionID, obsDomainID, version, setID, setID == optionsTemplateSetID)
+			if err != nil {
+				return nil, newDecodeError(decodeErrorInvalidTemplate, fmt.Errorf("error in decoding message: %v", err))
+			}
+		} else if setID >= minDataSetID {
+			set, err = cp.decodeDataSet(setBuffer, sessionID, obsDomainID, setID)
+			if err != nil {
+				skippedSetErrs = append(skippedSetErrs, newDecodeError(getDecodeErrorReason(err), fmt.Errorf("error in decoding data set with id %d: %v", setID, err)))
+				continue
+			}
+		} else {
+			return nil, newDecodeError(decodeErrorInvalidSet, fmt.Errorf("error in decoding message: set id %d is reserved", setID))
+		}
+		message.AddSet(set)
+	}
+	if len(skippedSetErrs) > 0 {
+		// The message is dropped if none of its sets can be decoded, and the
+		// error of its last set is counted by the caller.
+		if len(message.GetSets()) == 0 {
+			lastErr := skippedSetErrs[len(skippedSetErrs)-1]
+			cp.countSkippedSets(skippedSetErrs[:len(skippedSetErrs)-1], exportAddress)
+			return nil, lastErr
+		}
+		cp.countSkippedSets(skippedSetErrs, exportAddress)
+	}
+	cp.checkSequenceNumber(sessionID, message)
 	return message, nil
 }
 
-func (cp *CollectingProcess) decodeTemplateSet(templateBuffer *bytes.Buffer, obsDomainID uint32) (entities.Set, error) {
-	var templateID uint16
-	var fieldCount uint16
-	if err := util.Decode(templateBuffer, binary.BigEndian, &templateID, &fieldCount); err != nil {
-		return nil, err
+// countSkippedSets logs the data sets of a message which are skipped, and counts
+// them as decode errors.
+func (cp *CollectingProcess) countSkippedSets(errs []error, exportAddress string) {
+	for _, err := range errs {
+		cp.metrics.addDecodeError(getDecodeErrorReason(err))
+		klog.Errorf("Skipping data set from %s: %v", exportAddress, err)
+	}
+}
+
+// decodeIPFIXHeader decodes the header of an IPFIX message, and returns the
+// message with the header fields and the buffer of its sets. Any bytes after
+// the message length are ignored.
+func decodeIPFIXHeader(packetBuffer *bytes.Buffer) (*entities.Message, *bytes.Buffer, error) {
+	var version, msgLen uint16
+	var exportTime, sequencNum, obsDomainID uint32
+	err := util.Decode(packetBuffer, binary.BigEndian, &version, &msgLen, &exportTime, &sequencNum, &obsDomainID)
+	if err != nil {
+		return nil, nil, err
 	}
+	if int(msgLen) < entities.MsgHeaderLength || int(msgLen)-entities.MsgHeaderLength > packetBuffer.Len() {
+		return nil, nil, fmt.Errorf("message length %d is invalid, received %d bytes", msgLen, packetBuffer.Len()+entities.MsgHeaderLength)
+	}
+	message := entities.NewMessage(true)
+	message.SetVersion(version)
+	message.SetMessageLen(msgLen)
+	message.SetExportTime(exportTime)
+	message.SetSequenceNum(sequencNum)
+	message.SetObsDomainID(obsDomainID)
+	return message, bytes.NewBuffer(packetBuffer.Next(int(msgLen) - entities.MsgHeaderLength)), nil
+}
 
+// decodeTemplateSet decodes all the template records in a template set, or all
+// the options template records in an options template set, of an IPFIX or
+// NetFlow v9 message. setID is the set ID of the set in the message, which is
+// the flowset ID for NetFlow v9.
+func (cp *CollectingProcess) decodeTemplateSet(templateBuffer *bytes.Buffer, sessionID string, obsDomainID uint32, version uint16, setID uint16, isOptions bool) (entities.Set, error) {
+	setType := entities.Template
+	if isOptions {
+		setType = entities.OptionsTemplate
+	}
 	templateSet := entities.NewSet(true)
-	if err := templateSet.PrepareSet(entities.Template, templateID); err != nil {
+	if err := templateSet.PrepareSet(setType, setID); err != nil {
 		return nil, err
 	}
+	// A template set can carry multiple template records. Templates are added to
+	// the template map only after the whole set is decoded successfully.
+	// Padding at the end of the set is always shorter than a template record
+	// header, except in options template sets where the header is longer than a
+	// withdrawal record; zero-filled padding is detected by its template ID 0.
+	for templateBuffer.Len() >= entities.TemplateRecordHeaderLen {
+		var templateID, fieldCount, scopeFieldCount uint16
+		if err := util.Decode(templateBuffer, binary.BigEndian, &templateID, &fieldCount); err != nil {
+			return nil, err
+		}
+		if templateID == 0 && fieldCount == 0 {
+			break
+		}
+		if version == entities.NetFlowV9Version {
+			elementsWithValue, scopeFieldCount, err := decodeNetFlowV9TemplateRecord(templateBuffer, templateID, fieldCount, isOptions, cp.isLenient)
+			if err != nil {
+				return nil, err
+			}
+			if err = templateSet.AddRecordWithScope(elementsWithValue, scopeFieldCount, templateID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if fieldCount == 0 {
+			// Template withdrawal record (RFC7011 section 8.1). A template ID
+			// equal to the set ID withdraws all templates of that set type.
+			if templateID < minDataSetID && templateID != setID {
+				return nil, fmt.Errorf("template withdrawal with template id %d is invalid", templateID)
+			}
+			if err := templateSet.AddRecordWithScope(nil, 0, templateID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if templateID < minDataSetID {
+			return nil, fmt.Errorf("template id %d is invalid", templateID)
+		}
+		if isOptions {
+			if templateBuffer.Len() < entities.OptionsTemplateRecordHeaderLen-entities.TemplateRecordHeaderLen {
+				return nil, fmt.Errorf("options template %d is too short", templateID)
+			}
+			if err := util.Decode(templateBuffer, binary.BigEndian, &scopeFieldCount); err != nil {
+				return nil, err
+			}
+			if scopeFieldCount == 0 || scopeFieldCount > fieldCount {
+				return nil, fmt.Errorf("scope field count %d of options template %d is invalid", scopeFieldCount, templateID)
+			}
+		}
+		elementsWithValue, err := decodeTemplateRecord(templateBuffer, fieldCount, cp.isLenient)
+		if err != nil {
+			return nil, err
+		}
+		if err = templateSet.AddRecordWithScope(elementsWithValue, scopeFieldCount, templateID); err != nil {
+			return nil, err
+		}
+	}
+	// Apply template definitions and withdrawals in the order they appear in the set.
+	for _, record := range templateSet.GetRecords() {
+		if record.GetFieldCount() == 0 {
+			cp.withdrawTemplate(sessionID, obsDomainID, record.GetTemplateID(), isOptions)
+		} else {
+			cp.addTemplate(sessionID, obsDomainID, record.GetTemplateID(), record.GetOrderedElementList(), record.GetScopeFieldCount())
+		}
+	}
+	return templateSet, nil
+}
+
+// decodeTemplateRecord decodes fieldCount field specifiers of a template record
+// from the buffer. If isLenient is true, elements that are not in the registry
+// are decoded as octet arrays with the length given in the field specifier.
+func decodeTemplateRecord(templateBuffer *bytes.Buffer, fieldCount uint16, isLenient bool) ([]*entities.InfoElementWithValue, error) {
 	elementsWithValue := make([]*entities.InfoElementWithValue, int(fieldCount))
 	for i := 0; i < int(fieldCount); i++ {
 		var element *entities.InfoElement
@@ -231,10 +685,7 @@ func (cp *CollectingProcess) decodeTemplateSet(templateBuffer *bytes.Buffer, obs
 		if !isNonIANARegistry {
 			elementID = binary.BigEndian.Uint16(elementid)
 			enterpriseID = registry.IANAEnterpriseID
-			element, err = registry.GetInfoElementFromID(elementID, enterpriseID)
-			if err != nil {
-				return nil, err
-			}
+			element, err = getInfoElement(elementID, enterpriseID, elementLength, isLenient)
 		} else {
 			/*
 				Encoding format for Enterprise-Specific Information Elements:
@@ -257,44 +708,115 @@ func (cp *CollectingProcess) decodeTemplateSet(templateBuffer *bytes.Buffer, obs
 			}
 			elementid[0] = elementid[0] ^ 0x80
 			elementID = binary.BigEndian.Uint16(elementid)
-			element, err = registry.GetInfoElementFromID(elementID, enterpriseID)
-			if err != nil {
-				return nil, err
-			}
+			element, err = getInfoElement(elementID, enterpriseID, elementLength, isLenient)
+		}
+		if err != nil {
+			return nil, err
+		}
+		element, err = getTemplateElement(element, elementLength)
+		if err != nil {
+			return nil, err
 		}
 		elementsWithValue[i] = entities.NewInfoElementWithValue(element, nil)
 	}
-	err := templateSet.AddRecord(elementsWithValue, templateID)
+	return elementsWithValue, nil
+}
+
+// getTemplateElement returns the element with the length given in the template.
+// The length is kept in a copy of the element, so that the element in the
+// registry is not modified.
+func getTemplateElement(element *entities.InfoElement, elementLength uint16) (*entities.InfoElement, error) {
+	if elementLength == 0 {
+		return nil, fmt.Errorf("length of element %s is zero", element.Name)
+	}
+	if element.Len == entities.VariableLength && elementLength != entities.VariableLength {
+		// Elements of variable length types, such as octetArray, can be
+		// exported with a fixed length given in the template.
+		return entities.NewInfoElement(element.Name, element.ElementId, element.DataType, element.EnterpriseId, elementLength), nil
+	} else if element.Len != elementLength {
+		// Reduced-size encoding (RFC7011 section 6.2)
+		return entities.NewReducedSizeInfoElement(element, elementLength)
+	}
+	return element, nil
+}
+
+// getInfoElement returns the information element from the registry. If isLenient
+// is true, an element that is not in the registry is returned as an octetArray
+// element with the given length.
+func getInfoElement(elementID uint16, enterpriseID uint32, length uint16, isLenient bool) (*entities.InfoElement, error) {
+	element, err := registry.GetInfoElementFromID(elementID, enterpriseID)
 	if err != nil {
-		return nil, err
+		if !isLenient {
+			return nil, err
+		}
+		klog.V(2).Infof("Decoding unknown information element with elementID %d and enterpriseID %d as octetArray: %v", elementID, enterpriseID, err)
+		element = newUnknownInfoElement(elementID, enterpriseID, length)
 	}
-	cp.addTemplate(obsDomainID, templateID, elementsWithValue)
-	return templateSet, nil
+	return element, nil
+}
+
+// newUnknownInfoElement creates an information element of octetArray type for
+// an element that is not in the registry.
+func newUnknownInfoElement(elementID uint16, enterpriseID uint32, length uint16) *entities.InfoElement {
+	name := fmt.Sprintf("unknown_%d_%d", enterpriseID, elementID)
+	return entities.NewInfoElement(name, elementID, entities.OctetArray, enterpriseID, length)
 }
 
-func (cp *CollectingProcess) decodeDataSet(dataBuffer *bytes.Buffer, obsDomainID uint32, templateID uint16) (entities.Set, error) {
+// lazySet is implemented by the decoding sets of the entities package, which
+// can keep data records as lazy records. It is not part of entities.Set.
+type lazySet interface {
+	AddLazyRecord(buffer []byte, template []*entities.InfoElement, scopeFieldCount uint16, templateID uint16) (int, error)
+}
+
+func (cp *CollectingProcess) decodeDataSet(dataBuffer *bytes.Buffer, sessionID string, obsDomainID uint32, templateID uint16) (entities.Set, error) {
 	// make sure template exists
-	template, err := cp.getTemplate(obsDomainID, templateID)
+	template, err := cp.getTemplate(sessionID, obsDomainID, templateID)
 	if err != nil {
-		return nil, fmt.Errorf("template %d with obsDomainID %d does not exist", templateID, obsDomainID)
+		return nil, newDecodeError(decodeErrorMissingTemplate, fmt.Errorf("template %d with obsDomainID %d does not exist", templateID, obsDomainID))
 	}
 	dataSet := entities.NewSet(true)
 	if err = dataSet.PrepareSet(entities.Data, templateID); err != nil {
 		return nil, err
 	}
 
-	for dataBuffer.Len() > 0 {
-		elements := make([]*entities.InfoElementWithValue, len(template))
-		for i, element := range template {
+	// Padding at the end of the set is always shorter than the minimum length
+	// of a data record, so stop once fewer bytes than that remain.
+	minDataRecLen := getMinDataRecordLen(template.elements)
+	if lazyDataSet, ok := dataSet.(lazySet); ok && cp.isLazyDecoding && !template.hasStructuredElements {
+		for minDataRecLen > 0 && dataBuffer.Len() >= minDataRecLen {
+			recordLen, err := lazyDataSet.AddLazyRecord(dataBuffer.Bytes(), template.elements, template.scopeFieldCount, templateID)
+			if err != nil {
+				return nil, err
+			}
+			dataBuffer.Next(recordLen)
+		}
+		return dataSet, nil
+	}
+	recordElements := getRecordElements(len(template.elements))
+	defer recordElements.release()
+	for minDataRecLen > 0 && dataBuffer.Len() >= minDataRecLen {
+		for i, element := range template.elements {
 			var length int
 			if element.Len == entities.VariableLength { // string
 				length = getFieldLength(dataBuffer)
 			} else {
 				length = int(element.Len)
 			}
-			elements[i] = entities.NewInfoElementWithValue(element, dataBuffer.Next(length))
+			if length > dataBuffer.Len() {
+				return nil, fmt.Errorf("data record of template %d is shorter than the length of element %s", templateID, element.Name)
+			}
+			value := dataBuffer.Next(length)
+			if entities.IsStructuredDataType(element.DataType) {
+				structuredValue, err := cp.decodeStructuredValue(sessionID, obsDomainID, element, value)
+				if err != nil {
+					return nil, err
+				}
+				recordElements.set(i, element, structuredValue)
+			} else if err = recordElements.decode(i, element, value); err != nil {
+				return nil, err
+			}
 		}
-		err = dataSet.AddRecord(elements, templateID)
+		err = dataSet.AddRecordWithScope(recordElements.elements, template.scopeFieldCount, templateID)
 		if err != nil {
 			return nil, err
 		}
@@ -302,52 +824,206 @@ func (cp *CollectingProcess) decodeDataSet(dataBuffer *bytes.Buffer, obsDomainID
 	return dataSet, nil
 }
 
-func (cp *CollectingProcess) addTemplate(obsDomainID uint32, templateID uint16, elementsWithValue []*entities.InfoElementWithValue) {
+// decodeStructuredValue decodes the value of a basicList, subTemplateList or
+// subTemplateMultiList element. Sub-templates are looked up in the templates of
+// the same transport session and observation domain.
+func (cp *CollectingProcess) decodeStructuredValue(sessionID string, obsDomainID uint32, element *entities.InfoElement, value []byte) (interface{}, error) {
+	getElement := func(elementID uint16, enterpriseID uint32, length uint16) (*entities.InfoElement, error) {
+		return getInfoElement(elementID, enterpriseID, length, cp.isLenient)
+	}
+	getTemplate := func(templateID uint16) ([]*entities.InfoElement, error) {
+		template, err := cp.getTemplate(sessionID, obsDomainID, templateID)
+		if err != nil {
+			return nil, err
+		}
+		return template.elements, nil
+	}
+	decodedValue, err := entities.DecodeStructuredValue(element.DataType, value, getElement, getTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("error in decoding element %s: %v", element.Name, err)
+	}
+	return decodedValue, nil
+}
+
+func (cp *CollectingProcess) addTemplate(sessionID string, obsDomainID uint32, templateID uint16, elementsWithValue []*entities.InfoElementWithValue, scopeFieldCount uint16) {
+	cp.putTemplate(sessionID, obsDomainID, templateID, newTemplateValue(elementsWithValue, scopeFieldCount, cp.templateExpiry.now()))
+}
+
+// putTemplate adds or replaces the template, whose lifetime starts at its
+// update time (udp only). It returns false if the lifetime of the template has
+// already ended, in which case the template is not added.
+func (cp *CollectingProcess) putTemplate(sessionID string, obsDomainID uint32, templateID uint16, template *templateValue) bool {
 	cp.mutex.Lock()
-	defer cp.mutex.Unlock()
-	if _, exists := cp.templatesMap[obsDomainID]; !exists {
-		cp.templatesMap[obsDomainID] = make(map[uint16][]*entities.InfoElement)
+	var expiryTime time.Time
+	if cp.protocol != "tcp" {
+		if cp.templateTTL == 0 {
+			cp.templateTTL = entities.TemplateTTL // Default value
+		}
+		expiryTime = template.updateTime.Add(time.Duration(cp.templateTTL) * time.Second)
+		if !expiryTime.After(cp.templateExpiry.now()) {
+			cp.mutex.Unlock()
+			return false
+		}
 	}
-	elements := make([]*entities.InfoElement, 0)
-	for _, elementWithValue := range elementsWithValue {
-		elements = append(elements, elementWithValue.Element)
+	if _, exists := cp.templatesMap[sessionID]; !exists {
+		cp.templatesMap[sessionID] = make(map[uint32]map[uint16]*templateValue)
 	}
-	cp.templatesMap[obsDomainID][templateID] = elements
-	// template lifetime management
-	if cp.protocol == "tcp" {
-		return
+	if _, exists := cp.templatesMap[sessionID][obsDomainID]; !exists {
+		cp.templatesMap[sessionID][obsDomainID] = make(map[uint16]*templateValue)
 	}
+	oldTemplate, isRedefined := cp.templatesMap[sessionID][obsDomainID][templateID]
+	if isRedefined {
+		isRedefined = !oldTemplate.isSameLayout(template)
+	}
+	cp.templatesMap[sessionID][obsDomainID][templateID] = template
+	cp.templatesChanged = true
+	// Refreshing a udp template moves its expiry time, which restarts its
+	// lifetime.
+	if cp.protocol != "tcp" {
+		cp.templateExpiry.schedule(templateKey{sessionID, obsDomainID, templateID}, template, expiryTime)
+	}
+	callback := cp.templateRedefinitionCallBack
+	cp.mutex.Unlock()
 
-	// Handle udp template expiration
-	if cp.templateTTL == 0 {
-		cp.templateTTL = entities.TemplateTTL // Default value
+	if isRedefined {
+		klog.Warningf("Template with id %d, and obsDomainID %d from %s is redefined with a different layout.", templateID, obsDomainID, sessionID)
+		if callback != nil {
+			callback(obsDomainID, templateID, oldTemplate.elements, template.elements)
+		}
 	}
-	go func() {
-		ticker := time.NewTicker(time.Duration(cp.templateTTL) * time.Second)
-		defer ticker.Stop()
-		select {
-		case <-ticker.C:
-			klog.Infof("Template with id %d, and obsDomainID %d is expired.", templateID, obsDomainID)
-			cp.deleteTemplate(obsDomainID, templateID)
-			break
+	return true
+}
+
+// withdrawTemplate removes the template with the given ID. A template ID equal
+// to the template set ID (or options template set ID) withdraws all templates
+// (or all options templates) of the observation domain in the transport session.
+func (cp *CollectingProcess) withdrawTemplate(sessionID string, obsDomainID uint32, templateID uint16, isOptions bool) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if templateID == entities.TemplateSetID || templateID == entities.OptionsTemplateSetID {
+		if isOptions {
+			klog.V(2).Infof("All options templates with obsDomainID %d are withdrawn.", obsDomainID)
+		} else {
+			klog.V(2).Infof("All templates with obsDomainID %d are withdrawn.", obsDomainID)
 		}
-	}()
+		templates := cp.templatesMap[sessionID][obsDomainID]
+		for id, template := range templates {
+			if (template.scopeFieldCount > 0) == isOptions {
+				cp.templateExpiry.cancel(templateKey{sessionID, obsDomainID, id})
+				delete(templates, id)
+				cp.templatesChanged = true
+			}
+		}
+		return
+	}
+	if _, exists := cp.templatesMap[sessionID][obsDomainID][templateID]; exists {
+		klog.V(2).Infof("Template with id %d, and obsDomainID %d is withdrawn.", templateID, obsDomainID)
+		cp.templateExpiry.cancel(templateKey{sessionID, obsDomainID, templateID})
+		delete(cp.templatesMap[sessionID][obsDomainID], templateID)
+		cp.templatesChanged = true
+	} else {
+		klog.Warningf("Withdrawn template with id %d, and obsDomainID %d does not exist.", templateID, obsDomainID)
+	}
 }
 
-func (cp *CollectingProcess) getTemplate(obsDomainID uint32, templateID uint16) ([]*entities.InfoElement, error) {
+func (cp *CollectingProcess) getTemplate(sessionID string, obsDomainID uint32, templateID uint16) (*templateValue, error) {
 	cp.mutex.RLock()
 	defer cp.mutex.RUnlock()
-	if elements, exists := cp.templatesMap[obsDomainID][templateID]; exists {
-		return elements, nil
+	if template, exists := cp.templatesMap[sessionID][obsDomainID][templateID]; exists {
+		return template, nil
 	} else {
 		return nil, fmt.Errorf("template %d with obsDomainID %d does not exist", templateID, obsDomainID)
 	}
 }
 
-func (cp *CollectingProcess) deleteTemplate(obsDomainID uint32, templateID uint16) {
+// getSyntheticTemplate returns the elements of the synthetic template of a
+// protocol without templates, with the lengths of its fields. Fields without a
+// name are padding, and they are not part of the template.
+func (cp *CollectingProcess) getSyntheticTemplate(version uint16, templateID uint16, fields []templateField) ([]*entities.InfoElement, error) {
+	key := syntheticTemplateKey{version, templateID}
 	cp.mutex.Lock()
 	defer cp.mutex.Unlock()
-	delete(cp.templatesMap[obsDomainID], templateID)
+	if template, exists := cp.syntheticTemplates[key]; exists {
+		return template, nil
+	}
+	template := make([]*entities.InfoElement, 0, len(fields))
+	for _, field := range fields {
+		if field.name == "" {
+			continue
+		}
+		element, err := registry.GetInfoElement(field.name, registry.IANAEnterpriseID)
+		if err != nil {
+			return nil, err
+		}
+		element, err = getTemplateElement(element, field.length)
+		if err != nil {
+			return nil, err
+		}
+		template = append(template, element)
+	}
+	if cp.syntheticTemplates == nil {
+		cp.syntheticTemplates = make(map[syntheticTemplateKey][]*entities.InfoElement)
+	}
+	cp.syntheticTemplates[key] = template
+	return template, nil
+}
+
+// deleteExpiredTemplate deletes the template only if it has not been refreshed
+// or redefined since it was scheduled to expire.
+func (cp *CollectingProcess) deleteExpiredTemplate(key templateKey, template *templateValue) {
+	cp.mutex.Lock()
+	if cp.templatesMap[key.sessionID][key.obsDomainID][key.templateID] != template {
+		cp.mutex.Unlock()
+		return
+	}
+	delete(cp.templatesMap[key.sessionID][key.obsDomainID], key.templateID)
+	cp.templatesChanged = true
+	cp.metrics.addTemplateExpiration()
+	callback := cp.templateExpiryCallBack
+	cp.mutex.Unlock()
+
+	klog.Infof("Template with id %d, and obsDomainID %d from %s is expired.", key.templateID, key.obsDomainID, key.sessionID)
+	if callback != nil {
+		callback(key.sessionID, key.obsDomainID, key.templateID)
+	}
+}
+
+// getTemplateCount returns the number of templates of all the transport sessions.
+func (cp *CollectingProcess) getTemplateCount() int {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	count := 0
+	for _, obsDomainTemplates := range cp.templatesMap {
+		for _, templates := range obsDomainTemplates {
+			count += len(templates)
+		}
+	}
+	return count
+}
+
+// deleteSessionTemplates deletes all the templates of the transport session,
+// which is required when the session is closed (tcp only).
+func (cp *CollectingProcess) deleteSessionTemplates(sessionID string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	for obsDomainID, templates := range cp.templatesMap[sessionID] {
+		for templateID := range templates {
+			cp.templateExpiry.cancel(templateKey{sessionID, obsDomainID, templateID})
+		}
+	}
+	delete(cp.templatesMap, sessionID)
+	cp.templatesChanged = true
+}
+
+// getExportAddress returns the IP address of the exporter from its transport
+// session ID, which is its address and port.
+func getExportAddress(sessionID string) string {
+	// handle IPv6 address which may involve []
+	portIndex := strings.LastIndex(sessionID, ":")
+	exportAddress := sessionID[:portIndex]
+	exportAddress = strings.Replace(exportAddress, "[", "", -1)
+	exportAddress = strings.Replace(exportAddress, "]", "", -1)
+	return exportAddress
 }
 
 func (cp *CollectingProcess) updateAddress(address net.Addr) {
@@ -365,9 +1041,50 @@ func getMessageLength(msgBuffer *bytes.Buffer) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("cannot decode message: %v", err)
 	}
+	// NetFlow v9 header does not have the message length, so NetFlow v9
+	// messages can not be framed in a tcp stream.
+	if version != entities.IPFIXVersion {
+		return 0, fmt.Errorf("cannot decode message: version %d is not supported over tcp", version)
+	}
 	return int(msgLen), nil
 }
 
+func newTemplateValue(elementsWithValue []*entities.InfoElementWithValue, scopeFieldCount uint16, updateTime time.Time) *templateValue {
+	elements := make([]*entities.InfoElement, 0, len(elementsWithValue))
+	for _, elementWithValue := range elementsWithValue {
+		elements = append(elements, elementWithValue.Element)
+	}
+	return &templateValue{
+		elements:              elements,
+		scopeFieldCount:       scopeFieldCount,
+		hasStructuredElements: hasStructuredElements(elements),
+		updateTime:            updateTime,
+	}
+}
+
+func hasStructuredElements(elements []*entities.InfoElement) bool {
+	for _, element := range elements {
+		if entities.IsStructuredDataType(element.DataType) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMinDataRecordLen returns the minimum length of a data record for the given
+// template. Elements with variable length are considered to be one byte.
+func getMinDataRecordLen(template []*entities.InfoElement) int {
+	minLen := 0
+	for _, element := range template {
+		if element.Len == entities.VariableLength {
+			minLen = minLen + 1
+		} else {
+			minLen = minLen + int(element.Len)
+		}
+	}
+	return minLen
+}
+
 // getFieldLength returns string field length for data record
 // (encoding reference: https://tools.ietf.org/html/rfc7011#appendix-A.5)
 func getFieldLength(dataBuffer *bytes.Buffer) int {
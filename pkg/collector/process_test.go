@@ -16,15 +16,31 @@ package collector
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/pion/dtls/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/vmware/go-ipfix/pkg/entities"
@@ -60,10 +76,12 @@ func TestTCPCollectingProcess_ReceiveTemplateRecord(t *testing.T) {
 	if err != nil {
 		t.Fatalf("TCP Collecting Process does not start correctly: %v", err)
 	}
-	go cp.Start()
+	go cp.Start(context.Background())
 	// wait until collector is ready
 	waitForCollectorReady(t, cp)
 	collectorAddr := cp.GetAddress()
+	// templates of a tcp session are deleted when the connection is closed
+	done := make(chan bool)
 	go func() {
 		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
 		if err != nil {
@@ -71,10 +89,12 @@ func TestTCPCollectingProcess_ReceiveTemplateRecord(t *testing.T) {
 		}
 		defer conn.Close()
 		conn.Write(validTemplatePacket)
+		<-done
 	}()
-	<-cp.GetMsgChan()
+	message := <-cp.GetMsgChan()
+	template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
+	close(done)
 	cp.Stop()
-	template, _ := cp.getTemplate(1, 256)
 	assert.NotNil(t, template, "TCP Collecting Process should receive and store the received template.")
 }
 
@@ -84,7 +104,7 @@ func TestUDPCollectingProcess_ReceiveTemplateRecord(t *testing.T) {
 	if err != nil {
 		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
 	}
-	go cp.Start()
+	go cp.Start(context.Background())
 	// wait until collector is ready
 	waitForCollectorReady(t, cp)
 	collectorAddr := cp.GetAddress()
@@ -100,9 +120,9 @@ func TestUDPCollectingProcess_ReceiveTemplateRecord(t *testing.T) {
 		defer conn.Close()
 		conn.Write(validTemplatePacket)
 	}()
-	<-cp.GetMsgChan()
+	message := <-cp.GetMsgChan()
 	cp.Stop()
-	template, _ := cp.getTemplate(1, 256)
+	template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
 	assert.NotNil(t, template, "UDP Collecting Process should receive and store the received template.")
 
 }
@@ -110,13 +130,11 @@ func TestUDPCollectingProcess_ReceiveTemplateRecord(t *testing.T) {
 func TestTCPCollectingProcess_ReceiveDataRecord(t *testing.T) {
 	input := getCollectorInput(tcpTransport, false, false)
 	cp, err := InitCollectingProcess(input)
-	// Add the templates before sending data record
-	cp.addTemplate(uint32(1), uint16(256), elementsWithValueIPv4)
 	if err != nil {
 		t.Fatalf("TCP Collecting Process does not start correctly: %v", err)
 	}
 
-	go cp.Start()
+	go cp.Start(context.Background())
 
 	// wait until collector is ready
 	waitForCollectorReady(t, cp)
@@ -127,24 +145,24 @@ func TestTCPCollectingProcess_ReceiveDataRecord(t *testing.T) {
 			t.Errorf("Cannot establish connection to %s", collectorAddr.String())
 		}
 		defer conn.Close()
+		// Send the template before sending data record
+		conn.Write(validTemplatePacket)
 		conn.Write(validDataPacket)
 	}()
 	<-cp.GetMsgChan()
+	message := <-cp.GetMsgChan()
 	cp.Stop()
+	assert.Equal(t, uint32(1), message.GetNumberOfRecords())
 }
 
 func TestUDPCollectingProcess_ReceiveDataRecord(t *testing.T) {
 	input := getCollectorInput(udpTransport, false, false)
 	cp, err := InitCollectingProcess(input)
-	// Add the templates before sending data record
-	cp.addTemplate(uint32(1), uint16(256), elementsWithValueIPv4)
 	if err != nil {
 		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
 	}
-	// Add the templates before sending data record
-	cp.addTemplate(uint32(1), uint16(256), elementsWithValueIPv4)
 
-	go cp.Start()
+	go cp.Start(context.Background())
 	// wait until collector is ready
 	waitForCollectorReady(t, cp)
 	collectorAddr := cp.GetAddress()
@@ -158,10 +176,14 @@ func TestUDPCollectingProcess_ReceiveDataRecord(t *testing.T) {
 			t.Errorf("UDP Collecting Process does not start correctly.")
 		}
 		defer conn.Close()
+		// Send the template before sending data record
+		conn.Write(validTemplatePacket)
 		conn.Write(validDataPacket)
 	}()
 	<-cp.GetMsgChan()
+	message := <-cp.GetMsgChan()
 	cp.Stop()
+	assert.Equal(t, uint32(1), message.GetNumberOfRecords())
 }
 
 func TestTCPCollectingProcess_ConcurrentClient(t *testing.T) {
@@ -188,13 +210,13 @@ func TestTCPCollectingProcess_ConcurrentClient(t *testing.T) {
 		assert.Equal(t, 2, cp.getClientCount(), "There should be two tcp clients.")
 		cp.Stop()
 	}()
-	cp.Start()
+	cp.Start(context.Background())
 }
 
 func TestUDPCollectingProcess_ConcurrentClient(t *testing.T) {
 	input := getCollectorInput(udpTransport, false, false)
 	cp, _ := InitCollectingProcess(input)
-	go cp.Start()
+	go cp.Start(context.Background())
 	// wait until collector is ready
 	waitForCollectorReady(t, cp)
 	collectorAddr := cp.GetAddress()
@@ -221,18 +243,18 @@ func TestUDPCollectingProcess_ConcurrentClient(t *testing.T) {
 		}
 		defer conn.Close()
 		conn.Write(validTemplatePacket)
-		time.Sleep(time.Millisecond)
-		assert.Equal(t, 2, cp.getClientCount(), "There should be two udp clients.")
 	}()
 	// there should be two messages received
 	<-cp.GetMsgChan()
 	<-cp.GetMsgChan()
+	assert.Equal(t, 2, cp.getClientCount(), "There should be two udp clients.")
 	cp.Stop()
 }
 
 func TestCollectingProcess_DecodeTemplateRecord(t *testing.T) {
 	cp := CollectingProcess{}
-	cp.templatesMap = make(map[uint32]map[uint16][]*entities.InfoElement)
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
 	cp.mutex = sync.RWMutex{}
 	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
 	if err != nil {
@@ -250,7 +272,7 @@ func TestCollectingProcess_DecodeTemplateRecord(t *testing.T) {
 	}
 	assert.Equal(t, uint16(10), message.GetVersion(), "Flow record version should be 10.")
 	assert.Equal(t, uint32(1), message.GetObsDomainID(), "Flow record obsDomainID should be 1.")
-	assert.NotNil(t, cp.templatesMap[message.GetObsDomainID()], "Template should be stored in template map")
+	assert.NotNil(t, cp.templatesMap[address.String()][message.GetObsDomainID()], "Template should be stored in template map")
 
 	templateSet := message.GetSet()
 	assert.NotNil(t, templateSet, "Template record should be stored in message flowset")
@@ -263,17 +285,18 @@ func TestCollectingProcess_DecodeTemplateRecord(t *testing.T) {
 	assert.NotNil(t, err, "Error should be logged for invalid version")
 	// Malformed record
 	templateRecord = []byte{0, 10, 0, 40, 95, 40, 211, 236, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 24, 1, 0, 0, 3, 0, 8, 0, 4, 0, 12, 0, 4, 128, 105, 255, 255, 0, 0}
-	cp.templatesMap = make(map[uint32]map[uint16][]*entities.InfoElement)
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
 	_, err = cp.decodePacket(bytes.NewBuffer(templateRecord), address.String())
 	assert.NotNil(t, err, "Error should be logged for malformed template record")
-	if _, exist := cp.templatesMap[uint32(1)]; exist {
+	if _, exist := cp.templatesMap[address.String()][uint32(1)]; exist {
 		t.Fatal("Template should not be stored for malformed template record")
 	}
 }
 
 func TestCollectingProcess_DecodeDataRecord(t *testing.T) {
 	cp := CollectingProcess{}
-	cp.templatesMap = make(map[uint32]map[uint16][]*entities.InfoElement)
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
 	cp.mutex = sync.RWMutex{}
 	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
 	if err != nil {
@@ -289,7 +312,7 @@ func TestCollectingProcess_DecodeDataRecord(t *testing.T) {
 	_, err = cp.decodePacket(bytes.NewBuffer(validDataPacket), address.String())
 	assert.NotNil(t, err, "Error should be logged if corresponding template does not exist.")
 	// Decode with template
-	cp.addTemplate(uint32(1), uint16(256), elementsWithValueIPv4)
+	cp.addTemplate(address.String(), uint32(1), uint16(256), elementsWithValueIPv4, 0)
 	message, err := cp.decodePacket(bytes.NewBuffer(validDataPacket), address.String())
 	assert.Nil(t, err, "Error should not be logged if corresponding template exists.")
 	assert.Equal(t, uint16(10), message.GetVersion(), "Flow record version should be 10.")
@@ -307,211 +330,2110 @@ func TestCollectingProcess_DecodeDataRecord(t *testing.T) {
 	assert.NotNil(t, err, "Error should be logged for malformed data record")
 }
 
-func TestUDPCollectingProcess_TemplateExpire(t *testing.T) {
-	input := CollectorInput{
-		Address:       hostPortIPv4,
-		Protocol:      udpTransport,
-		MaxBufferSize: 1024,
-		TemplateTTL:   1,
-		IsEncrypted:   false,
-		ServerCert:    nil,
-		ServerKey:     nil,
-	}
+func TestCollectingProcess_SkipDataSetWithoutTemplate(t *testing.T) {
+	input := getCollectorInput(tcpTransport, false, false)
+	input.MessageQueueDepth = 1
+	input.MetricsRegistry = prometheus.NewRegistry()
 	cp, err := InitCollectingProcess(input)
 	if err != nil {
-		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+		t.Fatalf("Collecting Process does not initiate correctly: %v", err)
 	}
-	go cp.Start()
-	// wait until collector is ready
-	waitForCollectorReady(t, cp)
-	collectorAddr := cp.GetAddress()
-	go func() {
-		resolveAddr, err := net.ResolveUDPAddr(collectorAddr.Network(), collectorAddr.String())
-		if err != nil {
-			t.Errorf("UDP Address cannot be resolved.")
-		}
-		conn, err := net.DialUDP(udpTransport, nil, resolveAddr)
-		if err != nil {
-			t.Errorf("UDP Collecting Process does not start correctly.")
-		}
-		defer conn.Close()
-		_, err = conn.Write(validTemplatePacket)
-		if err != nil {
-			t.Errorf("Error in sending data to collector: %v", err)
-		}
-	}()
-	<-cp.GetMsgChan()
-	cp.Stop()
-	template, err := cp.getTemplate(1, 256)
-	assert.NotNil(t, template, "Template should be stored in the template map.")
-	assert.Nil(t, err, "Template should be stored in the template map.")
-	time.Sleep(2 * time.Second)
-	template, err = cp.getTemplate(1, 256)
-	assert.Nil(t, template, "Template should be deleted after 5 seconds.")
-	assert.NotNil(t, err, "Template should be deleted after 5 seconds.")
+	sessionID := "127.0.0.1:4739"
+	cp.addTemplate(sessionID, uint32(1), uint16(256), elementsWithValueIPv4, 0)
+	// A data set of template 257, which does not exist, followed by the data
+	// set of validDataPacket.
+	packet := []byte{0, 10, 0, 41, 95, 154, 108, 18, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 0, 8, 1, 2, 3, 4}
+	packet = append(packet, validDataPacket[entities.MsgHeaderLength:]...)
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), sessionID)
+	assert.NoError(t, err, "Data set without template should be skipped")
+	assert.Equal(t, message, <-cp.GetMsgChan())
+	assert.Equal(t, 1, len(message.GetSets()))
+	assert.Equal(t, uint32(1), message.GetNumberOfRecords())
+	sourceIPv4Address, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv4Address")
+	assert.True(t, exist)
+	assert.Equal(t, net.IP([]byte{1, 2, 3, 4}), sourceIPv4Address.Value)
+	assert.Contains(t, getMetrics(t, cp), `ipfix_collector_decode_errors_total{reason="missing_template"} 1`)
 }
 
-func TestTLSCollectingProcess(t *testing.T) {
-	input := getCollectorInput(tcpTransport, true, false)
-	cp, err := InitCollectingProcess(input)
+func TestCollectingProcess_DecodeDataRecordLazily(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.isLazyDecoding = true
+	cp.messageChan = make(chan *entities.Message, 1)
+	cp.addTemplate(hostPortIPv4, uint32(1), uint16(256), elementsWithValueIPv4, 0)
+	// two data records, the second of which has an empty string, followed by
+	// padding
+	packet := append(append([]byte{}, validDataPacket...), 10, 0, 0, 1, 10, 0, 0, 2, 0, 0, 0)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[18:20], uint16(len(packet)-entities.MsgHeaderLength))
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), hostPortIPv4)
 	if err != nil {
-		t.Fatalf("Collecting Process does not initiate correctly: %v", err)
+		t.Fatalf("Got error in decoding data records lazily: %v", err)
 	}
-	go cp.Start()
-	// wait until collector is ready
-	waitForCollectorReady(t, cp)
-	collectorAddr := cp.GetAddress()
-	go func() {
-		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM([]byte(test.FakeCACert))
-		if !ok {
-			t.Error("Failed to parse root certificate")
-		}
-		cert, err := tls.X509KeyPair([]byte(test.FakeClientCert), []byte(test.FakeClientKey))
-		if err != nil {
-			t.Error(err)
-		}
-		config := &tls.Config{
-			RootCAs:      roots,
-			Certificates: []tls.Certificate{cert},
-		}
+	<-cp.messageChan
+	records := message.GetSet().GetRecords()
+	assert.Len(t, records, 2)
+	record, ok := records[0].(entities.LazyRecord)
+	assert.True(t, ok, "Data record should be decoded lazily")
+	sourceIPv4Address, exist := record.GetInfoElementWithValue("sourceIPv4Address")
+	assert.True(t, exist)
+	assert.Equal(t, net.IP{1, 2, 3, 4}, sourceIPv4Address.Value)
+	destinationNodeName, exist := record.GetRawValue("destinationNodeName")
+	assert.True(t, exist)
+	assert.Equal(t, []byte("pod1"), destinationNodeName)
+	assert.Equal(t, "pod1", record.GetOrderedElementList()[2].Value)
+	destinationIPv4Address, exist := records[1].GetInfoElementWithValue("destinationIPv4Address")
+	assert.True(t, exist)
+	assert.Equal(t, net.IP{10, 0, 0, 2}, destinationIPv4Address.Value)
+	message.Release()
+	// A data record which is shorter than the template is an error.
+	_, err = cp.decodePacket(bytes.NewBuffer(validDataPacket[:len(validDataPacket)-2]), hostPortIPv4)
+	assert.Error(t, err)
+}
 
-		conn, err := tls.Dial("tcp", collectorAddr.String(), config)
-		if err != nil {
-			t.Error(err)
-			return
+func TestCollectingProcess_DecodeUnknownElements(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
 		}
-		defer conn.Close()
-		_, err = conn.Write(validTemplatePacket)
-		assert.NoError(t, err)
 	}()
-	<-cp.GetMsgChan()
-	cp.Stop()
-	assert.NotNil(t, cp.templatesMap[1], "TLS Collecting Process should receive and store the received template.")
+	// Template 256 with sourceIPv4Address, unknown IANA element 1000 of variable
+	// length and unknown element 1 of enterprise 12345 with length 2, followed by
+	// a data set.
+	packet := []byte{0, 10, 0, 54, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 2, 0, 24, 1, 0, 0, 3, 0, 8, 0, 4, 3, 232, 255, 255, 128, 1, 0, 2, 0, 0, 48, 57,
+		1, 0, 0, 14, 1, 2, 3, 4, 3, 10, 11, 12, 13, 14}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NotNil(t, err, "Error should be logged for unknown elements when lenient mode is disabled")
+	_, err = cp.getTemplate(address.String(), 1, 256)
+	assert.NotNil(t, err)
+
+	cp.isLenient = true
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding unknown elements: %v", err)
+	}
+	template, err := cp.getTemplate(address.String(), 1, 256)
+	assert.NoError(t, err)
+	assert.Equal(t, "unknown_0_1000", template.elements[1].Name)
+	assert.Equal(t, entities.OctetArray, template.elements[1].DataType)
+	assert.Equal(t, entities.VariableLength, template.elements[1].Len)
+	assert.Equal(t, "unknown_12345_1", template.elements[2].Name)
+	assert.Equal(t, uint16(2), template.elements[2].Len)
+	record := message.GetSets()[1].GetRecords()[0]
+	sourceIPv4Address, exist := record.GetInfoElementWithValue("sourceIPv4Address")
+	assert.True(t, exist)
+	assert.Equal(t, net.IP([]byte{1, 2, 3, 4}), sourceIPv4Address.Value)
+	unknownIANAElement, exist := record.GetInfoElementWithValue("unknown_0_1000")
+	assert.True(t, exist)
+	assert.Equal(t, []byte{10, 11, 12}, unknownIANAElement.Value)
+	unknownEnterpriseElement, exist := record.GetInfoElementWithValue("unknown_12345_1")
+	assert.True(t, exist)
+	assert.Equal(t, []byte{13, 14}, unknownEnterpriseElement.Value)
 }
 
-func TestDTLSCollectingProcess(t *testing.T) {
-	input := getCollectorInput(udpTransport, true, false)
-	cp, err := InitCollectingProcess(input)
+func TestCollectingProcess_DecodeStructuredDataTypes(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
 	if err != nil {
-		t.Fatalf("DTLS Collecting Process does not initiate correctly: %v", err)
+		t.Error(err)
 	}
-	go cp.Start()
-	// wait until collector is ready
-	waitForCollectorReady(t, cp)
-	collectorAddr, _ := net.ResolveUDPAddr("udp", cp.GetAddress().String())
-	go func() {
-		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM([]byte(test.FakeCert2))
-		if !ok {
-			t.Error("Failed to parse root certificate")
-		}
-		config := &dtls.Config{RootCAs: roots,
-			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret}
-		conn, err := dtls.Dial("udp", collectorAddr, config)
-		if err != nil {
-			t.Error(err)
-			return
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
 		}
-		defer conn.Close()
-		_, err = conn.Write(validTemplatePacket)
-		assert.NoError(t, err)
 	}()
-	<-cp.GetMsgChan()
-	cp.Stop()
-	assert.NotNil(t, cp.templatesMap[1], "DTLS Collecting Process should receive and store the received template.")
+	// Template 257 with sourceTransportPort, and template 256 with
+	// sourceIPv4Address, basicList and subTemplateList of template 257, followed
+	// by a data set of template 256.
+	packet := []byte{0, 10, 0, 70, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 2, 0, 28, 1, 1, 0, 1, 0, 7, 0, 2, 1, 0, 0, 3, 0, 8, 0, 4, 1, 35, 255, 255, 1, 36, 255, 255,
+		1, 0, 0, 26, 1, 2, 3, 4, 9, 3, 0, 7, 0, 2, 0, 80, 1, 187, 7, 3, 1, 1, 0, 80, 1, 187}
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding structured data types: %v", err)
+	}
+	record := message.GetSets()[1].GetRecords()[0]
+	basicList, exist := record.GetInfoElementWithValue("basicList")
+	assert.True(t, exist)
+	basicListValue, ok := basicList.Value.(*entities.BasicListValue)
+	assert.True(t, ok)
+	assert.Equal(t, entities.SemanticAllOf, basicListValue.Semantic)
+	assert.Equal(t, "sourceTransportPort", basicListValue.Element.Name)
+	assert.Equal(t, []interface{}{uint16(80), uint16(443)}, basicListValue.Values)
+	subTemplateList, exist := record.GetInfoElementWithValue("subTemplateList")
+	assert.True(t, exist)
+	subTemplateListValue, ok := subTemplateList.Value.(*entities.SubTemplateListValue)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(257), subTemplateListValue.TemplateID)
+	assert.Equal(t, 2, len(subTemplateListValue.Records))
+	assert.Equal(t, uint16(443), subTemplateListValue.Records[1][0].Value)
+	// subTemplateList referring to a template that does not exist
+	packet = []byte{0, 10, 0, 42, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		1, 0, 0, 26, 1, 2, 3, 4, 9, 3, 0, 7, 0, 2, 0, 80, 1, 187, 7, 3, 1, 5, 0, 80, 1, 187}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NotNil(t, err, "Error should be logged for unknown sub-template")
 }
 
-func TestTCPCollectingProcessIPv6(t *testing.T) {
-	input := getCollectorInput(tcpTransport, false, true)
-	cp, err := InitCollectingProcess(input)
+func TestCollectingProcess_DecodeReducedSizeElements(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
 	if err != nil {
-		t.Fatalf("TCP Collecting Process does not start correctly: %v", err)
+		t.Error(err)
 	}
-	go cp.Start()
-	// wait until collector is ready
-	waitForCollectorReady(t, cp)
-	collectorAddr := cp.GetAddress()
-	go func() {
-		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
-		if err != nil {
-			t.Errorf("Cannot establish connection to %s", collectorAddr.String())
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
 		}
-		defer conn.Close()
-		conn.Write(validTemplatePacketIPv6)
-		conn.Write(validDataPacketIPv6)
 	}()
-	<-cp.GetMsgChan()
-	message := <-cp.GetMsgChan()
-	cp.Stop()
-	template, _ := cp.getTemplate(1, 256)
-	assert.NotNil(t, template)
-	ie, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv6Address")
+	// Template 256 with octetDeltaCount in 4 bytes, packetDeltaCount in 2 bytes
+	// and sourceTransportPort in 1 byte, followed by a data set.
+	packet := []byte{0, 10, 0, 47, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 2, 0, 20, 1, 0, 0, 3, 0, 1, 0, 4, 0, 2, 0, 2, 0, 7, 0, 1,
+		1, 0, 0, 11, 0, 1, 0, 0, 0, 5, 80}
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding reduced-size elements: %v", err)
+	}
+	template, err := cp.getTemplate(address.String(), 1, 256)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(4), template.elements[0].Len)
+	octetDeltaCount, err := registry.GetInfoElement("octetDeltaCount", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(8), octetDeltaCount.Len, "Element in the registry should not be modified")
+	record := message.GetSets()[1].GetRecords()[0]
+	element, exist := record.GetInfoElementWithValue("octetDeltaCount")
 	assert.True(t, exist)
-	assert.Equal(t, net.ParseIP("2001:0:3238:DFE1:63::FEFB"), ie.Value)
+	assert.Equal(t, uint64(65536), element.Value)
+	element, exist = record.GetInfoElementWithValue("packetDeltaCount")
+	assert.True(t, exist)
+	assert.Equal(t, uint64(5), element.Value)
+	element, exist = record.GetInfoElementWithValue("sourceTransportPort")
+	assert.True(t, exist)
+	assert.Equal(t, uint16(80), element.Value)
+	// sourceIPv4Address does not support reduced-size encoding.
+	packet = []byte{0, 10, 0, 28, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 2, 0, 12, 1, 1, 0, 1, 0, 8, 0, 2}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.Error(t, err)
 }
 
-func TestUDPCollectingProcessIPv6(t *testing.T) {
-	input := getCollectorInput(udpTransport, false, true)
-	cp, err := InitCollectingProcess(input)
+func TestCollectingProcess_DecodeNetFlowV9(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveUDPAddr(udpTransport, hostPortIPv4)
 	if err != nil {
-		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+		t.Error(err)
 	}
-	go cp.Start()
-	// wait until collector is ready
-	waitForCollectorReady(t, cp)
-	collectorAddr := cp.GetAddress()
-	go func() {
-		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
-		if err != nil {
-			t.Errorf("Cannot establish connection to %s", collectorAddr.String())
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
 		}
-		defer conn.Close()
-		conn.Write(validTemplatePacketIPv6)
-		conn.Write(validDataPacketIPv6)
 	}()
-	<-cp.GetMsgChan()
-	message := <-cp.GetMsgChan()
-	cp.Stop()
-	template, _ := cp.getTemplate(1, 256)
-	assert.NotNil(t, template)
-	ie, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv6Address")
+	// Template flowset with template 256 of sourceIPv4Address and
+	// sourceTransportPort, and options template flowset with template 257 of
+	// interface scope, exportedMessageTotalCount in 4 bytes and
+	// exportedFlowRecordTotalCount in 4 bytes, followed by 2 bytes of padding.
+	packet := []byte{0, 9, 0, 2, 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 1, 0, 0, 0, 1,
+		0, 0, 0, 16, 1, 0, 0, 2, 0, 8, 0, 4, 0, 7, 0, 2,
+		0, 1, 0, 24, 1, 1, 0, 4, 0, 8, 0, 2, 0, 4, 0, 41, 0, 4, 0, 42, 0, 4, 0, 0}
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding NetFlow v9 templates: %v", err)
+	}
+	assert.Equal(t, entities.NetFlowV9Version, message.GetVersion())
+	assert.Equal(t, uint16(60), message.GetMessageLen())
+	assert.Equal(t, uint32(1000), message.GetSysUpTime())
+	assert.Equal(t, uint32(1603955583), message.GetExportTime())
+	assert.Equal(t, uint32(1), message.GetSequenceNum())
+	assert.Equal(t, uint32(1), message.GetObsDomainID())
+	assert.Equal(t, entities.Template, message.GetSets()[0].GetSetType())
+	assert.Equal(t, entities.OptionsTemplate, message.GetSets()[1].GetSetType())
+	template, err := cp.getTemplate(address.String(), 1, 256)
+	assert.NoError(t, err)
+	assert.Equal(t, "sourceIPv4Address", template.elements[0].Name)
+	assert.Equal(t, "sourceTransportPort", template.elements[1].Name)
+	template, err = cp.getTemplate(address.String(), 1, 257)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), template.scopeFieldCount)
+	assert.Equal(t, "ingressInterface", template.elements[0].Name)
+	assert.Equal(t, uint16(4), template.elements[1].Len)
+
+	// Data flowset of template 256 with padding, and data flowset of options template 257
+	packet = []byte{0, 9, 0, 2, 0, 0, 3, 240, 95, 154, 107, 128, 0, 0, 0, 2, 0, 0, 0, 1,
+		1, 0, 0, 12, 1, 2, 3, 4, 0, 80, 0, 0,
+		1, 1, 0, 16, 0, 0, 0, 5, 0, 0, 0, 10, 0, 0, 0, 20}
+	message, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding NetFlow v9 data: %v", err)
+	}
+	assert.Equal(t, uint32(2), message.GetNumberOfRecords())
+	record := message.GetSets()[0].GetRecords()[0]
+	element, exist := record.GetInfoElementWithValue("sourceIPv4Address")
 	assert.True(t, exist)
-	assert.Equal(t, net.ParseIP("2001:0:3238:DFE1:63::FEFB"), ie.Value)
+	assert.Equal(t, net.IP([]byte{1, 2, 3, 4}), element.Value)
+	element, exist = record.GetInfoElementWithValue("sourceTransportPort")
+	assert.True(t, exist)
+	assert.Equal(t, uint16(80), element.Value)
+	record = message.GetSets()[1].GetRecords()[0]
+	element, exist = record.GetInfoElementWithValue("ingressInterface")
+	assert.True(t, exist)
+	assert.Equal(t, uint32(5), element.Value)
+	element, exist = record.GetInfoElementWithValue("exportedFlowRecordTotalCount")
+	assert.True(t, exist)
+	assert.Equal(t, uint64(20), element.Value)
+	// NetFlow v9 sequence numbers count packets.
+	assert.Equal(t, SequenceStats{}, cp.GetTotalSequenceStats())
+	// NetFlow v9 packets can not be framed in a tcp stream.
+	_, err = getMessageLength(bytes.NewBuffer(packet))
+	assert.Error(t, err)
+
+	// Template ID is reserved
+	packet = []byte{0, 9, 0, 1, 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 3, 0, 0, 0, 1,
+		0, 0, 0, 12, 0, 1, 0, 1, 0, 8, 0, 4}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.Error(t, err)
+	// Scope length of options template is 0
+	packet = []byte{0, 9, 0, 1, 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 3, 0, 0, 0, 1,
+		0, 1, 0, 16, 1, 1, 0, 0, 0, 4, 0, 41, 0, 4, 0, 0}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.Error(t, err)
+	// Packet is shorter than the header
+	_, err = cp.decodePacket(bytes.NewBuffer(packet[:18]), address.String())
+	assert.Error(t, err)
+	// Unsupported version
+	packet[1] = 8
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.Error(t, err)
 }
 
-func getCollectorInput(network string, isEncrypted bool, isIPv6 bool) CollectorInput {
-	if network == tcpTransport {
-		var address string
-		if isIPv6 {
-			address = hostPortIPv6
-		} else {
-			address = hostPortIPv4
+func TestCollectingProcess_DecodeNetFlowV5(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveUDPAddr(udpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
 		}
-		if isEncrypted {
-			return CollectorInput{
-				Address:       address,
-				Protocol:      tcpTransport,
-				MaxBufferSize: 1024,
-				TemplateTTL:   0,
-				IsEncrypted:   true,
-				CACert:        []byte(test.FakeCACert),
-				ServerCert:    []byte(test.FakeCert),
-				ServerKey:     []byte(test.FakeKey),
-			}
-		} else {
-			return CollectorInput{
-				Address:       address,
-				Protocol:      tcpTransport,
-				MaxBufferSize: 1024,
-			}
+	}()
+	header := []byte{0, 5, 0, 2, 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 10, 1, 2, 0, 0}
+	record := []byte{10, 0, 0, 1, 10, 0, 0, 2, 10, 0, 0, 254, 0, 1, 0, 2,
+		0, 0, 0, 10, 0, 0, 5, 220, 0, 0, 1, 0, 0, 0, 2, 0,
+		4, 210, 0, 80, 0, 0x12, 6, 0, 0xfd, 0xe8, 0xfd, 0xe9, 24, 16, 0, 0}
+	packet := append(append(header, record...), record...)
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding NetFlow v5 packet: %v", err)
+	}
+	assert.Equal(t, entities.NetFlowV5Version, message.GetVersion())
+	assert.Equal(t, uint16(120), message.GetMessageLen())
+	assert.Equal(t, uint32(1000), message.GetSysUpTime())
+	assert.Equal(t, uint32(10), message.GetSequenceNum())
+	assert.Equal(t, uint32(0x102), message.GetObsDomainID())
+	assert.Equal(t, 1, len(message.GetSets()))
+	assert.Equal(t, entities.Data, message.GetSet().GetSetType())
+	assert.Equal(t, uint32(2), message.GetNumberOfRecords())
+	dataRecord := message.GetSet().GetRecords()[1]
+	assert.Equal(t, netFlowV5TemplateID, dataRecord.GetTemplateID())
+	assert.Equal(t, 18, len(dataRecord.GetOrderedElementList()))
+	expectedValues := map[string]interface{}{
+		"sourceIPv4Address":           net.IP([]byte{10, 0, 0, 1}),
+		"destinationIPv4Address":      net.IP([]byte{10, 0, 0, 2}),
+		"ipNextHopIPv4Address":        net.IP([]byte{10, 0, 0, 254}),
+		"ingressInterface":            uint32(1),
+		"egressInterface":             uint32(2),
+		"packetDeltaCount":            uint64(10),
+		"octetDeltaCount":             uint64(1500),
+		"flowStartSysUpTime":          uint32(256),
+		"flowEndSysUpTime":            uint32(512),
+		"sourceTransportPort":         uint16(1234),
+		"destinationTransportPort":    uint16(80),
+		"tcpControlBits":              uint16(0x12),
+		"protocolIdentifier":          uint8(6),
+		"ipClassOfService":            uint8(0),
+		"bgpSourceAsNumber":           uint32(65000),
+		"bgpDestinationAsNumber":      uint32(65001),
+		"sourceIPv4PrefixLength":      uint8(24),
+		"destinationIPv4PrefixLength": uint8(16),
+	}
+	for name, value := range expectedValues {
+		element, exist := dataRecord.GetInfoElementWithValue(name)
+		assert.True(t, exist, "Element %s should be in the record", name)
+		assert.Equal(t, value, element.Value, "Value of element %s is not correct", name)
+	}
+	octetDeltaCount, _ := registry.GetInfoElement("octetDeltaCount", registry.IANAEnterpriseID)
+	assert.Equal(t, uint16(8), octetDeltaCount.Len, "Element in the registry should not be modified")
+	// Flow sequence of NetFlow v5 counts flow records.
+	header[19] = 12
+	_, err = cp.decodePacket(bytes.NewBuffer(append(header, append(record, record...)...)), address.String())
+	assert.NoError(t, err)
+	assert.Equal(t, SequenceStats{}, cp.GetTotalSequenceStats())
+
+	// Packet is shorter than the record count
+	_, err = cp.decodePacket(bytes.NewBuffer(append(header, record...)), address.String())
+	assert.Error(t, err)
+	// Packet is shorter than the header
+	_, err = cp.decodePacket(bytes.NewBuffer(header[:20]), address.String())
+	assert.Error(t, err)
+}
+
+func TestCollectingProcess_DecodeSFlow(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveUDPAddr(udpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
 		}
-	} else {
-		var address string
-		if isIPv6 {
-			address = hostPortIPv6
-		} else {
-			address = hostPortIPv4
+	}()
+	encode := func(values ...uint32) []byte {
+		b := make([]byte, 4*len(values))
+		for i, value := range values {
+			binary.BigEndian.PutUint32(b[4*i:], value)
+		}
+		return b
+	}
+	// Version, agent address 192.168.0.1, sub agent ID, sequence number, uptime and sample count
+	header := encode(5, 1, 0xc0a80001, 7, 100, 5000, 2)
+	// Ethernet frame with VLAN 10 of a TCP SYN-ACK from 10.0.0.1:1234 to 10.0.0.2:80
+	sampledHeader := []byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 0x81, 0, 0, 10, 0x08, 0,
+		0x45, 0x10, 0, 40, 0, 0, 0x40, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+		4, 210, 0, 80, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, 0x12, 0, 0, 0, 0, 0, 0, 0, 0}
+	flowRecord := append(encode(1, 76, 1, 1518, 4, 58), sampledHeader...)
+	flowSample := append(encode(1, 116, 1, 3, 100, 1000, 0, 1, 2, 1), flowRecord...)
+	counterRecord := encode(1, 88, 3, 6, 0, 1000000000, 1, 3, 0, 1000, 10, 1, 2, 0, 0, 0, 0, 2000, 20, 3, 4, 0, 0, 0)
+	counterSample := append(encode(2, 108, 1, 3, 1), counterRecord...)
+	packet := append(append(header, flowSample...), counterSample...)
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding sFlow datagram: %v", err)
+	}
+	assert.Equal(t, entities.SFlowV5Version, message.GetVersion())
+	assert.Equal(t, uint16(len(packet)), message.GetMessageLen())
+	assert.Equal(t, uint32(5000), message.GetSysUpTime())
+	assert.Equal(t, uint32(100), message.GetSequenceNum())
+	assert.Equal(t, uint32(7), message.GetObsDomainID())
+	assert.Equal(t, 2, len(message.GetSets()))
+	flowDataRecord := message.GetSets()[0].GetRecords()[0]
+	assert.Equal(t, sFlowIPv4TemplateID, flowDataRecord.GetTemplateID())
+	assert.Equal(t, len(sFlowIPv4Fields), len(flowDataRecord.GetOrderedElementList()))
+	expectedValues := map[string]interface{}{
+		"samplingPacketInterval":   uint32(100),
+		"ingressInterface":         uint32(1),
+		"egressInterface":          uint32(2),
+		"layer2OctetDeltaCount":    uint64(1518),
+		"sourceMacAddress":         net.HardwareAddr([]byte{0, 0, 0, 0, 0, 1}),
+		"destinationMacAddress":    net.HardwareAddr([]byte{0, 0, 0, 0, 0, 2}),
+		"vlanId":                   uint16(10),
+		"ethernetType":             uint16(0x0800),
+		"sourceIPv4Address":        net.IP([]byte{10, 0, 0, 1}),
+		"destinationIPv4Address":   net.IP([]byte{10, 0, 0, 2}),
+		"ipClassOfService":         uint8(0x10),
+		"ipTTL":                    uint8(64),
+		"protocolIdentifier":       uint8(6),
+		"sourceTransportPort":      uint16(1234),
+		"destinationTransportPort": uint16(80),
+		"tcpControlBits":           uint16(0x12),
+	}
+	for name, value := range expectedValues {
+		element, exist := flowDataRecord.GetInfoElementWithValue(name)
+		assert.True(t, exist, "Element %s should be in the record", name)
+		assert.Equal(t, value, element.Value, "Value of element %s is not correct", name)
+	}
+	counterDataRecord := message.GetSets()[1].GetRecords()[0]
+	assert.Equal(t, sFlowCountersTemplateID, counterDataRecord.GetTemplateID())
+	expectedValues = map[string]interface{}{
+		"ingressInterface":                 uint32(3),
+		"ingressInterfaceType":             uint32(6),
+		"layer2OctetTotalCount":            uint64(1000),
+		"ingressUnicastPacketTotalCount":   uint64(10),
+		"ingressMulticastPacketTotalCount": uint64(1),
+		"ingressBroadcastPacketTotalCount": uint64(2),
+		"postLayer2OctetTotalCount":        uint64(2000),
+		"egressUnicastPacketTotalCount":    uint64(20),
+		"postMCastPacketTotalCount":        uint64(3),
+		"egressBroadcastPacketTotalCount":  uint64(4),
+	}
+	for name, value := range expectedValues {
+		element, exist := counterDataRecord.GetInfoElementWithValue(name)
+		assert.True(t, exist, "Element %s should be in the record", name)
+		assert.Equal(t, value, element.Value, "Value of element %s is not correct", name)
+	}
+
+	// IPv6 header of a UDP packet from [2001:db8::1]:53 to [2001:db8::2]:5353 in
+	// two expanded flow samples, whose records are in the same data set.
+	sampledHeader = []byte{0x60, 0, 0, 0, 0, 8, 17, 255,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		0, 53, 0x14, 0xe9, 0, 8, 0, 0}
+	flowRecord = append(encode(1, 64, 12, 48, 0, 48), sampledHeader...)
+	flowSample = append(encode(3, 116, 1, 0, 3, 100, 1000, 0, 0, 1, 0, 2, 1), flowRecord...)
+	header = encode(5, 1, 0xc0a80001, 7, 101, 6000, 2)
+	message, err = cp.decodePacket(bytes.NewBuffer(append(append(header, flowSample...), flowSample...)), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding sFlow datagram: %v", err)
+	}
+	assert.Equal(t, 1, len(message.GetSets()))
+	assert.Equal(t, uint32(2), message.GetNumberOfRecords())
+	flowDataRecord = message.GetSet().GetRecords()[1]
+	assert.Equal(t, sFlowIPv6TemplateID, flowDataRecord.GetTemplateID())
+	expectedValues = map[string]interface{}{
+		"ingressInterface":         uint32(1),
+		"egressInterface":          uint32(2),
+		"ethernetType":             uint16(0x86dd),
+		"sourceIPv6Address":        net.ParseIP("2001:db8::1"),
+		"destinationIPv6Address":   net.ParseIP("2001:db8::2"),
+		"ipTTL":                    uint8(255),
+		"protocolIdentifier":       uint8(17),
+		"sourceTransportPort":      uint16(53),
+		"destinationTransportPort": uint16(5353),
+		"tcpControlBits":           uint16(0),
+		"vlanId":                   uint16(0),
+	}
+	for name, value := range expectedValues {
+		element, exist := flowDataRecord.GetInfoElementWithValue(name)
+		assert.True(t, exist, "Element %s should be in the record", name)
+		assert.Equal(t, value, element.Value, "Value of element %s is not correct", name)
+	}
+	// sFlow sequence numbers count datagrams.
+	assert.Equal(t, SequenceStats{}, cp.GetTotalSequenceStats())
+
+	// Sample is longer than the datagram
+	_, err = cp.decodePacket(bytes.NewBuffer(append(header, flowSample[:100]...)), address.String())
+	assert.Error(t, err)
+	// Agent address type is invalid
+	_, err = cp.decodePacket(bytes.NewBuffer(encode(5, 3, 0xc0a80001, 7, 102, 7000, 0)), address.String())
+	assert.Error(t, err)
+}
+
+func TestCollectingProcess_DecodeMultipleTemplateRecords(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
+		}
+	}()
+	// Template set with templates 256 and 257 followed by 2 bytes of padding.
+	packet := []byte{0, 10, 0, 54, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 38,
+		1, 0, 0, 3, 0, 8, 0, 4, 0, 12, 0, 4, 128, 101, 255, 255, 0, 0, 220, 186,
+		1, 1, 0, 2, 0, 27, 0, 16, 0, 28, 0, 16, 0, 0}
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding template set with multiple records: %v", err)
+	}
+	templateSet := message.GetSet()
+	assert.Equal(t, uint32(2), templateSet.GetNumberOfRecords())
+	assert.Equal(t, uint16(256), templateSet.GetRecords()[0].GetTemplateID())
+	assert.Equal(t, uint16(257), templateSet.GetRecords()[1].GetTemplateID())
+	template, err := cp.getTemplate(address.String(), 1, 256)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(template.elements))
+	template, err = cp.getTemplate(address.String(), 1, 257)
+	assert.NoError(t, err)
+	assert.Equal(t, "sourceIPv6Address", template.elements[0].Name)
+	// Second template record is malformed; none of the templates should be stored.
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	packet = []byte{0, 10, 0, 46, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 30,
+		1, 0, 0, 3, 0, 8, 0, 4, 0, 12, 0, 4, 128, 101, 255, 255, 0, 0, 220, 186,
+		1, 1, 0, 2, 0, 27}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NotNil(t, err, "Error should be logged for malformed template record")
+	_, err = cp.getTemplate(address.String(), 1, 256)
+	assert.NotNil(t, err, "Template should not be stored for malformed template set")
+}
+
+func TestCollectingProcess_DecodeOptionsTemplateRecord(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
+		}
+	}()
+	// Options template set with options template 257 (scope: observationDomainId,
+	// option: samplingInterval) and 2 bytes of padding, followed by a data set.
+	packet := []byte{0, 10, 0, 48, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 3, 0, 20, 1, 1, 0, 2, 0, 1, 0, 149, 0, 4, 0, 34, 0, 4, 0, 0,
+		1, 1, 0, 12, 0, 0, 0, 1, 0, 0, 0, 100}
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding options template record: %v", err)
+	}
+	optionsTemplateSet := message.GetSets()[0]
+	assert.Equal(t, entities.OptionsTemplate, optionsTemplateSet.GetSetType())
+	assert.Equal(t, uint32(1), optionsTemplateSet.GetNumberOfRecords())
+	assert.Equal(t, uint16(1), optionsTemplateSet.GetRecords()[0].GetScopeFieldCount())
+	template, err := cp.getTemplate(address.String(), 1, 257)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), template.scopeFieldCount)
+	dataSet := message.GetSets()[1]
+	assert.Equal(t, entities.Data, dataSet.GetSetType())
+	record := dataSet.GetRecords()[0]
+	assert.Equal(t, uint16(1), record.GetScopeFieldCount())
+	assert.Equal(t, "observationDomainId", record.GetOrderedElementList()[0].Element.Name)
+	samplingInterval, exist := record.GetInfoElementWithValue("samplingInterval")
+	assert.True(t, exist)
+	assert.Equal(t, uint32(100), samplingInterval.Value)
+	// Scope field count of 0 is invalid.
+	packet = []byte{0, 10, 0, 36, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 3, 0, 20, 1, 2, 0, 2, 0, 0, 0, 149, 0, 4, 0, 34, 0, 4, 0, 0}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NotNil(t, err, "Error should be logged for invalid scope field count")
+	_, err = cp.getTemplate(address.String(), 1, 258)
+	assert.NotNil(t, err)
+}
+
+func TestCollectingProcess_DecodeMultipleSets(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
+		}
+	}()
+	// Message with a template set followed by a data set with 3 bytes of padding.
+	packet := []byte{0, 10, 0, 60, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1}
+	packet = append(packet, validTemplatePacket[16:]...)
+	packet = append(packet, 1, 0, 0, 20, 1, 2, 3, 4, 5, 6, 7, 8, 4, 112, 111, 100, 49, 0, 0, 0)
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	if err != nil {
+		t.Fatalf("Got error in decoding message with multiple sets: %v", err)
+	}
+	assert.Equal(t, 2, len(message.GetSets()))
+	assert.Equal(t, entities.Template, message.GetSets()[0].GetSetType())
+	assert.Equal(t, entities.Data, message.GetSets()[1].GetSetType())
+	assert.Equal(t, uint32(2), message.GetNumberOfRecords())
+	sourcePodName, exist := message.GetSets()[1].GetRecords()[0].GetInfoElementWithValue("sourcePodName")
+	assert.True(t, exist)
+	assert.Equal(t, "pod1", sourcePodName.Value)
+	// Set length exceeding the message length
+	packet = []byte{0, 10, 0, 24, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0, 0, 20, 1, 2, 3, 4}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NotNil(t, err, "Error should be logged for invalid set length")
+}
+
+func TestCollectingProcess_DecodeTemplateWithdrawal(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	address, err := net.ResolveTCPAddr(tcpTransport, hostPortIPv4)
+	if err != nil {
+		t.Error(err)
+	}
+	cp.netAddress = address
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
+		}
+	}()
+	_, err = cp.decodePacket(bytes.NewBuffer(validTemplatePacket), address.String())
+	assert.NoError(t, err)
+	cp.addTemplate(address.String(), uint32(1), uint16(257), elementsWithValueIPv4, 0)
+	cp.addTemplate(address.String(), uint32(1), uint16(258), elementsWithValueIPv4, 1)
+	// Withdrawal of template 256
+	packet := []byte{0, 10, 0, 24, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 8, 1, 0, 0, 0}
+	message, err := cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0), message.GetSet().GetRecords()[0].GetFieldCount())
+	_, err = cp.getTemplate(address.String(), 1, 256)
+	assert.NotNil(t, err, "Template 256 should be withdrawn")
+	_, err = cp.getTemplate(address.String(), 1, 257)
+	assert.NoError(t, err)
+	// Withdrawal of all templates does not remove options templates.
+	packet = []byte{0, 10, 0, 24, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 8, 0, 2, 0, 0}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NoError(t, err)
+	_, err = cp.getTemplate(address.String(), 1, 257)
+	assert.NotNil(t, err, "Template 257 should be withdrawn")
+	_, err = cp.getTemplate(address.String(), 1, 258)
+	assert.NoError(t, err)
+	// Withdrawal of all options templates with 4 bytes of padding.
+	packet = []byte{0, 10, 0, 28, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 3, 0, 12, 0, 3, 0, 0, 0, 0, 0, 0}
+	message, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), message.GetNumberOfRecords())
+	_, err = cp.getTemplate(address.String(), 1, 258)
+	assert.NotNil(t, err, "Options template 258 should be withdrawn")
+	// Withdrawal with a reserved template ID is invalid.
+	packet = []byte{0, 10, 0, 24, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 8, 0, 3, 0, 0}
+	_, err = cp.decodePacket(bytes.NewBuffer(packet), address.String())
+	assert.NotNil(t, err, "Error should be logged for invalid template withdrawal")
+}
+
+func TestCollectingProcess_TemplateRedefinition(t *testing.T) {
+	redefinedIDs := make([]uint16, 0)
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	cp.protocol = udpTransport
+	cp.templateTTL = 1
+	fakeClock := clock.NewFakeClock(time.Now())
+	cp.templateExpiry = newExpiryScheduler(fakeClock)
+	sessionID := "127.0.0.1:4739"
+	cp.templateRedefinitionCallBack = func(obsDomainID uint32, templateID uint16, oldElements, newElements []*entities.InfoElement) {
+		assert.Equal(t, uint32(1), obsDomainID)
+		assert.Equal(t, 3, len(oldElements))
+		assert.Equal(t, 1, len(newElements))
+		redefinedIDs = append(redefinedIDs, templateID)
+	}
+	cp.addTemplate(sessionID, uint32(1), uint16(256), elementsWithValueIPv4, 0)
+	// Refreshing the template with the same layout is not a redefinition, and
+	// restarts the template lifetime.
+	fakeClock.Step(600 * time.Millisecond)
+	cp.addTemplate(sessionID, uint32(1), uint16(256), elementsWithValueIPv4, 0)
+	assert.Empty(t, redefinedIDs)
+	assert.Equal(t, 1, cp.templateExpiry.count(), "Refreshed template should have a single expiry time")
+	_, nextExpiryTime, _ := cp.templateExpiry.popExpired(fakeClock.Now().Add(600 * time.Millisecond))
+	assert.Equal(t, fakeClock.Now().Add(time.Second), nextExpiryTime, "Refreshed template should not expire")
+	// Redefining the template with a different layout notifies the callback.
+	cp.addTemplate(sessionID, uint32(1), uint16(256), elementsWithValueIPv4[:1], 0)
+	assert.Equal(t, []uint16{256}, redefinedIDs)
+	template, err := cp.getTemplate(sessionID, 1, 256)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(template.elements))
+}
+
+func TestCollectingProcess_TemplatesPerSession(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	cp.protocol = tcpTransport
+	cp.messageChan = make(chan *entities.Message)
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
+		}
+	}()
+	// Two exporters define template 256 in observation domain 1 with different
+	// layouts: sourceIPv4Address in the first one, sourceTransportPort in the
+	// second one.
+	session1 := "10.0.0.1:4739"
+	session2 := "10.0.0.2:4739"
+	packet1 := []byte{0, 10, 0, 28, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 12, 1, 0, 0, 1, 0, 8, 0, 4}
+	packet2 := []byte{0, 10, 0, 28, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 12, 1, 0, 0, 1, 0, 7, 0, 2}
+	_, err := cp.decodePacket(bytes.NewBuffer(packet1), session1)
+	assert.NoError(t, err)
+	_, err = cp.decodePacket(bytes.NewBuffer(packet2), session2)
+	assert.NoError(t, err)
+
+	dataPacket := []byte{0, 10, 0, 24, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0, 0, 8, 1, 2, 3, 4}
+	message, err := cp.decodePacket(bytes.NewBuffer(dataPacket), session1)
+	assert.NoError(t, err)
+	assert.Equal(t, session1, message.GetSessionID())
+	assert.Equal(t, "10.0.0.1", message.GetExportAddress())
+	_, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv4Address")
+	assert.True(t, exist)
+	dataPacket = []byte{0, 10, 0, 24, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0, 0, 8, 0, 80, 1, 187}
+	message, err = cp.decodePacket(bytes.NewBuffer(dataPacket), session2)
+	assert.NoError(t, err)
+	assert.Equal(t, session2, message.GetSessionID())
+	assert.Equal(t, 2, len(message.GetSet().GetRecords()))
+	_, exist = message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceTransportPort")
+	assert.True(t, exist)
+	// Template of another session can not be used to decode data records.
+	_, err = cp.decodePacket(bytes.NewBuffer(dataPacket), "10.0.0.3:4739")
+	assert.Error(t, err)
+
+	cp.deleteSessionTemplates(session1)
+	_, err = cp.getTemplate(session1, 1, 256)
+	assert.Error(t, err)
+	_, err = cp.getTemplate(session2, 1, 256)
+	assert.NoError(t, err)
+}
+
+func TestCollectingProcess_SequenceNumberTracking(t *testing.T) {
+	type sequenceEvent struct {
+		obsDomainID uint32
+		event       SequenceEvent
+		expected    uint32
+		received    uint32
+	}
+	events := make([]sequenceEvent, 0)
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.mutex = sync.RWMutex{}
+	cp.protocol = tcpTransport
+	cp.messageChan = make(chan *entities.Message)
+	cp.sequenceNumberCallBack = func(sessionID string, obsDomainID uint32, event SequenceEvent, expected, received uint32) {
+		assert.Equal(t, "127.0.0.1:4739", sessionID)
+		events = append(events, sequenceEvent{obsDomainID, event, expected, received})
+	}
+	go func() { // remove the message from the message channel
+		for range cp.GetMsgChan() {
+		}
+	}()
+	// getPacket returns a message with template 256 of sourceIPv4Address if
+	// numRecords is 0, or a data set with numRecords records otherwise.
+	getPacket := func(obsDomainID uint32, seqNumber uint32, numRecords int) *bytes.Buffer {
+		packet := []byte{0, 10, 0, 0, 95, 154, 107, 127}
+		packet = append(packet, byte(seqNumber>>24), byte(seqNumber>>16), byte(seqNumber>>8), byte(seqNumber))
+		packet = append(packet, byte(obsDomainID>>24), byte(obsDomainID>>16), byte(obsDomainID>>8), byte(obsDomainID))
+		if numRecords == 0 {
+			packet = append(packet, 0, 2, 0, 12, 1, 0, 0, 1, 0, 8, 0, 4)
+		} else {
+			packet = append(packet, 1, 0, 0, byte(4+4*numRecords))
+			for i := 0; i < numRecords; i++ {
+				packet = append(packet, 1, 2, 3, 4)
+			}
+		}
+		packet[3] = byte(len(packet))
+		return bytes.NewBuffer(packet)
+	}
+	sessionID := "127.0.0.1:4739"
+	for _, packet := range []*bytes.Buffer{
+		// Template messages do not increase the sequence number.
+		getPacket(1, 0, 0),
+		getPacket(1, 0, 2),
+		getPacket(1, 2, 1),
+		// Records 3 to 5 are lost.
+		getPacket(1, 6, 1),
+		// Record 4 arrives out of order.
+		getPacket(1, 4, 1),
+		getPacket(1, 7, 1),
+		// Exporter restarts.
+		getPacket(1, 0, 0),
+		getPacket(1, 0, 1),
+		// Sequence number of another domain wraps around.
+		getPacket(2, 0xffffffff, 0),
+		getPacket(2, 0xffffffff, 2),
+		getPacket(2, 1, 1),
+	} {
+		_, err := cp.decodePacket(packet, sessionID)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []sequenceEvent{
+		{1, SequenceGap, 3, 6},
+		{1, SequenceReorder, 7, 4},
+		{1, SequenceReset, 8, 0},
+	}, events)
+	stats, exist := cp.GetSequenceStats(sessionID, 1)
+	assert.True(t, exist)
+	assert.Equal(t, SequenceStats{Gaps: 1, LostRecords: 3, Reorders: 1, Resets: 1}, stats)
+	stats, exist = cp.GetSequenceStats(sessionID, 2)
+	assert.True(t, exist)
+	assert.Equal(t, SequenceStats{}, stats)
+	_, exist = cp.GetSequenceStats("127.0.0.1:4740", 1)
+	assert.False(t, exist)
+
+	cp.deleteSessionSequenceStates(sessionID)
+	_, exist = cp.GetSequenceStats(sessionID, 1)
+	assert.False(t, exist)
+	assert.Equal(t, SequenceStats{Gaps: 1, LostRecords: 3, Reorders: 1, Resets: 1}, cp.GetTotalSequenceStats())
+
+	// Sequence numbers are checked without taking the mutex of the templates
+	// and clients.
+	message := entities.NewMessage(true)
+	message.SetVersion(entities.IPFIXVersion)
+	message.SetObsDomainID(1)
+	cp.mutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		cp.checkSequenceNumber(sessionID, message)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Checking the sequence number is blocked by the mutex of the collecting process")
+	}
+	cp.mutex.Unlock()
+	<-done
+	_, exist = cp.GetSequenceStats(sessionID, 1)
+	assert.True(t, exist)
+}
+
+func TestCollectingProcess_OverflowPolicy(t *testing.T) {
+	address := "127.0.0.1:4739"
+	for _, tc := range []struct {
+		policy          OverflowPolicy
+		expectedSetType entities.ContentType
+		expectedDrops   map[string]uint64
+		expectedQueued  int
+	}{
+		{OverflowDropNewest, entities.Template, map[string]uint64{"127.0.0.1": 1}, 0},
+		{OverflowDropOldest, entities.Data, map[string]uint64{"127.0.0.1": 1}, 0},
+		{OverflowBlock, entities.Template, map[string]uint64{}, 1},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			input := getCollectorInput(tcpTransport, false, false)
+			input.MessageQueueDepth = 1
+			input.OverflowPolicy = tc.policy
+			cp, err := InitCollectingProcess(input)
+			if err != nil {
+				t.Fatalf("Collecting Process does not initiate correctly: %v", err)
+			}
+			_, err = cp.decodePacket(bytes.NewBuffer(validTemplatePacket), address)
+			assert.NoError(t, err)
+			// the message queue is full, and the data message is only queued
+			// once the template message is consumed when the exporter is blocked
+			done := make(chan bool)
+			go func() {
+				_, err := cp.decodePacket(bytes.NewBuffer(validDataPacket), address)
+				assert.NoError(t, err)
+				close(done)
+			}()
+			if tc.policy != OverflowBlock {
+				<-done
+			}
+			message := <-cp.GetMsgChan()
+			assert.Equal(t, tc.expectedSetType, message.GetSet().GetSetType())
+			assert.Equal(t, tc.expectedDrops, cp.GetDroppedMessageCounts())
+			<-done
+			assert.Len(t, cp.GetMsgChan(), tc.expectedQueued)
+		})
+	}
+
+	input := getCollectorInput(tcpTransport, false, false)
+	input.OverflowPolicy = OverflowDropOldest
+	_, err := InitCollectingProcess(input)
+	assert.Error(t, err, "Overflow policy drop-oldest should require a message queue")
+	input.MessageQueueDepth = -1
+	input.OverflowPolicy = OverflowBlock
+	_, err = InitCollectingProcess(input)
+	assert.Error(t, err, "Message queue depth should not be negative")
+}
+
+func TestCollectingProcess_ReleaseMessage(t *testing.T) {
+	cp := CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.messageChan = make(chan *entities.Message, 1)
+	_, err := cp.decodePacket(bytes.NewBuffer(validTemplatePacket), hostPortIPv4)
+	assert.NoError(t, err)
+	<-cp.messageChan
+	// The second message can reuse the packet buffer, sets and records of the
+	// first message once it is released.
+	otherDataPacket := append([]byte{}, validDataPacket...)
+	copy(otherDataPacket[20:28], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	for _, tc := range []struct {
+		packet        []byte
+		sourceAddress net.IP
+	}{
+		{validDataPacket, net.IP{1, 2, 3, 4}},
+		{otherDataPacket, net.IP{10, 0, 0, 1}},
+	} {
+		buffer := cp.getPacketBuffer(len(tc.packet))
+		copy(*buffer, tc.packet)
+		cp.decodeClientPacket(packet{buffer, len(tc.packet)}, hostPortIPv4)
+		message := <-cp.messageChan
+		record := message.GetSet().GetRecords()[0]
+		sourceIPv4Address, exist := record.GetInfoElementWithValue("sourceIPv4Address")
+		assert.True(t, exist)
+		assert.Equal(t, tc.sourceAddress, sourceIPv4Address.Value)
+		sourcePodName, exist := record.GetInfoElementWithValue("sourcePodName")
+		assert.True(t, exist)
+		assert.Equal(t, "pod1", sourcePodName.Value)
+		message.Release()
+		assert.Empty(t, message.GetSets())
+	}
+}
+
+func TestTCPCollectingProcess_DeleteTemplatesOnClose(t *testing.T) {
+	input := getCollectorInput(tcpTransport, false, false)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("TCP Collecting Process does not start correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+	if err != nil {
+		t.Fatalf("Cannot establish connection to %s", collectorAddr.String())
+	}
+	conn.Write(validTemplatePacket)
+	message := <-cp.GetMsgChan()
+	assert.Equal(t, conn.LocalAddr().String(), message.GetSessionID())
+	_, err = cp.getTemplate(message.GetSessionID(), 1, 256)
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		_, err := cp.getTemplate(message.GetSessionID(), 1, 256)
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "Templates should be deleted when the tcp connection is closed")
+	cp.Stop()
+}
+
+func TestTCPCollectingProcess_ReassembleMessages(t *testing.T) {
+	input := getCollectorInput(tcpTransport, false, false)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("TCP Collecting Process does not start correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+	if err != nil {
+		t.Fatalf("Cannot establish connection to %s", collectorAddr.String())
+	}
+	defer conn.Close()
+	// Messages span multiple writes, and a write has parts of two messages.
+	conn.Write(validTemplatePacket[:10])
+	time.Sleep(50 * time.Millisecond)
+	conn.Write(append(append([]byte{}, validTemplatePacket[10:]...), validDataPacket[:5]...))
+	time.Sleep(50 * time.Millisecond)
+	conn.Write(validDataPacket[5:])
+	message := <-cp.GetMsgChan()
+	assert.Equal(t, entities.Template, message.GetSet().GetSetType())
+	message = <-cp.GetMsgChan()
+	assert.Equal(t, entities.Data, message.GetSet().GetSetType())
+	assert.Equal(t, uint32(1), message.GetNumberOfRecords())
+	// A message which cannot be decoded is dropped without closing the connection.
+	unknownTemplateDataPacket := append([]byte{}, validDataPacket...)
+	unknownTemplateDataPacket[17] = 1
+	conn.Write(append(unknownTemplateDataPacket, validDataPacket...))
+	message = <-cp.GetMsgChan()
+	assert.Equal(t, uint16(256), message.GetSet().GetRecords()[0].GetTemplateID())
+	// A message with a corrupt header closes the connection.
+	conn.Write([]byte{0, 11, 0, 16, 95, 154, 108, 18, 0, 0, 0, 0, 0, 0, 0, 1})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "Connection should be closed by the collector")
+	cp.Stop()
+}
+
+func TestReadTCPMessage(t *testing.T) {
+	messages := append(append([]byte{}, validTemplatePacket...), validDataPacket...)
+	reader := iotest.OneByteReader(bytes.NewReader(messages))
+	buffer := make([]byte, entities.MaxTcpSocketMsgSize)
+	msg, err := readTCPMessage(reader, buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, validTemplatePacket, msg)
+	msg, err = readTCPMessage(reader, buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, validDataPacket, msg)
+	_, err = readTCPMessage(reader, buffer)
+	assert.Equal(t, io.EOF, err)
+
+	testCases := []struct {
+		name      string
+		stream    []byte
+		maxMsgLen int
+	}{
+		{"truncated header", validDataPacket[:10], entities.MaxTcpSocketMsgSize},
+		{"truncated message", validDataPacket[:20], entities.MaxTcpSocketMsgSize},
+		{"invalid version", append([]byte{0, 9}, validDataPacket[2:]...), entities.MaxTcpSocketMsgSize},
+		{"length shorter than header", append([]byte{0, 10, 0, 8}, validDataPacket[4:]...), entities.MaxTcpSocketMsgSize},
+		{"length longer than maximum", validDataPacket, 32},
+	}
+	for _, tc := range testCases {
+		_, err = readTCPMessage(bytes.NewReader(tc.stream), make([]byte, tc.maxMsgLen))
+		assert.Error(t, err, tc.name)
+		assert.NotEqual(t, io.EOF, err, tc.name)
+	}
+}
+
+func TestUDPCollectingProcess_SocketsAndWorkers(t *testing.T) {
+	numGoroutines := runtime.NumGoroutine()
+	input := getCollectorInput(udpTransport, false, false)
+	input.NumUDPSockets = 4
+	input.NumUDPWorkers = 2
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+	}
+	cp.idleTimeout = 500 * time.Millisecond
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cp.Start(context.Background())
+	}()
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	numExporters := 8
+	for i := 0; i < numExporters; i++ {
+		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			t.Fatalf("Cannot establish connection to %s: %v", collectorAddr.String(), err)
+		}
+		defer conn.Close()
+		_, err = conn.Write(validTemplatePacket)
+		assert.NoError(t, err)
+	}
+	sessionIDs := make(map[string]bool)
+	for i := 0; i < numExporters; i++ {
+		message := <-cp.GetMsgChan()
+		sessionIDs[message.GetSessionID()] = true
+		template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
+		assert.NotNil(t, template, "Template of each exporter should be stored")
+	}
+	assert.Len(t, sessionIDs, numExporters)
+	assert.Equal(t, numExporters, cp.getClientCount())
+	// idle exporters are deleted by their worker
+	assert.Eventually(t, func() bool {
+		return cp.getClientCount() == 0
+	}, 2*time.Second, 100*time.Millisecond, "Idle udp exporters should be deleted")
+	cp.Stop()
+	assert.NoError(t, <-errCh)
+	waitForGoroutines(t, numGoroutines)
+
+	input.IsEncrypted = true
+	_, err = InitCollectingProcess(input)
+	assert.Error(t, err, "Multiple udp sockets should not be supported with DTLS")
+	input = getCollectorInput(tcpTransport, false, false)
+	input.NumUDPWorkers = 2
+	_, err = InitCollectingProcess(input)
+	assert.Error(t, err, "Udp workers should not be supported with tcp")
+}
+
+func TestUDPCollectingProcess_DrainWorkers(t *testing.T) {
+	cp := &CollectingProcess{}
+	workers := []chan udpPacket{make(chan udpPacket, 4), make(chan udpPacket, 4)}
+	for i := 0; i < 4; i++ {
+		cp.dispatchUDPPacket(context.Background(), workers, fmt.Sprintf("127.0.0.1:%d", 4739+i), packet{cp.getPacketBuffer(16), 16})
+	}
+	assert.Equal(t, 4, len(workers[0])+len(workers[1]))
+	// the packets which are still queued once the workers have stopped are
+	// put back to the pool
+	for _, worker := range workers {
+		close(worker)
+	}
+	cp.drainUDPWorkers(workers)
+	assert.Empty(t, workers[0])
+	assert.Empty(t, workers[1])
+	// dispatching does not block on a full queue once the collecting process
+	// is stopped
+	workers = []chan udpPacket{make(chan udpPacket, 4)}
+	for i := 0; i < 4; i++ {
+		cp.dispatchUDPPacket(context.Background(), workers, "127.0.0.1:4739", packet{cp.getPacketBuffer(16), 16})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cp.dispatchUDPPacket(ctx, workers, "127.0.0.1:4739", packet{cp.getPacketBuffer(16), 16})
+	assert.Len(t, workers[0], 4)
+	close(workers[0])
+	cp.drainUDPWorkers(workers)
+	assert.Empty(t, workers[0])
+}
+
+func TestUDPCollectingProcess_DeleteIdleSequenceStates(t *testing.T) {
+	for _, numWorkers := range []int{0, 2} {
+		input := getCollectorInput(udpTransport, false, false)
+		input.NumUDPWorkers = numWorkers
+		cp, err := InitCollectingProcess(input)
+		if err != nil {
+			t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+		}
+		cp.idleTimeout = 500 * time.Millisecond
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- cp.Start(context.Background())
+		}()
+		waitForCollectorReady(t, cp)
+		collectorAddr := cp.GetAddress()
+		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			t.Fatalf("Cannot establish connection to %s: %v", collectorAddr.String(), err)
+		}
+		_, err = conn.Write(validTemplatePacket)
+		assert.NoError(t, err)
+		message := <-cp.GetMsgChan()
+		_, exist := cp.GetSequenceStats(message.GetSessionID(), 1)
+		assert.True(t, exist)
+		// the sequence number states of the idle exporter are deleted with its client
+		assert.Eventually(t, func() bool {
+			_, exist := cp.GetSequenceStats(message.GetSessionID(), 1)
+			return !exist && cp.getClientCount() == 0
+		}, 2*time.Second, 100*time.Millisecond, "Sequence number states of idle udp exporters should be deleted with %d workers", numWorkers)
+		conn.Close()
+		cp.Stop()
+		assert.NoError(t, <-errCh)
+	}
+}
+
+func TestUDPCollectingProcess_TemplateExpire(t *testing.T) {
+	input := CollectorInput{
+		Address:       hostPortIPv4,
+		Protocol:      udpTransport,
+		MaxBufferSize: 1024,
+		TemplateTTL:   1,
+		IsEncrypted:   false,
+		ServerCert:    nil,
+		ServerKey:     nil,
+	}
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	go func() {
+		resolveAddr, err := net.ResolveUDPAddr(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			t.Errorf("UDP Address cannot be resolved.")
+		}
+		conn, err := net.DialUDP(udpTransport, nil, resolveAddr)
+		if err != nil {
+			t.Errorf("UDP Collecting Process does not start correctly.")
+		}
+		defer conn.Close()
+		_, err = conn.Write(validTemplatePacket)
+		if err != nil {
+			t.Errorf("Error in sending data to collector: %v", err)
+		}
+	}()
+	message := <-cp.GetMsgChan()
+	defer cp.Stop()
+	template, err := cp.getTemplate(message.GetSessionID(), 1, 256)
+	assert.NotNil(t, template, "Template should be stored in the template map.")
+	assert.Nil(t, err, "Template should be stored in the template map.")
+	time.Sleep(2 * time.Second)
+	template, err = cp.getTemplate(message.GetSessionID(), 1, 256)
+	assert.Nil(t, template, "Template should be deleted after 5 seconds.")
+	assert.NotNil(t, err, "Template should be deleted after 5 seconds.")
+}
+
+func TestUDPCollectingProcess_TemplateExpiryScheduler(t *testing.T) {
+	expiredTemplates := make(chan templateKey, 10)
+	input := getCollectorInput(udpTransport, false, false)
+	input.TemplateTTL = 10
+	input.TemplateExpiryCallBack = func(sessionID string, obsDomainID uint32, templateID uint16) {
+		expiredTemplates <- templateKey{sessionID, obsDomainID, templateID}
+	}
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+	}
+	fakeClock := clock.NewFakeClock(time.Now())
+	cp.templateExpiry = newExpiryScheduler(fakeClock)
+	go cp.Start(context.Background())
+	defer cp.Stop()
+	waitForCollectorReady(t, cp)
+	// waitForScheduler waits until the scheduler has expired the templates
+	// which are due, and waits for the next expiry time.
+	waitForScheduler := func() {
+		err := wait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+			return fakeClock.HasWaiters(), nil
+		})
+		assert.NoError(t, err, "Scheduler should wait for the next expiry time")
+	}
+	nextExpiredTemplate := func() templateKey {
+		select {
+		case key := <-expiredTemplates:
+			return key
+		case <-time.After(time.Second):
+			t.Fatalf("Template should be expired")
+		}
+		return templateKey{}
+	}
+
+	sessionID := "10.0.0.1:4739"
+	cp.addTemplate(sessionID, 1, 256, elementsWithValueIPv4, 0)
+	cp.addTemplate(sessionID, 1, 257, elementsWithValueIPv4, 0)
+	cp.addTemplate(sessionID, 1, 258, elementsWithValueIPv4, 0)
+	cp.withdrawTemplate(sessionID, 1, 258, false)
+	waitForScheduler()
+	fakeClock.Step(5 * time.Second)
+	// Refreshing the template moves its expiry time instead of adding another one.
+	cp.addTemplate(sessionID, 1, 256, elementsWithValueIPv4, 0)
+	assert.Equal(t, 2, cp.templateExpiry.count())
+	waitForScheduler()
+	fakeClock.Step(5 * time.Second)
+	assert.Equal(t, templateKey{sessionID, 1, 257}, nextExpiredTemplate())
+	waitForScheduler()
+	_, err = cp.getTemplate(sessionID, 1, 256)
+	assert.NoError(t, err, "Refreshed template should not expire")
+	fakeClock.Step(4 * time.Second)
+	waitForScheduler()
+	_, err = cp.getTemplate(sessionID, 1, 256)
+	assert.NoError(t, err, "Refreshed template should not expire")
+	fakeClock.Step(time.Second)
+	assert.Equal(t, templateKey{sessionID, 1, 256}, nextExpiredTemplate())
+	// The withdrawn template does not expire.
+	assert.Empty(t, expiredTemplates)
+	assert.Equal(t, 0, cp.getTemplateCount())
+	assert.Equal(t, 0, cp.templateExpiry.count())
+}
+
+func TestUDPCollectingProcess_TemplateStore(t *testing.T) {
+	storeDir := t.TempDir()
+	// The exporter keeps the same address and port across the restart of the
+	// collecting process, so that it is the same transport session.
+	exporterConn, err := net.ListenUDP(udpTransport, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Cannot open exporter socket: %v", err)
+	}
+	defer exporterConn.Close()
+	for i, packet := range [][]byte{validTemplatePacket, validDataPacket} {
+		input := getCollectorInput(udpTransport, false, false)
+		input.TemplateStoreDir = storeDir
+		cp, err := InitCollectingProcess(input)
+		if err != nil {
+			t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+		}
+		startDone := make(chan struct{})
+		go func() {
+			defer close(startDone)
+			cp.Start(context.Background())
+		}()
+		waitForCollectorReady(t, cp)
+		_, err = exporterConn.WriteTo(packet, cp.GetAddress())
+		assert.NoError(t, err)
+		message := <-cp.GetMsgChan()
+		if i == 0 {
+			assert.Equal(t, entities.Template, message.GetSet().GetSetType())
+		} else {
+			// the data record is decoded with the template of the previous
+			// collecting process
+			assert.Equal(t, entities.Data, message.GetSet().GetSetType())
+			sourceIPv4Address, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv4Address")
+			assert.True(t, exist)
+			assert.Equal(t, net.IP{1, 2, 3, 4}, sourceIPv4Address.Value)
+		}
+		cp.Stop()
+		// the templates are saved when Start returns
+		<-startDone
+		_, err = os.Stat(filepath.Join(storeDir, templateStoreFileName))
+		assert.NoError(t, err)
+	}
+
+	input := getCollectorInput(tcpTransport, false, false)
+	input.TemplateStoreDir = storeDir
+	_, err = InitCollectingProcess(input)
+	assert.Error(t, err, "Template store should not be supported with tcp")
+}
+
+func TestCollectingProcess_LoadTemplates(t *testing.T) {
+	storeDir := t.TempDir()
+	newCollectingProcess := func() *CollectingProcess {
+		return &CollectingProcess{
+			templatesMap:     make(map[string]map[uint32]map[uint16]*templateValue),
+			protocol:         udpTransport,
+			templateTTL:      60,
+			templateStoreDir: storeDir,
+		}
+	}
+	// no template store yet
+	cp := newCollectingProcess()
+	assert.NoError(t, cp.loadTemplates())
+	assert.Equal(t, 0, cp.getTemplateCount())
+
+	// the elements of the stored templates are checked against the registry
+	elementsWithValue := make([]*entities.InfoElementWithValue, 0)
+	for _, name := range []string{"sourceIPv4Address", "destinationIPv4Address"} {
+		element, err := registry.GetInfoElement(name, registry.IANAEnterpriseID)
+		assert.NoError(t, err)
+		elementsWithValue = append(elementsWithValue, entities.NewInfoElementWithValue(element, nil))
+	}
+	sessionID := "10.0.0.1:4739"
+	template := newTemplateValue(elementsWithValue, 0, time.Now())
+	template.updateTime = time.Now().Add(-30 * time.Second)
+	assert.True(t, cp.putTemplate(sessionID, 1, 256, template))
+	expiredTemplate := newTemplateValue(elementsWithValue, 1, time.Now())
+	expiredTemplate.updateTime = time.Now().Add(-90 * time.Second)
+	assert.False(t, cp.putTemplate(sessionID, 1, 257, expiredTemplate))
+	expiringTemplate := newTemplateValue(elementsWithValue, 1, time.Now())
+	expiringTemplate.updateTime = time.Now().Add(-50 * time.Second)
+	assert.True(t, cp.putTemplate(sessionID, 2, 258, expiringTemplate))
+	assert.NoError(t, cp.saveTemplates())
+	cp.deleteSessionTemplates(sessionID)
+
+	// templates are loaded with the remaining lifetime from their update time
+	cp = newCollectingProcess()
+	assert.NoError(t, cp.loadTemplates())
+	assert.Equal(t, 2, cp.getTemplateCount())
+	loadedTemplate, err := cp.getTemplate(sessionID, 1, 256)
+	assert.NoError(t, err)
+	assert.True(t, loadedTemplate.isSameLayout(template))
+	assert.True(t, loadedTemplate.updateTime.Equal(template.updateTime))
+	loadedTemplate, err = cp.getTemplate(sessionID, 2, 258)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), loadedTemplate.scopeFieldCount)
+	_, err = cp.getTemplate(sessionID, 1, 257)
+	assert.Error(t, err)
+	cp.deleteSessionTemplates(sessionID)
+
+	// the lifetime of a template can end after it is saved
+	cp = newCollectingProcess()
+	cp.templateTTL = 45
+	assert.NoError(t, cp.loadTemplates())
+	assert.Equal(t, 1, cp.getTemplateCount())
+	cp.deleteSessionTemplates(sessionID)
+
+	// invalid templates are skipped with the checks of the templates decoded
+	// from the wire
+	sourceIPv4Address := func(dataType entities.IEDataType, length uint16) *entities.InfoElement {
+		return &entities.InfoElement{Name: "sourceIPv4Address", ElementId: 8, DataType: dataType, EnterpriseId: 0, Len: length}
+	}
+	newStoredTemplate := func(templateID uint16, element *entities.InfoElement) storedTemplate {
+		return storedTemplate{SessionID: sessionID, ObsDomainID: 1, TemplateID: templateID, UpdateTime: time.Now(), Elements: []*entities.InfoElement{element}}
+	}
+	data, err := json.Marshal([]storedTemplate{
+		newStoredTemplate(100, sourceIPv4Address(entities.Ipv4Address, 4)),
+		newStoredTemplate(256, sourceIPv4Address(entities.Ipv4Address, 0)),
+		newStoredTemplate(257, sourceIPv4Address(entities.Ipv4Address, entities.VariableLength)),
+		newStoredTemplate(258, sourceIPv4Address(entities.IEDataType(99), 4)),
+		newStoredTemplate(259, &entities.InfoElement{Name: "unknown", ElementId: 32767, DataType: entities.OctetArray, EnterpriseId: 0, Len: 4}),
+		{SessionID: sessionID, ObsDomainID: 1, TemplateID: 260, UpdateTime: time.Now()},
+		newStoredTemplate(261, sourceIPv4Address(entities.Ipv4Address, 4)),
+	})
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(storeDir, templateStoreFileName), data, 0600)
+	assert.NoError(t, err)
+	cp = newCollectingProcess()
+	assert.NoError(t, cp.loadTemplates())
+	assert.Equal(t, 1, cp.getTemplateCount())
+	loadedTemplate, err = cp.getTemplate(sessionID, 1, 261)
+	assert.NoError(t, err)
+	assert.Equal(t, sourceIPv4Address(entities.Ipv4Address, 4), loadedTemplate.elements[0])
+	cp.deleteSessionTemplates(sessionID)
+
+	err = ioutil.WriteFile(filepath.Join(storeDir, templateStoreFileName), []byte("{"), 0600)
+	assert.NoError(t, err)
+	cp = newCollectingProcess()
+	assert.Error(t, cp.loadTemplates())
+	assert.Equal(t, 0, cp.getTemplateCount())
+}
+
+func TestUDPCollectingProcess_Metrics(t *testing.T) {
+	input := getCollectorInput(udpTransport, false, false)
+	input.TemplateTTL = 1
+	input.MetricsRegistry = prometheus.NewRegistry()
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+	}
+	_, err = InitCollectingProcess(input)
+	assert.Error(t, err, "Metrics should not be registered twice with the same registry")
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	// data set of template 257, which does not exist
+	missingTemplatePacket := append([]byte{}, validDataPacket...)
+	missingTemplatePacket[17] = 1
+	go func() {
+		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			t.Errorf("Cannot establish connection to %s", collectorAddr.String())
+			return
+		}
+		defer conn.Close()
+		conn.Write(validTemplatePacket)
+		conn.Write(validDataPacket)
+		conn.Write(missingTemplatePacket)
+	}()
+	<-cp.GetMsgChan()
+	<-cp.GetMsgChan()
+	expectedMetrics := []string{
+		`ipfix_collector_messages_received_total{exporter="127.0.0.1",transport="udp"} 3`,
+		`ipfix_collector_bytes_received_total{exporter="127.0.0.1",transport="udp"} 106`,
+		`ipfix_collector_records_received_total{exporter="127.0.0.1",transport="udp",type="data"} 1`,
+		`ipfix_collector_records_received_total{exporter="127.0.0.1",transport="udp",type="template"} 1`,
+		`ipfix_collector_decode_errors_total{reason="missing_template"} 1`,
+		`ipfix_collector_active_clients 1`,
+		`ipfix_collector_message_queue_length 0`,
+		`ipfix_collector_template_expirations_total 1`,
+		`ipfix_collector_templates 0`,
+	}
+	// the template expires after its lifetime of 1 second
+	var metrics string
+	for start := time.Now(); time.Since(start) < 3*time.Second; time.Sleep(100 * time.Millisecond) {
+		metrics = getMetrics(t, cp)
+		if strings.Contains(metrics, `ipfix_collector_template_expirations_total 1`) && strings.Contains(metrics, `reason="missing_template"`) {
+			break
+		}
+	}
+	for _, expectedMetric := range expectedMetrics {
+		assert.Contains(t, metrics, expectedMetric)
+	}
+	cp.Stop()
+}
+
+func TestTLSCollectingProcess(t *testing.T) {
+	input := getCollectorInput(tcpTransport, true, false)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("Collecting Process does not initiate correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	done := make(chan bool)
+	go func() {
+		roots := x509.NewCertPool()
+		ok := roots.AppendCertsFromPEM([]byte(test.FakeCACert))
+		if !ok {
+			t.Error("Failed to parse root certificate")
+		}
+		cert, err := tls.X509KeyPair([]byte(test.FakeClientCert), []byte(test.FakeClientKey))
+		if err != nil {
+			t.Error(err)
+		}
+		config := &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert},
+		}
+
+		conn, err := tls.Dial("tcp", collectorAddr.String(), config)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write(validTemplatePacket)
+		assert.NoError(t, err)
+		<-done
+	}()
+	message := <-cp.GetMsgChan()
+	template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
+	close(done)
+	cp.Stop()
+	assert.NotNil(t, template, "TLS Collecting Process should receive and store the received template.")
+}
+
+func TestDTLSCollectingProcess(t *testing.T) {
+	input := getCollectorInput(udpTransport, true, false)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("DTLS Collecting Process does not initiate correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr, _ := net.ResolveUDPAddr("udp", cp.GetAddress().String())
+	// templates of a dtls association are deleted when it is closed
+	done := make(chan bool)
+	go func() {
+		conn, err := dialDTLS(collectorAddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write(validTemplatePacket)
+		assert.NoError(t, err)
+		<-done
+	}()
+	message := <-cp.GetMsgChan()
+	template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
+	close(done)
+	cp.Stop()
+	assert.NotNil(t, template, "DTLS Collecting Process should receive and store the received template.")
+}
+
+func TestDTLSCollectingProcess_CloseAssociations(t *testing.T) {
+	input := getCollectorInput(udpTransport, true, false)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("DTLS Collecting Process does not initiate correctly: %v", err)
+	}
+	cp.idleTimeout = 500 * time.Millisecond
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr, _ := net.ResolveUDPAddr("udp", cp.GetAddress().String())
+	conn1, err := dialDTLS(collectorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := dialDTLS(collectorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn1.Write(validTemplatePacket)
+	message1 := <-cp.GetMsgChan()
+	assert.Equal(t, conn1.LocalAddr().String(), message1.GetSessionID())
+	conn2.Write(validTemplatePacket)
+	message2 := <-cp.GetMsgChan()
+	assert.Equal(t, conn2.LocalAddr().String(), message2.GetSessionID())
+	assert.Equal(t, 2, cp.getClientCount())
+	// The association closed by the exporter is deleted right away.
+	conn1.Close()
+	assert.Eventually(t, func() bool {
+		_, err := cp.getTemplate(message1.GetSessionID(), 1, 256)
+		return err != nil && cp.getClientCount() == 1
+	}, 400*time.Millisecond, 10*time.Millisecond, "Templates should be deleted when the dtls association is closed")
+	// The idle association is deleted after the idle timeout.
+	assert.Eventually(t, func() bool {
+		_, err := cp.getTemplate(message2.GetSessionID(), 1, 256)
+		return err != nil && cp.getClientCount() == 0
+	}, time.Second, 10*time.Millisecond, "Templates should be deleted when the dtls association is idle")
+	cp.Stop()
+}
+
+func TestDTLSCollectingProcess_AcceptErrors(t *testing.T) {
+	cp := &CollectingProcess{address: hostPortIPv4}
+	timeoutErr := fmt.Errorf("accept: %w", os.ErrDeadlineExceeded)
+	listener := &fakeListener{errs: []error{
+		timeoutErr,
+		timeoutErr,
+		errDTLSListenerClosed,
+	}}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		cp.acceptDTLSConnections(context.Background(), listener, nil, &wg)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Accepting dtls connections should stop when the listener is closed")
+	}
+	assert.Equal(t, 3, listener.numAccepts, "Accept should not be called after the listener is closed")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(dtlsAcceptMinBackoff*3), "Timeouts should be retried with a backoff")
+
+	// other errors stop accepting associations
+	listener = &fakeListener{errs: []error{fmt.Errorf("listener error")}}
+	cp.acceptDTLSConnections(context.Background(), listener, nil, &wg)
+	assert.Equal(t, 1, listener.numAccepts)
+
+	// the backoff is interrupted when the collecting process is stopped
+	listener = &fakeListener{errs: []error{timeoutErr}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		cp.acceptDTLSConnections(ctx, listener, nil, &wg)
+	}()
+	cancel()
+	<-done
+}
+
+func TestDTLSCollectingProcess_StalledHandshake(t *testing.T) {
+	input := getCollectorInput(udpTransport, true, false)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("DTLS Collecting Process does not initiate correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	defer cp.Stop()
+	collectorAddr, _ := net.ResolveUDPAddr("udp", cp.GetAddress().String())
+	// The first exporter stalls after the first flight of its handshake.
+	udpConn, err := net.DialUDP("udp", nil, collectorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	config, err := getDTLSClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dtls.ClientWithContext(ctx, &stalledConn{Conn: udpConn}, config)
+	time.Sleep(100 * time.Millisecond)
+	// The handshake of the second exporter does not wait for the first one.
+	done := make(chan error, 1)
+	go func() {
+		conn, err := dialDTLS(collectorAddr)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("The handshake of an exporter should not be delayed by a stalled handshake")
+	}
+}
+
+func TestTCPCollectingProcessIPv6(t *testing.T) {
+	input := getCollectorInput(tcpTransport, false, true)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("TCP Collecting Process does not start correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	done := make(chan bool)
+	go func() {
+		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			t.Errorf("Cannot establish connection to %s", collectorAddr.String())
+		}
+		defer conn.Close()
+		conn.Write(validTemplatePacketIPv6)
+		conn.Write(validDataPacketIPv6)
+		<-done
+	}()
+	<-cp.GetMsgChan()
+	message := <-cp.GetMsgChan()
+	template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
+	close(done)
+	cp.Stop()
+	assert.NotNil(t, template)
+	ie, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv6Address")
+	assert.True(t, exist)
+	assert.Equal(t, net.ParseIP("2001:0:3238:DFE1:63::FEFB"), ie.Value)
+}
+
+func TestUDPCollectingProcessIPv6(t *testing.T) {
+	input := getCollectorInput(udpTransport, false, true)
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	// wait until collector is ready
+	waitForCollectorReady(t, cp)
+	collectorAddr := cp.GetAddress()
+	go func() {
+		conn, err := net.Dial(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			t.Errorf("Cannot establish connection to %s", collectorAddr.String())
+		}
+		defer conn.Close()
+		conn.Write(validTemplatePacketIPv6)
+		conn.Write(validDataPacketIPv6)
+	}()
+	<-cp.GetMsgChan()
+	message := <-cp.GetMsgChan()
+	cp.Stop()
+	template, _ := cp.getTemplate(message.GetSessionID(), 1, 256)
+	assert.NotNil(t, template)
+	ie, exist := message.GetSet().GetRecords()[0].GetInfoElementWithValue("sourceIPv6Address")
+	assert.True(t, exist)
+	assert.Equal(t, net.ParseIP("2001:0:3238:DFE1:63::FEFB"), ie.Value)
+}
+
+func TestCollectingProcess_StartStop(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		network     string
+		isEncrypted bool
+	}{
+		{"tcp", tcpTransport, false},
+		{"udp", udpTransport, false},
+		{"dtls", udpTransport, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			numGoroutines := runtime.NumGoroutine()
+			cp, err := InitCollectingProcess(getCollectorInput(tc.network, tc.isEncrypted, false))
+			if err != nil {
+				t.Fatalf("Collecting Process does not initiate correctly: %v", err)
+			}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- cp.Start(context.Background())
+			}()
+			waitForCollectorReady(t, cp)
+			var conn net.Conn
+			if tc.isEncrypted {
+				collectorAddr, _ := net.ResolveUDPAddr("udp", cp.GetAddress().String())
+				conn, err = dialDTLS(collectorAddr)
+			} else {
+				conn, err = net.Dial(cp.GetAddress().Network(), cp.GetAddress().String())
+			}
+			if err != nil {
+				t.Fatalf("Cannot establish connection to %s: %v", cp.GetAddress().String(), err)
+			}
+			_, err = conn.Write(validTemplatePacket)
+			assert.NoError(t, err)
+			<-cp.GetMsgChan()
+			// the client is still connected, and Stop can be called more than once
+			cp.Stop()
+			cp.Stop()
+			assert.NoError(t, <-errCh)
+			_, ok := <-cp.GetMsgChan()
+			assert.False(t, ok, "Message channel should be closed when Start returns")
+			assert.Equal(t, 0, cp.getClientCount())
+			assert.Error(t, cp.Start(context.Background()), "Collecting Process should not be started twice")
+			conn.Close()
+			waitForGoroutines(t, numGoroutines)
+		})
+	}
+}
+
+func TestCollectingProcess_StartWithContext(t *testing.T) {
+	numGoroutines := runtime.NumGoroutine()
+	cp, err := InitCollectingProcess(getCollectorInput(tcpTransport, false, false))
+	if err != nil {
+		t.Fatalf("TCP Collecting Process does not initiate correctly: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cp.Start(ctx)
+	}()
+	waitForCollectorReady(t, cp)
+	conn, err := net.Dial(cp.GetAddress().Network(), cp.GetAddress().String())
+	if err != nil {
+		t.Fatalf("Cannot establish connection to %s: %v", cp.GetAddress().String(), err)
+	}
+	defer conn.Close()
+	cancel()
+	assert.NoError(t, <-errCh)
+	_, ok := <-cp.GetMsgChan()
+	assert.False(t, ok, "Message channel should be closed when Start returns")
+	waitForGoroutines(t, numGoroutines)
+}
+
+func TestCollectingProcess_StopBeforeStart(t *testing.T) {
+	cp, err := InitCollectingProcess(getCollectorInput(udpTransport, false, false))
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not initiate correctly: %v", err)
+	}
+	cp.Stop()
+	assert.NoError(t, cp.Start(context.Background()))
+	_, ok := <-cp.GetMsgChan()
+	assert.False(t, ok, "Message channel should be closed when Start returns")
+
+	// The deprecated CloseMsgChan stops the collecting process.
+	cp, err = InitCollectingProcess(getCollectorInput(udpTransport, false, false))
+	if err != nil {
+		t.Fatalf("UDP Collecting Process does not initiate correctly: %v", err)
+	}
+	cp.CloseMsgChan()
+	assert.NoError(t, cp.Start(context.Background()))
+	_, ok = <-cp.GetMsgChan()
+	assert.False(t, ok, "Message channel should be closed when Start returns")
+}
+
+func TestCollectingProcess_StartListenError(t *testing.T) {
+	listener, err := net.Listen(tcpTransport, hostPortIPv4)
+	if err != nil {
+		t.Fatalf("Cannot create listener: %v", err)
+	}
+	defer listener.Close()
+	input := getCollectorInput(tcpTransport, false, false)
+	input.Address = listener.Addr().String()
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		t.Fatalf("TCP Collecting Process does not initiate correctly: %v", err)
+	}
+	assert.Error(t, cp.Start(context.Background()), "Start should return the error of the listener")
+	_, ok := <-cp.GetMsgChan()
+	assert.False(t, ok, "Message channel should be closed when Start returns")
+}
+
+// BenchmarkUDPCollectingProcess measures the throughput of NetFlow v5 packets
+// sent by multiple exporters, with multiple udp sockets and decode workers. The
+// exporters only keep a window of packets in flight, so that the throughput of
+// the collector is measured instead of the packets dropped by the kernel when
+// the socket buffers are full. Dropped packets are still reported.
+func BenchmarkUDPCollectingProcess(b *testing.B) {
+	for _, bc := range []struct {
+		numSockets int
+		numWorkers int
+	}{
+		{1, 0},
+		{1, 4},
+		{4, 4},
+		{8, 8},
+	} {
+		b.Run(fmt.Sprintf("sockets=%d/workers=%d", bc.numSockets, bc.numWorkers), func(b *testing.B) {
+			benchmarkUDPCollectingProcess(b, bc.numSockets, bc.numWorkers)
+		})
+	}
+}
+
+func benchmarkUDPCollectingProcess(b *testing.B, numSockets int, numWorkers int) {
+	numExporters := 16
+	// maxInFlight is small enough for the packets to fit in the socket buffers.
+	maxInFlight := 128
+	header := []byte{0, 5, 0, 2, 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 10, 1, 2, 0, 0}
+	record := []byte{10, 0, 0, 1, 10, 0, 0, 2, 10, 0, 0, 254, 0, 1, 0, 2,
+		0, 0, 0, 10, 0, 0, 5, 220, 0, 0, 1, 0, 0, 0, 2, 0,
+		4, 210, 0, 80, 0, 0x12, 6, 0, 0xfd, 0xe8, 0xfd, 0xe9, 24, 16, 0, 0}
+	packet := append(append(header, record...), record...)
+
+	input := getCollectorInput(udpTransport, false, false)
+	input.MaxBufferSize = 1500
+	input.NumUDPSockets = numSockets
+	input.NumUDPWorkers = numWorkers
+	cp, err := InitCollectingProcess(input)
+	if err != nil {
+		b.Fatalf("UDP Collecting Process does not start correctly: %v", err)
+	}
+	go cp.Start(context.Background())
+	waitForCollectorReady(b, cp)
+	defer cp.Stop()
+	collectorAddr := cp.GetAddress()
+	conns := make([]net.Conn, numExporters)
+	for i := range conns {
+		conns[i], err = net.Dial(collectorAddr.Network(), collectorAddr.String())
+		if err != nil {
+			b.Fatalf("Cannot establish connection to %s: %v", collectorAddr.String(), err)
+		}
+		defer conns[i].Close()
+	}
+	// each message received gives back a token to send a packet
+	tokens := make(chan struct{}, maxInFlight)
+	for i := 0; i < maxInFlight; i++ {
+		tokens <- struct{}{}
+	}
+	var numReceived, lastReceivedTime int64
+	go func() {
+		for range cp.GetMsgChan() {
+			atomic.AddInt64(&numReceived, 1)
+			atomic.StoreInt64(&lastReceivedTime, time.Now().UnixNano())
+			select {
+			case tokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn, numPackets int) {
+			defer wg.Done()
+			timer := time.NewTimer(0)
+			for j := 0; j < numPackets; j++ {
+				// Packets which are dropped are never received, so the
+				// exporter does not wait for their token more than 10ms.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(10 * time.Millisecond)
+				select {
+				case <-tokens:
+				case <-timer.C:
+				}
+				conn.Write(packet)
+			}
+		}(conn, (b.N+i)/numExporters)
+	}
+	wg.Wait()
+	// wait until all the packets are received, or the remaining packets are
+	// dropped
+	for previous := int64(-1); ; time.Sleep(100 * time.Millisecond) {
+		received := atomic.LoadInt64(&numReceived)
+		if received == int64(b.N) || received == previous {
+			break
+		}
+		previous = received
+	}
+	b.StopTimer()
+	received := atomic.LoadInt64(&numReceived)
+	if received > 0 {
+		elapsed := time.Duration(atomic.LoadInt64(&lastReceivedTime) - startTime.UnixNano())
+		b.ReportMetric(float64(received)/elapsed.Seconds(), "msgs/s")
+	}
+	b.ReportMetric(100*float64(int64(b.N)-received)/float64(b.N), "%dropped")
+}
+
+func BenchmarkCollectingProcess_DecodePacket(b *testing.B) {
+	numRecords := 30
+	ipfixRecord := []byte{1, 2, 3, 4, 5, 6, 7, 8, 4, 112, 111, 100, 49}
+	ipfixPacket := []byte{0, 10, 0, 0, 95, 154, 108, 18, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0, 0, 0}
+	netFlowV5Record := []byte{10, 0, 0, 1, 10, 0, 0, 2, 10, 0, 0, 254, 0, 1, 0, 2,
+		0, 0, 0, 10, 0, 0, 5, 220, 0, 0, 1, 0, 0, 0, 2, 0,
+		4, 210, 0, 80, 0, 0x12, 6, 0, 0xfd, 0xe8, 0xfd, 0xe9, 24, 16, 0, 0}
+	netFlowV5Packet := []byte{0, 5, 0, byte(numRecords), 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 10, 1, 2, 0, 0}
+	for i := 0; i < numRecords; i++ {
+		ipfixPacket = append(ipfixPacket, ipfixRecord...)
+		netFlowV5Packet = append(netFlowV5Packet, netFlowV5Record...)
+	}
+	binary.BigEndian.PutUint16(ipfixPacket[2:4], uint16(len(ipfixPacket)))
+	binary.BigEndian.PutUint16(ipfixPacket[18:20], uint16(len(ipfixPacket)-entities.MsgHeaderLength))
+
+	for _, bc := range []struct {
+		name   string
+		packet []byte
+		lazy   bool
+	}{
+		{"IPFIX", ipfixPacket, false},
+		{"IPFIX/lazy", ipfixPacket, true},
+		{"NetFlowV5", netFlowV5Packet, false},
+	} {
+		// Messages which are not released are the decode path without
+		// pooling, as their buffers and records are garbage collected.
+		for _, release := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/release=%t", bc.name, release), func(b *testing.B) {
+				benchmarkDecodePacket(b, bc.packet, numRecords, bc.lazy, release)
+			})
+		}
+	}
+}
+
+func benchmarkDecodePacket(b *testing.B, packetBytes []byte, numRecords int, lazy bool, release bool) {
+	cp := &CollectingProcess{}
+	cp.templatesMap = make(map[string]map[uint32]map[uint16]*templateValue)
+	cp.sequenceStates = make(map[sequenceKey]*sequenceState)
+	cp.isLazyDecoding = lazy
+	cp.messageChan = make(chan *entities.Message, 1)
+	address := hostPortIPv4
+	if _, err := cp.decodePacket(bytes.NewBuffer(validTemplatePacket), address); err != nil {
+		b.Fatalf("Got error in decoding template record: %v", err)
+	}
+	<-cp.messageChan
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	mallocs := memStats.Mallocs
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// the packet is received in a buffer from the pool, as by the readers
+		buffer := cp.getPacketBuffer(len(packetBytes))
+		copy(*buffer, packetBytes)
+		cp.decodeClientPacket(packet{buffer, len(packetBytes)}, address)
+		message := <-cp.messageChan
+		if int(message.GetNumberOfRecords()) != numRecords {
+			b.Fatalf("Got %d records instead of %d", message.GetNumberOfRecords(), numRecords)
+		}
+		if release {
+			message.Release()
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&memStats)
+	b.ReportMetric(float64(memStats.Mallocs-mallocs)/float64(b.N*numRecords), "allocs/record")
+}
+
+// fakeListener is a listener whose Accept returns its errors in order, and then
+// keeps returning its last error.
+type fakeListener struct {
+	errs       []error
+	numAccepts int
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.numAccepts++
+	if l.numAccepts > len(l.errs) {
+		return nil, l.errs[len(l.errs)-1]
+	}
+	return nil, l.errs[l.numAccepts-1]
+}
+
+func (l *fakeListener) Close() error { return nil }
+
+func (l *fakeListener) Addr() net.Addr { return &net.UDPAddr{} }
+
+// stalledConn only sends the first datagram written to it, so that a dtls
+// handshake over it stalls after its first flight.
+type stalledConn struct {
+	net.Conn
+	numWrites int32
+}
+
+func (c *stalledConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&c.numWrites, 1) > 1 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func getDTLSClientConfig() (*dtls.Config, error) {
+	roots := x509.NewCertPool()
+	ok := roots.AppendCertsFromPEM([]byte(test.FakeCert2))
+	if !ok {
+		return nil, fmt.Errorf("failed to parse root certificate")
+	}
+	return &dtls.Config{RootCAs: roots,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret}, nil
+}
+
+func dialDTLS(address *net.UDPAddr) (*dtls.Conn, error) {
+	config, err := getDTLSClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dtls.Dial("udp", address, config)
+}
+
+func getCollectorInput(network string, isEncrypted bool, isIPv6 bool) CollectorInput {
+	if network == tcpTransport {
+		var address string
+		if isIPv6 {
+			address = hostPortIPv6
+		} else {
+			address = hostPortIPv4
+		}
+		if isEncrypted {
+			return CollectorInput{
+				Address:       address,
+				Protocol:      tcpTransport,
+				MaxBufferSize: 1024,
+				TemplateTTL:   0,
+				IsEncrypted:   true,
+				CACert:        []byte(test.FakeCACert),
+				ServerCert:    []byte(test.FakeCert),
+				ServerKey:     []byte(test.FakeKey),
+			}
+		} else {
+			return CollectorInput{
+				Address:       address,
+				Protocol:      tcpTransport,
+				MaxBufferSize: 1024,
+			}
+		}
+	} else {
+		var address string
+		if isIPv6 {
+			address = hostPortIPv6
+		} else {
+			address = hostPortIPv4
 		}
 		if isEncrypted {
 			return CollectorInput{
@@ -533,7 +2455,7 @@ func getCollectorInput(network string, isEncrypted bool, isIPv6 bool) CollectorI
 	}
 }
 
-func waitForCollectorReady(t *testing.T, cp *CollectingProcess) {
+func waitForCollectorReady(t testing.TB, cp *CollectingProcess) {
 	checkConn := func() (bool, error) {
 		if conn, err := net.Dial(cp.GetAddress().Network(), cp.GetAddress().String()); err != nil {
 			return false, err
@@ -546,3 +2468,22 @@ func waitForCollectorReady(t *testing.T, cp *CollectingProcess) {
 		t.Errorf("Cannot establish connection to %s", cp.GetAddress().String())
 	}
 }
+
+// waitForGoroutines waits until the number of goroutines is back to at most
+// numGoroutines, so that a stopped process does not leak any goroutine.
+func waitForGoroutines(t *testing.T, numGoroutines int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if runtime.NumGoroutine() <= numGoroutines {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Errorf("Goroutines are leaked, %d goroutines are running instead of %d:\n%s", runtime.NumGoroutine(), numGoroutines, buf[:runtime.Stack(buf, true)])
+}
+
+func getMetrics(t *testing.T, cp *CollectingProcess) string {
+	recorder := httptest.NewRecorder()
+	cp.GetMetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	return recorder.Body.String()
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"k8s.io/klog/v2"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+)
+
+// OverflowPolicy is what the collecting process does with a decoded message
+// when the message queue is full.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock blocks the exporter until the message is consumed.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the decoded message.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest message in the queue to make room
+	// for the decoded message. It requires a message queue depth of at least 1.
+	OverflowDropOldest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	default:
+		return "unknown"
+	}
+}
+
+// sendMessage sends the decoded message to the message channel, and applies the
+// overflow policy when the message queue is full.
+func (cp *CollectingProcess) sendMessage(message *entities.Message) {
+	switch cp.overflowPolicy {
+	case OverflowDropNewest:
+		select {
+		case cp.messageChan <- message:
+		default:
+			cp.countDroppedMessage(message)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case cp.messageChan <- message:
+				return
+			default:
+			}
+			// The consumer may have emptied the queue in the meantime, in
+			// which case nothing is dropped.
+			select {
+			case oldMessage := <-cp.messageChan:
+				cp.countDroppedMessage(oldMessage)
+			default:
+			}
+		}
+	default:
+		// the thread(s)/client(s) executing the code will get blocked until the message is consumed/read in other goroutines.
+		cp.messageChan <- message
+	}
+}
+
+// countDroppedMessage counts a message dropped because the message queue is
+// full, and releases it as it is not consumed.
+func (cp *CollectingProcess) countDroppedMessage(message *entities.Message) {
+	exportAddress := message.GetExportAddress()
+	cp.mutex.Lock()
+	if cp.droppedMessages == nil {
+		cp.droppedMessages = make(map[string]uint64)
+	}
+	cp.droppedMessages[exportAddress]++
+	cp.mutex.Unlock()
+	cp.metrics.addDroppedMessage(exportAddress)
+	klog.V(2).Infof("Message queue is full, dropping message from %s with %d records", exportAddress, message.GetNumberOfRecords())
+	message.Release()
+}
+
+// GetDroppedMessageCounts returns the number of messages dropped because the
+// message queue was full, for each exporter address.
+func (cp *CollectingProcess) GetDroppedMessageCounts() map[string]uint64 {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	counts := make(map[string]uint64, len(cp.droppedMessages))
+	for exportAddress, count := range cp.droppedMessages {
+		counts[exportAddress] = count
+	}
+	return counts
+}
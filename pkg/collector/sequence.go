@@ -0,0 +1,181 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"k8s.io/klog/v2"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+)
+
+// maxReorderDistance is the maximum number of data records by which a message
+// can be behind the expected sequence number to be considered as reordered.
+// Messages further behind are considered as a reset of the exporter.
+const maxReorderDistance uint32 = 1 << 16
+
+// SequenceEvent is the type of sequence number anomaly detected in a message.
+type SequenceEvent uint8
+
+const (
+	// SequenceGap means the sequence number is ahead of the expected one, and
+	// data records were lost in between.
+	SequenceGap SequenceEvent = iota
+	// SequenceReorder means the sequence number is behind the expected one,
+	// and the message arrived out of order.
+	SequenceReorder
+	// SequenceReset means the exporter restarted its sequence numbers.
+	SequenceReset
+)
+
+func (e SequenceEvent) String() string {
+	switch e {
+	case SequenceGap:
+		return "gap"
+	case SequenceReorder:
+		return "reorder"
+	case SequenceReset:
+		return "reset"
+	default:
+		return "unknown"
+	}
+}
+
+// SequenceNumberCallBack is called when the sequence number of a message does
+// not match the expected sequence number of the exporter and observation domain.
+type SequenceNumberCallBack func(sessionID string, obsDomainID uint32, event SequenceEvent, expected, received uint32)
+
+// SequenceStats contains the counters of sequence number anomalies.
+type SequenceStats struct {
+	// Gaps is the number of messages received after a gap.
+	Gaps uint64
+	// LostRecords is the number of data records missing in the gaps, or the
+	// number of export packets for NetFlow v9 and sFlow.
+	LostRecords uint64
+	// Reorders is the number of messages received out of order.
+	Reorders uint64
+	// Resets is the number of times the exporter restarted its sequence numbers.
+	Resets uint64
+}
+
+type sequenceKey struct {
+	sessionID   string
+	obsDomainID uint32
+}
+
+type sequenceState struct {
+	// expected is the sequence number expected in the next message, which is
+	// the number of data records received so far (RFC7011 section 3.1), or the
+	// number of export packets for NetFlow v9 and sFlow.
+	expected uint32
+	stats    SequenceStats
+}
+
+// checkSequenceNumber compares the sequence number of the message with the
+// expected sequence number of the session and observation domain, updates the
+// counters and notifies the callback if there is a gap, reorder or reset.
+func (cp *CollectingProcess) checkSequenceNumber(sessionID string, message *entities.Message) {
+	var increment uint32
+	for _, set := range message.GetSets() {
+		if set.GetSetType() == entities.Data {
+			increment += set.GetNumberOfRecords()
+		}
+	}
+	// NetFlow v9 and sFlow sequence numbers count the export packets instead of
+	// the data records (RFC3954 section 5.1).
+	if message.GetVersion() == entities.NetFlowV9Version || message.GetVersion() == entities.SFlowV5Version {
+		increment = 1
+	}
+	obsDomainID := message.GetObsDomainID()
+	received := message.GetSequenceNum()
+	key := sequenceKey{sessionID, obsDomainID}
+
+	cp.sequenceMutex.Lock()
+	state, exists := cp.sequenceStates[key]
+	if !exists {
+		cp.sequenceStates[key] = &sequenceState{expected: received + increment}
+		cp.sequenceMutex.Unlock()
+		return
+	}
+	expected := state.expected
+	if received == expected {
+		state.expected = received + increment
+		cp.sequenceMutex.Unlock()
+		return
+	}
+	// The difference is computed modulo 2^32 as the sequence number wraps around.
+	var event SequenceEvent
+	ahead := received - expected
+	behind := expected - received
+	switch {
+	case received == 0 || (ahead > behind && behind > maxReorderDistance):
+		event = SequenceReset
+		state.stats.Resets++
+		cp.sequenceStats.Resets++
+		state.expected = received + increment
+	case ahead < behind:
+		event = SequenceGap
+		state.stats.Gaps++
+		state.stats.LostRecords += uint64(ahead)
+		cp.sequenceStats.Gaps++
+		cp.sequenceStats.LostRecords += uint64(ahead)
+		state.expected = received + increment
+	default:
+		// Records of a late message are already counted in the gap it left,
+		// so the expected sequence number is not changed.
+		event = SequenceReorder
+		state.stats.Reorders++
+		cp.sequenceStats.Reorders++
+	}
+	callback := cp.sequenceNumberCallBack
+	cp.sequenceMutex.Unlock()
+
+	klog.V(2).Infof("Sequence number %s from %s with obsDomainID %d: expected %d, received %d", event, sessionID, obsDomainID, expected, received)
+	if callback != nil {
+		callback(sessionID, obsDomainID, event, expected, received)
+	}
+}
+
+// GetSequenceStats returns the sequence number counters of the exporter session
+// and observation domain, and whether any message has been received from them.
+func (cp *CollectingProcess) GetSequenceStats(sessionID string, obsDomainID uint32) (SequenceStats, bool) {
+	cp.sequenceMutex.Lock()
+	defer cp.sequenceMutex.Unlock()
+	state, exists := cp.sequenceStates[sequenceKey{sessionID, obsDomainID}]
+	if !exists {
+		return SequenceStats{}, false
+	}
+	return state.stats, true
+}
+
+// GetTotalSequenceStats returns the sequence number counters of all exporters,
+// including the sessions which have been closed.
+func (cp *CollectingProcess) GetTotalSequenceStats() SequenceStats {
+	cp.sequenceMutex.Lock()
+	defer cp.sequenceMutex.Unlock()
+	return cp.sequenceStats
+}
+
+// deleteSessionSequenceStates deletes the sequence number states of the
+// transport session when it is closed, or when the client of an udp exporter
+// is deleted.
+func (cp *CollectingProcess) deleteSessionSequenceStates(sessionID string) {
+	cp.sequenceMutex.Lock()
+	defer cp.sequenceMutex.Unlock()
+	for key := range cp.sequenceStates {
+		if key.sessionID == sessionID {
+			delete(cp.sequenceStates, key)
+		}
+	}
+}
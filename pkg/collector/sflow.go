@@ -0,0 +1,450 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+	"github.com/vmware/go-ipfix/pkg/util"
+)
+
+const (
+	// sFlowVersion is the 32-bit version in the header of sFlow v5 datagrams.
+	sFlowVersion uint32 = 5
+	// sFlowAgentIPv4, sFlowAgentIPv6 are the types of the agent address.
+	sFlowAgentIPv4 uint32 = 1
+	sFlowAgentIPv6 uint32 = 2
+	// Sample formats of the standard enterprise.
+	sFlowFlowSample            uint32 = 1
+	sFlowCounterSample         uint32 = 2
+	sFlowExpandedFlowSample    uint32 = 3
+	sFlowExpandedCounterSample uint32 = 4
+	// sFlowRawPacketHeader is the format of the flow record with the header of
+	// the sampled packet.
+	sFlowRawPacketHeader uint32 = 1
+	// sFlowGenericInterfaceCounters is the format of the counter record with
+	// the interface counters of RFC2233.
+	sFlowGenericInterfaceCounters uint32 = 1
+	// sFlowGenericInterfaceCountersLength is the length of the generic interface
+	// counter record.
+	sFlowGenericInterfaceCountersLength = 88
+	// Protocols of the header of the sampled packet.
+	sFlowHeaderProtocolEthernet uint32 = 1
+	sFlowHeaderProtocolIPv4     uint32 = 11
+	sFlowHeaderProtocolIPv6     uint32 = 12
+	// Template IDs of the data sets of sFlow records, which do not have
+	// templates.
+	sFlowIPv4TemplateID     uint16 = 256
+	sFlowIPv6TemplateID     uint16 = 257
+	sFlowEthernetTemplateID uint16 = 258
+	sFlowCountersTemplateID uint16 = 259
+)
+
+const (
+	etherTypeIPv4 uint16 = 0x0800
+	etherTypeIPv6 uint16 = 0x86dd
+	etherTypeVLAN uint16 = 0x8100
+	etherTypeQinQ uint16 = 0x88a8
+	ipProtocolTCP uint8  = 6
+	ipProtocolUDP uint8  = 17
+)
+
+// sFlowEthernetFields are the fields of the records of sampled packets, which
+// are decoded up to layer 2.
+var sFlowEthernetFields = []templateField{
+	{"samplingPacketInterval", 4},
+	{"ingressInterface", 4},
+	{"egressInterface", 4},
+	{"layer2OctetDeltaCount", 4},
+	{"sourceMacAddress", 6},
+	{"destinationMacAddress", 6},
+	{"vlanId", 2},
+	{"ethernetType", 2},
+}
+
+// sFlowTransportFields are the fields of the records of sampled IP packets,
+// after their addresses.
+var sFlowTransportFields = []templateField{
+	{"ipClassOfService", 1},
+	{"ipTTL", 1},
+	{"protocolIdentifier", 1},
+	{"sourceTransportPort", 2},
+	{"destinationTransportPort", 2},
+	{"tcpControlBits", 2},
+}
+
+// sFlowIPv4Fields are the fields of the records of sampled IPv4 packets.
+var sFlowIPv4Fields = concatTemplateFields(sFlowEthernetFields, []templateField{
+	{"sourceIPv4Address", 4},
+	{"destinationIPv4Address", 4},
+}, sFlowTransportFields)
+
+// sFlowIPv6Fields are the fields of the records of sampled IPv6 packets.
+var sFlowIPv6Fields = concatTemplateFields(sFlowEthernetFields, []templateField{
+	{"sourceIPv6Address", 16},
+	{"destinationIPv6Address", 16},
+}, sFlowTransportFields)
+
+// sFlowCountersFields are the fields of the records of generic interface
+// counters. The input and output counters are mapped to the ingress and egress
+// (post) total counters of the interface.
+var sFlowCountersFields = []templateField{
+	{"ingressInterface", 4},
+	{"ingressInterfaceType", 4},
+	{"layer2OctetTotalCount", 8},
+	{"ingressUnicastPacketTotalCount", 4},
+	{"ingressMulticastPacketTotalCount", 4},
+	{"ingressBroadcastPacketTotalCount", 4},
+	{"postLayer2OctetTotalCount", 8},
+	{"egressUnicastPacketTotalCount", 4},
+	{"postMCastPacketTotalCount", 4},
+	{"egressBroadcastPacketTotalCount", 4},
+}
+
+func concatTemplateFields(fieldLists ...[]templateField) []templateField {
+	var fields []templateField
+	for _, fieldList := range fieldLists {
+		fields = append(fields, fieldList...)
+	}
+	return fields
+}
+
+// sFlowTemplateFields returns the fields of the synthetic templates of sFlow records.
+func sFlowTemplateFields(templateID uint16) []templateField {
+	switch templateID {
+	case sFlowIPv4TemplateID:
+		return sFlowIPv4Fields
+	case sFlowIPv6TemplateID:
+		return sFlowIPv6Fields
+	case sFlowEthernetTemplateID:
+		return sFlowEthernetFields
+	default:
+		return sFlowCountersFields
+	}
+}
+
+// decodeSFlowHeader decodes the header of a sFlow v5 datagram, and returns the
+// message with the header fields and the buffer of its samples. sFlow does not
+// have an export time, so the time the datagram is received is used. The sub
+// agent ID is used as the observation domain ID, and the agent address is not
+// kept.
+func decodeSFlowHeader(packetBuffer *bytes.Buffer) (*entities.Message, *bytes.Buffer, error) {
+	msgLen := packetBuffer.Len()
+	if msgLen > entities.MaxTcpSocketMsgSize {
+		return nil, nil, fmt.Errorf("message length %d is invalid", msgLen)
+	}
+	var version, agentAddressType uint32
+	if err := util.Decode(packetBuffer, binary.BigEndian, &version, &agentAddressType); err != nil {
+		return nil, nil, err
+	}
+	switch agentAddressType {
+	case sFlowAgentIPv4:
+		packetBuffer.Next(4)
+	case sFlowAgentIPv6:
+		packetBuffer.Next(16)
+	default:
+		return nil, nil, fmt.Errorf("agent address type %d is invalid", agentAddressType)
+	}
+	var subAgentID, sequenceNum, sysUpTime, sampleCount uint32
+	// The sample count is not needed as samples are walked using their lengths.
+	if err := util.Decode(packetBuffer, binary.BigEndian, &subAgentID, &sequenceNum, &sysUpTime, &sampleCount); err != nil {
+		return nil, nil, err
+	}
+	message := entities.NewMessage(true)
+	message.SetVersion(entities.SFlowV5Version)
+	message.SetMessageLen(uint16(msgLen))
+	message.SetSysUpTime(sysUpTime)
+	message.SetExportTime(uint32(time.Now().Unix()))
+	message.SetSequenceNum(sequenceNum)
+	message.SetObsDomainID(subAgentID)
+	return message, bytes.NewBuffer(packetBuffer.Next(packetBuffer.Len())), nil
+}
+
+// decodeSFlowSamples decodes the flow samples with a raw packet header and the
+// counter samples with generic interface counters in the buffer into data sets
+// of the synthetic sFlow templates. Consecutive records of the same template
+// are in the same data set. Other samples and records are skipped.
+func (cp *CollectingProcess) decodeSFlowSamples(samplesBuffer *bytes.Buffer) ([]entities.Set, error) {
+	var sets []entities.Set
+	var dataSet entities.Set
+	var setTemplateID uint16
+	for samplesBuffer.Len() > 0 {
+		var format, sampleLen uint32
+		if err := util.Decode(samplesBuffer, binary.BigEndian, &format, &sampleLen); err != nil {
+			return nil, err
+		}
+		if int(sampleLen) > samplesBuffer.Len() {
+			return nil, fmt.Errorf("sample length %d of sample with format %d is invalid", sampleLen, format)
+		}
+		sampleBuffer := bytes.NewBuffer(samplesBuffer.Next(int(sampleLen)))
+		var templateID uint16
+		var values map[string][]byte
+		var err error
+		switch format {
+		case sFlowFlowSample, sFlowExpandedFlowSample:
+			templateID, values, err = decodeSFlowFlowSample(sampleBuffer, format == sFlowExpandedFlowSample)
+		case sFlowCounterSample, sFlowExpandedCounterSample:
+			templateID, values, err = decodeSFlowCounterSample(sampleBuffer, format == sFlowExpandedCounterSample)
+		default:
+			klog.V(4).Infof("Skipping sFlow sample with format %d", format)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if values == nil {
+			continue
+		}
+		fields := sFlowTemplateFields(templateID)
+		template, err := cp.getSyntheticTemplate(entities.SFlowV5Version, templateID, fields)
+		if err != nil {
+			return nil, err
+		}
+		if dataSet == nil || setTemplateID != templateID {
+			dataSet = entities.NewSet(true)
+			if err = dataSet.PrepareSet(entities.Data, templateID); err != nil {
+				return nil, err
+			}
+			sets = append(sets, dataSet)
+			setTemplateID = templateID
+		}
+		recordElements := getRecordElements(len(template))
+		for i, field := range fields {
+			value, exists := values[field.name]
+			if !exists {
+				value = make([]byte, field.length)
+			}
+			if err = recordElements.decode(i, template[i], value); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = dataSet.AddRecord(recordElements.elements, templateID)
+		}
+		recordElements.release()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sets, nil
+}
+
+// decodeSFlowFlowSample decodes a flow sample, and returns the template ID and
+// the values of the record of the sampled packet. The values are nil if the
+// sample does not have a raw packet header.
+func decodeSFlowFlowSample(sampleBuffer *bytes.Buffer, isExpanded bool) (uint16, map[string][]byte, error) {
+	var sequenceNum, samplingRate, samplePool, drops, input, output, recordCount uint32
+	if isExpanded {
+		var sourceIDType, sourceIDIndex, inputFormat, outputFormat uint32
+		err := util.Decode(sampleBuffer, binary.BigEndian, &sequenceNum, &sourceIDType, &sourceIDIndex, &samplingRate, &samplePool, &drops, &inputFormat, &input, &outputFormat, &output, &recordCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		input = getSFlowInterfaceIndex(inputFormat, input)
+		output = getSFlowInterfaceIndex(outputFormat, output)
+	} else {
+		var sourceID uint32
+		err := util.Decode(sampleBuffer, binary.BigEndian, &sequenceNum, &sourceID, &samplingRate, &samplePool, &drops, &input, &output, &recordCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		// The two most significant bits are the format of the interface.
+		input = getSFlowInterfaceIndex(input>>30, input&0x3fffffff)
+		output = getSFlowInterfaceIndex(output>>30, output&0x3fffffff)
+	}
+	// The record count is not needed as records are walked using their lengths.
+	for sampleBuffer.Len() > 0 {
+		record, format, err := nextSFlowRecord(sampleBuffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if format != sFlowRawPacketHeader {
+			continue
+		}
+		var headerProtocol, frameLength, stripped, headerLength uint32
+		recordBuffer := bytes.NewBuffer(record)
+		if err = util.Decode(recordBuffer, binary.BigEndian, &headerProtocol, &frameLength, &stripped, &headerLength); err != nil {
+			return 0, nil, err
+		}
+		if int(headerLength) > recordBuffer.Len() {
+			return 0, nil, fmt.Errorf("header length %d of sampled packet is invalid", headerLength)
+		}
+		values := map[string][]byte{
+			"samplingPacketInterval": uint32ToBytes(samplingRate),
+			"ingressInterface":       uint32ToBytes(input),
+			"egressInterface":        uint32ToBytes(output),
+			"layer2OctetDeltaCount":  uint32ToBytes(frameLength),
+		}
+		templateID := decodeSFlowSampledHeader(headerProtocol, recordBuffer.Next(int(headerLength)), values)
+		return templateID, values, nil
+	}
+	return 0, nil, nil
+}
+
+// decodeSFlowCounterSample decodes a counter sample, and returns the template ID
+// and the values of the record of the generic interface counters. The values
+// are nil if the sample does not have generic interface counters.
+func decodeSFlowCounterSample(sampleBuffer *bytes.Buffer, isExpanded bool) (uint16, map[string][]byte, error) {
+	var sequenceNum, sourceID, recordCount uint32
+	outputs := []interface{}{&sequenceNum, &sourceID, &recordCount}
+	if isExpanded {
+		var sourceIDIndex uint32
+		outputs = []interface{}{&sequenceNum, &sourceID, &sourceIDIndex, &recordCount}
+	}
+	if err := util.Decode(sampleBuffer, binary.BigEndian, outputs...); err != nil {
+		return 0, nil, err
+	}
+	// The record count is not needed as records are walked using their lengths.
+	for sampleBuffer.Len() > 0 {
+		record, format, err := nextSFlowRecord(sampleBuffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if format != sFlowGenericInterfaceCounters {
+			continue
+		}
+		if len(record) < sFlowGenericInterfaceCountersLength {
+			return 0, nil, fmt.Errorf("generic interface counters of %d bytes are too short", len(record))
+		}
+		return sFlowCountersTemplateID, map[string][]byte{
+			"ingressInterface":                 record[0:4],
+			"ingressInterfaceType":             record[4:8],
+			"layer2OctetTotalCount":            record[24:32],
+			"ingressUnicastPacketTotalCount":   record[32:36],
+			"ingressMulticastPacketTotalCount": record[36:40],
+			"ingressBroadcastPacketTotalCount": record[40:44],
+			"postLayer2OctetTotalCount":        record[56:64],
+			"egressUnicastPacketTotalCount":    record[64:68],
+			"postMCastPacketTotalCount":        record[68:72],
+			"egressBroadcastPacketTotalCount":  record[72:76],
+		}, nil
+	}
+	return 0, nil, nil
+}
+
+// nextSFlowRecord returns the data and format of the next flow or counter record
+// of a sample.
+func nextSFlowRecord(sampleBuffer *bytes.Buffer) ([]byte, uint32, error) {
+	var format, recordLen uint32
+	if err := util.Decode(sampleBuffer, binary.BigEndian, &format, &recordLen); err != nil {
+		return nil, 0, err
+	}
+	if int(recordLen) > sampleBuffer.Len() {
+		return nil, 0, fmt.Errorf("record length %d of record with format %d is invalid", recordLen, format)
+	}
+	return sampleBuffer.Next(int(recordLen)), format, nil
+}
+
+// getSFlowInterfaceIndex returns the index of a single interface, and 0 if the
+// packet was discarded or sent to multiple interfaces.
+func getSFlowInterfaceIndex(format uint32, value uint32) uint32 {
+	if format != 0 || value == 0x3fffffff {
+		return 0
+	}
+	return value
+}
+
+// decodeSFlowSampledHeader decodes the layer 2 to layer 4 fields of the header
+// of a sampled packet into the values, and returns the template ID of the
+// record. Fields which are not in the header, as it is truncated or it is not a
+// TCP or UDP packet, are left out.
+func decodeSFlowSampledHeader(headerProtocol uint32, header []byte, values map[string][]byte) uint16 {
+	var etherType uint16
+	switch headerProtocol {
+	case sFlowHeaderProtocolEthernet:
+		if len(header) < 14 {
+			return sFlowEthernetTemplateID
+		}
+		values["destinationMacAddress"] = header[0:6]
+		values["sourceMacAddress"] = header[6:12]
+		etherType = binary.BigEndian.Uint16(header[12:14])
+		header = header[14:]
+		// The VLAN ID of the outer tag is kept for tagged frames.
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(header) >= 4 {
+			if _, exists := values["vlanId"]; !exists {
+				values["vlanId"] = uint16ToBytes(binary.BigEndian.Uint16(header[0:2]) & 0x0fff)
+			}
+			etherType = binary.BigEndian.Uint16(header[2:4])
+			header = header[4:]
+		}
+	case sFlowHeaderProtocolIPv4:
+		etherType = etherTypeIPv4
+	case sFlowHeaderProtocolIPv6:
+		etherType = etherTypeIPv6
+	default:
+		return sFlowEthernetTemplateID
+	}
+	values["ethernetType"] = uint16ToBytes(etherType)
+
+	var templateID uint16
+	var protocol uint8
+	var transportHeader []byte
+	switch {
+	case etherType == etherTypeIPv4 && len(header) >= 20 && header[0]>>4 == 4:
+		templateID = sFlowIPv4TemplateID
+		values["ipClassOfService"] = header[1:2]
+		values["ipTTL"] = header[8:9]
+		values["protocolIdentifier"] = header[9:10]
+		values["sourceIPv4Address"] = header[12:16]
+		values["destinationIPv4Address"] = header[16:20]
+		protocol = header[9]
+		// Only the first fragment has the transport header.
+		headerLen := int(header[0]&0x0f) * 4
+		if binary.BigEndian.Uint16(header[6:8])&0x1fff == 0 && headerLen >= 20 && headerLen <= len(header) {
+			transportHeader = header[headerLen:]
+		}
+	case etherType == etherTypeIPv6 && len(header) >= 40 && header[0]>>4 == 6:
+		templateID = sFlowIPv6TemplateID
+		values["ipClassOfService"] = []byte{header[0]<<4 | header[1]>>4}
+		values["ipTTL"] = header[7:8]
+		values["protocolIdentifier"] = header[6:7]
+		values["sourceIPv6Address"] = header[8:24]
+		values["destinationIPv6Address"] = header[24:40]
+		// Extension headers are not walked, so the transport header is only
+		// decoded when it follows the fixed header.
+		protocol = header[6]
+		transportHeader = header[40:]
+	default:
+		return sFlowEthernetTemplateID
+	}
+	switch {
+	case protocol == ipProtocolTCP && len(transportHeader) >= 14:
+		values["sourceTransportPort"] = transportHeader[0:2]
+		values["destinationTransportPort"] = transportHeader[2:4]
+		values["tcpControlBits"] = uint16ToBytes(binary.BigEndian.Uint16(transportHeader[12:14]) & 0x01ff)
+	case protocol == ipProtocolUDP && len(transportHeader) >= 4:
+		values["sourceTransportPort"] = transportHeader[0:2]
+		values["destinationTransportPort"] = transportHeader[2:4]
+	}
+	return templateID
+}
+
+func uint16ToBytes(value uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, value)
+	return b
+}
+
+func uint32ToBytes(value uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	return b
+}
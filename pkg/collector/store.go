@@ -0,0 +1,202 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
+)
+
+const (
+	// templateStoreFileName is the name of the file of the template store in
+	// the template store directory.
+	templateStoreFileName = "templates.json"
+	// templateStoreInterval is how often the templates are saved to the
+	// template store if they have changed.
+	templateStoreInterval = 10 * time.Second
+)
+
+// storedTemplate is a template saved in the template store.
+type storedTemplate struct {
+	SessionID       string                  `json:"sessionID"`
+	ObsDomainID     uint32                  `json:"obsDomainID"`
+	TemplateID      uint16                  `json:"templateID"`
+	ScopeFieldCount uint16                  `json:"scopeFieldCount"`
+	UpdateTime      time.Time               `json:"updateTime"`
+	Elements        []*entities.InfoElement `json:"elements"`
+}
+
+// runTemplateStore saves the templates to the template store periodically when
+// they have changed, and once more when the collecting process is stopped.
+func (cp *CollectingProcess) runTemplateStore(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(templateStoreInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := cp.saveTemplates(); err != nil {
+				klog.Errorf("Error in saving templates to %s: %v", cp.templateStoreDir, err)
+			}
+		case <-ctx.Done():
+			if err := cp.saveTemplates(); err != nil {
+				klog.Errorf("Error in saving templates to %s: %v", cp.templateStoreDir, err)
+			}
+			return
+		}
+	}
+}
+
+// saveTemplates writes all the templates to the template store if they have
+// changed since they were last saved. The file is replaced atomically, so that
+// the store is not corrupted if the collecting process is killed while saving.
+func (cp *CollectingProcess) saveTemplates() error {
+	cp.mutex.Lock()
+	if !cp.templatesChanged {
+		cp.mutex.Unlock()
+		return nil
+	}
+	templates := make([]storedTemplate, 0)
+	for sessionID, obsDomainTemplates := range cp.templatesMap {
+		for obsDomainID, sessionTemplates := range obsDomainTemplates {
+			for templateID, template := range sessionTemplates {
+				templates = append(templates, storedTemplate{
+					SessionID:       sessionID,
+					ObsDomainID:     obsDomainID,
+					TemplateID:      templateID,
+					ScopeFieldCount: template.scopeFieldCount,
+					UpdateTime:      template.updateTime,
+					Elements:        template.elements,
+				})
+			}
+		}
+	}
+	cp.templatesChanged = false
+	cp.mutex.Unlock()
+
+	err := writeTemplateStore(cp.templateStoreDir, templates)
+	if err != nil {
+		// the templates are saved again next time
+		cp.mutex.Lock()
+		cp.templatesChanged = true
+		cp.mutex.Unlock()
+	}
+	return err
+}
+
+func writeTemplateStore(dir string, templates []storedTemplate) error {
+	data, err := json.Marshal(templates)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, templateStoreFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(dir, templateStoreFileName))
+}
+
+// loadTemplates adds the templates of the template store whose lifetime has
+// not ended. Their remaining lifetime is the template TTL from the last time
+// they were announced by the exporter.
+func (cp *CollectingProcess) loadTemplates() error {
+	data, err := ioutil.ReadFile(filepath.Join(cp.templateStoreDir, templateStoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var templates []storedTemplate
+	if err = json.Unmarshal(data, &templates); err != nil {
+		return fmt.Errorf("template store is corrupt: %v", err)
+	}
+	numLoaded := 0
+	for _, stored := range templates {
+		elements, err := cp.validateStoredTemplate(stored)
+		if err != nil {
+			klog.Errorf("Skipping stored template with id %d, and obsDomainID %d from %s: %v", stored.TemplateID, stored.ObsDomainID, stored.SessionID, err)
+			continue
+		}
+		template := &templateValue{
+			elements:              elements,
+			scopeFieldCount:       stored.ScopeFieldCount,
+			hasStructuredElements: hasStructuredElements(elements),
+			updateTime:            stored.UpdateTime,
+		}
+		if cp.putTemplate(stored.SessionID, stored.ObsDomainID, stored.TemplateID, template) {
+			numLoaded++
+		}
+	}
+	klog.Infof("Loaded %d of %d templates from %s", numLoaded, len(templates), cp.templateStoreDir)
+	return nil
+}
+
+// validateStoredTemplate checks the stored template with the same checks as the
+// templates decoded from the wire, as the template store may be corrupted or
+// edited, and returns the elements of the template from the registry.
+func (cp *CollectingProcess) validateStoredTemplate(stored storedTemplate) ([]*entities.InfoElement, error) {
+	if stored.TemplateID < minDataSetID {
+		return nil, fmt.Errorf("template id %d is invalid", stored.TemplateID)
+	}
+	if len(stored.Elements) == 0 {
+		return nil, fmt.Errorf("template has no elements")
+	}
+	if int(stored.ScopeFieldCount) > len(stored.Elements) {
+		return nil, fmt.Errorf("scope field count %d is more than the number of elements %d", stored.ScopeFieldCount, len(stored.Elements))
+	}
+	elements := make([]*entities.InfoElement, len(stored.Elements))
+	for i, storedElement := range stored.Elements {
+		if storedElement == nil {
+			return nil, fmt.Errorf("template has an empty element")
+		}
+		element, err := getInfoElement(storedElement.ElementId, storedElement.EnterpriseId, storedElement.Len, cp.isLenient)
+		if err != nil {
+			return nil, err
+		}
+		element, err = getTemplateElement(element, storedElement.Len)
+		if err != nil {
+			return nil, err
+		}
+		if element.DataType != storedElement.DataType {
+			return nil, fmt.Errorf("data type %d of element %s is not data type %d of the registry", storedElement.DataType, element.Name, element.DataType)
+		}
+		elements[i] = element
+	}
+	return elements, nil
+}
@@ -1,107 +1,158 @@
 package collector
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"k8s.io/klog/v2"
+
+	"github.com/vmware/go-ipfix/pkg/entities"
 )
 
-func (cp *CollectingProcess) startTCPServer() {
+func (cp *CollectingProcess) startTCPServer(ctx context.Context) error {
 	var listener net.Listener
 	var err error
 	if cp.isEncrypted { // use TLS
 		config, err := cp.createServerConfig()
 		if err != nil {
-			klog.Error(err)
-			return
+			return err
 		}
 		listener, err = tls.Listen("tcp", cp.address, config)
 		if err != nil {
-			klog.Errorf("Cannot start tls collecting process on %s: %v", cp.address, err)
-			return
+			return fmt.Errorf("cannot start tls collecting process on %s: %v", cp.address, err)
 		}
 		cp.updateAddress(listener.Addr())
 		klog.Infof("Started TLS collecting process on %s", cp.address)
 	} else {
 		listener, err = net.Listen("tcp", cp.address)
 		if err != nil {
-			klog.Errorf("Cannot start collecting process on %s: %v", cp.address, err)
-			return
+			return fmt.Errorf("cannot start collecting process on %s: %v", cp.address, err)
 		}
 		cp.updateAddress(listener.Addr())
 		klog.Infof("Start TCP collecting process on %s", cp.address)
 	}
 
+	var wg sync.WaitGroup
+	acceptDone := make(chan bool)
 	go func() {
-		defer listener.Close()
+		defer close(acceptDone)
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
-				klog.Errorf("Cannot start collecting process on %s: %v", cp.address, err)
+				if ctx.Err() == nil {
+					klog.Errorf("Cannot accept connection on %s: %v", cp.address, err)
+				}
 				return
 			}
-			go cp.handleTCPClient(conn)
+			wg.Add(1)
+			go cp.handleTCPClient(ctx, conn, &wg)
 		}
 	}()
-	<-cp.stopChan
-	// close all connections
-	cp.closeAllClients()
+	<-ctx.Done()
+	listener.Close()
+	<-acceptDone
+	// wait for all the connections to be closed
+	wg.Wait()
+	return nil
 }
 
-func (cp *CollectingProcess) handleTCPClient(conn net.Conn) {
+// handleTCPClient decodes the messages of a tcp connection, which is the
+// transport session of the exporter. The connection is closed and its templates
+// are deleted when the exporter closes it, when its stream is corrupt, or when
+// the collecting process is stopped.
+func (cp *CollectingProcess) handleTCPClient(ctx context.Context, conn net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
 	address := conn.RemoteAddr().String()
 	client := cp.createClient()
 	cp.addClient(address, client)
+	readerDone := make(chan bool)
 	go func() {
-		defer conn.Close()
-		buff := make([]byte, cp.maxBufferSize)
-	out:
+		defer close(readerDone)
+		// A message can span multiple reads, and a read can have multiple
+		// messages, so messages are framed with the length in their header.
+		reader := bufio.NewReaderSize(conn, int(cp.maxBufferSize))
+		maxMsgLen := entities.MaxTcpSocketMsgSize
+		if cp.maxBufferSize != 0 {
+			maxMsgLen = int(cp.maxBufferSize)
+		}
 		for {
-			size, err := conn.Read(buff)
+			buffer := cp.getPacketBuffer(maxMsgLen)
+			msg, err := readTCPMessage(reader, *buffer)
 			if err != nil {
+				cp.putPacketBuffer(buffer)
+				select {
+				case <-client.doneChan: // connection closed by the handler
+					return
+				default:
+				}
 				if err == io.EOF {
 					klog.Infof("Connection from %s has been closed.", address)
 				} else {
-					klog.Errorf("Error in collecting process: %v", err)
-				}
-				client.errChan <- true
-				break out
-			}
-			klog.V(2).Infof("Receiving %d bytes from %s", size, address)
-			buffBytes := make([]byte, size)
-			copy(buffBytes, buff[:size])
-			for size > 0 {
-				length, err := getMessageLength(bytes.NewBuffer(buffBytes))
-				if err != nil {
-					klog.Error(err)
-					client.errChan <- true
-					break out
-				}
-				if size < length {
-					klog.Errorf("Message length %v is larger than size read from buffer %v", length, size)
-					break out
+					// The stream cannot be resynchronised after a corrupt message
+					// header, so the connection is closed.
+					klog.Errorf("Error in collecting process, closing connection from %s: %v", address, err)
 				}
-				size = size - length
-				// get the message here
-				message, err := cp.decodePacket(bytes.NewBuffer(buffBytes[0:length]), address)
-				if err != nil {
-					klog.Error(err)
-					client.errChan <- true
-					break out
+				select {
+				case client.errChan <- true:
+				case <-client.doneChan:
 				}
-				klog.V(4).Infof("Processed message from exporter %v, number of records: %v, observation domain ID: %v",
-					message.GetExportAddress(), message.GetSet().GetNumberOfRecords(), message.GetObsDomainID())
-				buffBytes = buffBytes[length:]
+				return
 			}
+			klog.V(2).Infof("Receiving %d bytes from %s", len(msg), address)
+			// The message is framed, so the next message can still be decoded
+			// if this one cannot.
+			cp.decodeClientPacket(packet{buffer, len(msg)}, address)
 		}
 	}()
-	<-client.errChan
+	select {
+	case <-client.errChan:
+	case <-ctx.Done():
+	}
+	close(client.doneChan)
+	conn.Close()
+	// the message being decoded is delivered before the session is deleted
+	<-readerDone
 	cp.deleteClient(address)
+	// Templates are not valid anymore once the transport session is closed.
+	cp.deleteSessionTemplates(address)
+	cp.deleteSessionSequenceStates(address)
+}
+
+// readTCPMessage reads the next IPFIX message from the stream into the buffer,
+// whose length is the maximum message length. It returns io.EOF if the stream
+// ends between messages, and an error if the stream ends in the middle of a
+// message or the message header is corrupt.
+func readTCPMessage(reader io.Reader, buffer []byte) ([]byte, error) {
+	maxMsgLen := len(buffer)
+	if maxMsgLen < entities.MsgHeaderLength {
+		return nil, fmt.Errorf("buffer of %d bytes is shorter than the message header", maxMsgLen)
+	}
+	header := buffer[:entities.MsgHeaderLength]
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	msgLen, err := getMessageLength(bytes.NewBuffer(header))
+	if err != nil {
+		return nil, err
+	}
+	if msgLen < entities.MsgHeaderLength || msgLen > maxMsgLen {
+		return nil, fmt.Errorf("message length %d is invalid, the maximum message length is %d", msgLen, maxMsgLen)
+	}
+	msg := buffer[:msgLen]
+	if _, err = io.ReadFull(reader, msg[entities.MsgHeaderLength:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("cannot read message of %d bytes: %v", msgLen, err)
+	}
+	return msg, nil
 }
 
 func (cp *CollectingProcess) createServerConfig() (*tls.Config, error) {
@@ -15,34 +15,59 @@
 package collector
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/pion/dtls/v2"
+	"github.com/pion/udp"
 	"k8s.io/klog/v2"
+)
+
+// dtlsHandshakeTimeout is the maximum time to complete the handshake of a dtls
+// association.
+const dtlsHandshakeTimeout = 30 * time.Second
 
-	"github.com/vmware/go-ipfix/pkg/entities"
+// dtlsAcceptMinBackoff and dtlsAcceptMaxBackoff are the bounds of the delay
+// before accepting dtls associations again after a timeout.
+const (
+	dtlsAcceptMinBackoff = 5 * time.Millisecond
+	dtlsAcceptMaxBackoff = time.Second
 )
 
-func (cp *CollectingProcess) startUDPServer() {
-	var listener net.Listener
-	var err error
-	var conn net.Conn
+// dtlsRecordHeaderLen is the length of the header of a dtls record, and
+// dtlsContentTypeHandshake is the content type of handshake records.
+const (
+	dtlsRecordHeaderLen      = 13
+	dtlsContentTypeHandshake = 22
+)
+
+// errDTLSListenerClosed is returned by the dtls listener once it is closed.
+var errDTLSListenerClosed = errors.New("dtls listener closed")
+
+// udpWorkerQueueLength is the number of packets which can be queued for each
+// udp decode worker, before the socket readers are blocked.
+const udpWorkerQueueLength = 1024
+
+func (cp *CollectingProcess) startUDPServer(ctx context.Context) error {
 	var wg sync.WaitGroup
+	// workers are the queues of the udp decode workers, if there are workers
+	var workers []chan udpPacket
 	address, err := net.ResolveUDPAddr(cp.protocol, cp.address)
 	if err != nil {
-		klog.Error(err)
-		return
+		return err
 	}
 	if cp.isEncrypted { // use DTLS
 		cert, err := tls.X509KeyPair(cp.serverCert, cp.serverKey)
 		if err != nil {
-			klog.Error(err)
-			return
+			return err
 		}
 		certPool := x509.NewCertPool()
 		certPool.AppendCertsFromPEM(cp.serverCert)
@@ -51,104 +76,436 @@ func (cp *CollectingProcess) startUDPServer() {
 			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
 			ClientCAs:            certPool,
 		}
-		listener, err = dtls.Listen("udp", address, config)
+		// The udp associations are accepted before their handshake, so that
+		// the handshakes of the exporters run concurrently.
+		listenConfig := &udp.ListenConfig{AcceptFilter: isDTLSHandshakeRecord}
+		udpListener, err := listenConfig.Listen("udp", address)
 		if err != nil {
-			klog.Error(err)
-			return
+			return fmt.Errorf("cannot start dtls collecting process on %s: %v", cp.address, err)
 		}
+		listener := newDTLSListener(udpListener)
 		cp.updateAddress(listener.Addr())
 		klog.Infof("Start dtls collecting process on %s", cp.address)
-		conn, err = listener.Accept()
+		acceptDone := make(chan bool)
+		go func() {
+			defer close(acceptDone)
+			cp.acceptDTLSConnections(ctx, listener, config, &wg)
+		}()
+		<-ctx.Done()
+		listener.Close()
+		<-acceptDone
+	} else { // use udp
+		conns, err := cp.listenUDP(address)
 		if err != nil {
-			klog.Error(err)
-			return
+			return fmt.Errorf("cannot start udp collecting process on %s: %v", cp.address, err)
 		}
-		defer conn.Close()
-		go func() {
-			buff := make([]byte, cp.maxBufferSize)
-			for {
-				size, err := conn.Read(buff)
-				if err != nil {
-					if size == 0 { // received stop collector message
+		cp.updateAddress(conns[0].LocalAddr())
+		klog.Infof("Start UDP collecting process on %s with %d sockets", cp.address, len(conns))
+		handlePacket := func(address string, packet packet) {
+			cp.handleUDPPacket(ctx, address, packet, &wg)
+		}
+		if cp.numUDPWorkers > 0 {
+			workers = cp.startUDPWorkers(ctx, &wg)
+			handlePacket = func(address string, packet packet) {
+				cp.dispatchUDPPacket(ctx, workers, address, packet)
+			}
+		}
+		var readersWg sync.WaitGroup
+		for _, conn := range conns {
+			readersWg.Add(1)
+			go func(conn *net.UDPConn) {
+				defer readersWg.Done()
+				for {
+					buffer := cp.getPacketBuffer(int(cp.maxBufferSize))
+					size, address, err := conn.ReadFromUDP(*buffer)
+					if err != nil {
+						cp.putPacketBuffer(buffer)
+						if ctx.Err() == nil {
+							klog.Errorf("Error in udp collecting process: %v", err)
+						}
 						return
 					}
-					klog.Errorf("Error in collecting process: %v", err)
-					return
-				}
-				address, err = net.ResolveUDPAddr(conn.LocalAddr().Network(), conn.LocalAddr().String())
-				if err != nil {
-					klog.Errorf("Error in dtls collecting process: %v", err)
-					return
+					klog.V(2).Infof("Receiving %d bytes from %s", size, address.String())
+					handlePacket(address.String(), packet{buffer, size})
 				}
-				klog.V(2).Infof("Receiving %d bytes from %s", size, address.String())
-				cp.handleUDPClient(address, &wg)
-				buffBytes := make([]byte, size)
-				copy(buffBytes, buff[0:size])
-				cp.clients[address.String()].packetChan <- bytes.NewBuffer(buffBytes)
-			}
-		}()
-	} else { // use udp
+			}(conn)
+		}
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		readersWg.Wait()
+		// The socket readers are the only senders to the queues of the workers.
+		for _, worker := range workers {
+			close(worker)
+		}
+	}
+	// wait for all the workers to deliver their messages before returning
+	wg.Wait()
+	cp.drainUDPWorkers(workers)
+	return nil
+}
+
+// listenUDP opens the udp sockets of the collecting process. Multiple sockets
+// are bound to the same address with SO_REUSEPORT, and the first socket
+// resolves the port if it is 0.
+func (cp *CollectingProcess) listenUDP(address *net.UDPAddr) ([]*net.UDPConn, error) {
+	if cp.numUDPSockets <= 1 {
 		conn, err := net.ListenUDP("udp", address)
 		if err != nil {
-			klog.Error(err)
-			return
+			return nil, err
 		}
-		cp.updateAddress(conn.LocalAddr())
-		klog.Infof("Start UDP collecting process on %s", cp.address)
-		defer conn.Close()
-		go func() {
-			for {
-				buff := make([]byte, cp.maxBufferSize)
-				size, address, err := conn.ReadFromUDP(buff)
-				if err != nil {
-					if size == 0 { // received stop collector message
-						return
-					}
-					klog.Errorf("Error in udp collecting process: %v", err)
-					return
+		return []*net.UDPConn{conn}, nil
+	}
+	listenConfig := net.ListenConfig{Control: setReusePort}
+	conns := make([]*net.UDPConn, 0, cp.numUDPSockets)
+	for i := 0; i < cp.numUDPSockets; i++ {
+		if i > 0 {
+			address = conns[0].LocalAddr().(*net.UDPAddr)
+		}
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", address.String())
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+	}
+	return conns, nil
+}
+
+// udpPacket is a packet received from the exporter with the address.
+type udpPacket struct {
+	address string
+	packet  packet
+}
+
+// startUDPWorkers starts the fixed pool of udp decode workers, and returns the
+// queues of packets of the workers.
+func (cp *CollectingProcess) startUDPWorkers(ctx context.Context, wg *sync.WaitGroup) []chan udpPacket {
+	workers := make([]chan udpPacket, cp.numUDPWorkers)
+	for i := range workers {
+		workers[i] = make(chan udpPacket, udpWorkerQueueLength)
+		wg.Add(1)
+		go cp.runUDPWorker(ctx, workers[i], wg)
+	}
+	return workers
+}
+
+// dispatchUDPPacket queues the packet for the worker of the exporter. The packets
+// of an exporter are always decoded by the same worker, so that they are decoded
+// in order.
+func (cp *CollectingProcess) dispatchUDPPacket(ctx context.Context, workers []chan udpPacket, address string, packet packet) {
+	worker := workers[hashAddress(address)%uint32(len(workers))]
+	select {
+	case worker <- udpPacket{address, packet}:
+	case <-ctx.Done():
+		cp.putPacketBuffer(packet.buffer)
+	}
+}
+
+// drainUDPWorkers puts back the buffers of the packets which are still queued
+// once the workers have stopped. The queues must be closed, after the socket
+// readers have stopped.
+func (cp *CollectingProcess) drainUDPWorkers(workers []chan udpPacket) {
+	for _, worker := range workers {
+		for received := range worker {
+			cp.putPacketBuffer(received.packet.buffer)
+		}
+	}
+}
+
+// runUDPWorker decodes the packets of the exporters which are dispatched to the
+// worker, until the collecting process is stopped. The worker owns the clients
+// of its exporters, and deletes them once they are idle for the idle timeout.
+func (cp *CollectingProcess) runUDPWorker(ctx context.Context, packets <-chan udpPacket, wg *sync.WaitGroup) {
+	defer wg.Done()
+	lastSeen := make(map[string]time.Time)
+	ticker := time.NewTicker(cp.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for address := range lastSeen {
+				cp.deleteSessionSequenceStates(address)
+				cp.deleteClient(address)
+			}
+			return
+		case received, ok := <-packets:
+			if !ok {
+				// The queue is closed once the collecting process is stopped,
+				// so wait for ctx to delete the clients.
+				packets = nil
+				continue
+			}
+			if _, exists := lastSeen[received.address]; !exists {
+				// The client does not have a handler of its own, it is only
+				// kept to count the active exporters.
+				cp.addClient(received.address, &clientHandler{})
+			}
+			lastSeen[received.address] = time.Now()
+			cp.decodeClientPacket(received.packet, received.address)
+		case now := <-ticker.C:
+			for address, lastPacketTime := range lastSeen {
+				if now.Sub(lastPacketTime) >= cp.idleTimeout {
+					klog.Infof("UDP exporter %s is idle, deleting it.", address)
+					delete(lastSeen, address)
+					cp.deleteSessionSequenceStates(address)
+					cp.deleteClient(address)
 				}
-				klog.V(2).Infof("Receiving %d bytes from %s", size, address.String())
-				cp.handleUDPClient(address, &wg)
-				cp.clients[address.String()].packetChan <- bytes.NewBuffer(buff[0:size])
 			}
-		}()
+		}
 	}
-	<-cp.stopChan
-	// stop all the workers before closing collector
-	cp.closeAllClients()
-	wg.Wait()
 }
 
-func (cp *CollectingProcess) handleUDPClient(address net.Addr, wg *sync.WaitGroup) {
-	if _, exist := cp.clients[address.String()]; !exist {
-		client := cp.createClient()
-		cp.addClient(address.String(), client)
+// hashAddress returns the FNV-1a hash of the exporter address.
+func hashAddress(address string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(address); i++ {
+		hash ^= uint32(address[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// dtlsListener is the listener of the udp associations of the dtls exporters.
+// Accept returns errDTLSListenerClosed once the listener is closed.
+type dtlsListener struct {
+	net.Listener
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newDTLSListener(listener net.Listener) *dtlsListener {
+	return &dtlsListener{Listener: listener, closeChan: make(chan struct{})}
+}
+
+func (l *dtlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.closeChan:
+			return nil, errDTLSListenerClosed
+		default:
+		}
+	}
+	return conn, err
+}
+
+func (l *dtlsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeChan) })
+	return l.Listener.Close()
+}
+
+// isDTLSHandshakeRecord returns whether the datagram starts with a dtls
+// handshake record. Only handshake records create new udp associations.
+func isDTLSHandshakeRecord(packet []byte) bool {
+	return len(packet) >= dtlsRecordHeaderLen && packet[0] == dtlsContentTypeHandshake
+}
+
+// acceptDTLSConnections accepts the udp associations of the exporters until ctx
+// is done or the listener is closed, and runs the handshake of each association
+// in its own goroutine, so that an exporter which stalls in the middle of its
+// handshake does not delay the others. Timeouts are retried with a backoff, and
+// other errors stop accepting associations.
+func (cp *CollectingProcess) acceptDTLSConnections(ctx context.Context, listener net.Listener, config *dtls.Config, wg *sync.WaitGroup) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if errors.Is(err, errDTLSListenerClosed) {
+				return
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+				klog.Errorf("Cannot accept dtls connections on %s: %v", cp.address, err)
+				return
+			}
+			delay *= 2
+			if delay < dtlsAcceptMinBackoff {
+				delay = dtlsAcceptMinBackoff
+			} else if delay > dtlsAcceptMaxBackoff {
+				delay = dtlsAcceptMaxBackoff
+			}
+			klog.Errorf("Cannot accept dtls connection, retrying in %v: %v", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		delay = 0
 		wg.Add(1)
-		defer wg.Done()
-		go func() {
-			ticker := time.NewTicker(time.Duration(entities.TemplateRefreshTimeOut) * time.Second)
-			for {
+		go cp.handshakeDTLSClient(ctx, conn, config, wg)
+	}
+}
+
+// handshakeDTLSClient runs the handshake of the udp association of an exporter
+// within the handshake timeout, and then decodes its messages. A failed
+// handshake only closes the association of the exporter. The handshake is
+// cancelled when the collecting process is stopped.
+func (cp *CollectingProcess) handshakeDTLSClient(ctx context.Context, conn net.Conn, config *dtls.Config, wg *sync.WaitGroup) {
+	handshakeCtx, cancel := context.WithTimeout(ctx, dtlsHandshakeTimeout)
+	dtlsConn, err := dtls.ServerWithContext(handshakeCtx, conn, config)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			klog.Errorf("Cannot accept dtls connection from %s: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		wg.Done()
+		return
+	}
+	cp.handleDTLSClient(ctx, dtlsConn, wg)
+}
+
+// handleDTLSClient decodes the messages of a DTLS association, which is the
+// transport session of the exporter. The association is closed and its
+// templates are deleted when the exporter closes it, when it is idle for the
+// idle timeout, or when the collecting process is stopped.
+func (cp *CollectingProcess) handleDTLSClient(ctx context.Context, conn net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	address := conn.RemoteAddr().String()
+	client := cp.createClient()
+	cp.addClient(address, client)
+	klog.Infof("Accepted dtls connection from %s", address)
+	readerDone := make(chan bool)
+	go func() {
+		defer close(readerDone)
+		for {
+			buffer := cp.getPacketBuffer(int(cp.maxBufferSize))
+			size, err := conn.Read(*buffer)
+			if err != nil {
+				cp.putPacketBuffer(buffer)
 				select {
-				case <-client.errChan:
-					klog.Infof("Collecting process from %s has stopped.", address.String())
+				case <-client.doneChan: // connection closed by the handler
 					return
-				case <-ticker.C: // set timeout for udp connection
-					klog.Errorf("UDP connection from %s timed out.", address.String())
-					cp.deleteClient(address.String())
-					return
-				case packet := <-client.packetChan:
-					// get the message here
-					message, err := cp.decodePacket(packet, address.String())
-					if err != nil {
-						klog.Error(err)
-						return
-					}
-					klog.V(4).Infof("Processed message from exporter %v, number of records: %v, observation domain ID: %v",
-						message.GetExportAddress(), message.GetSet().GetNumberOfRecords(), message.GetObsDomainID())
-					ticker.Stop()
-					ticker = time.NewTicker(time.Duration(entities.TemplateRefreshTimeOut) * time.Second)
+				default:
+				}
+				if err == io.EOF {
+					klog.Infof("DTLS connection from %s has been closed.", address)
+				} else {
+					klog.Errorf("Error in dtls collecting process: %v", err)
 				}
+				select {
+				case client.errChan <- true:
+				case <-client.doneChan:
+				}
+				return
 			}
-		}()
+			klog.V(2).Infof("Receiving %d bytes from %s", size, address)
+			select {
+			case client.packetChan <- packet{buffer, size}:
+			case <-client.doneChan:
+				cp.putPacketBuffer(buffer)
+				return
+			}
+		}
+	}()
+	idleTimer := time.NewTimer(cp.idleTimeout)
+	defer idleTimer.Stop()
+out:
+	for {
+		select {
+		case <-client.errChan:
+			break out
+		case <-ctx.Done():
+			break out
+		case <-idleTimer.C:
+			klog.Errorf("DTLS connection from %s timed out.", address)
+			break out
+		case packet := <-client.packetChan:
+			cp.decodeClientPacket(packet, address)
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(cp.idleTimeout)
+		}
+	}
+	close(client.doneChan)
+	conn.Close()
+	<-readerDone
+	cp.deleteClient(address)
+	// Templates are not valid anymore once the transport session is closed.
+	cp.deleteSessionTemplates(address)
+	cp.deleteSessionSequenceStates(address)
+}
+
+// handleUDPPacket sends the packet to the worker of the exporter. The worker is
+// started with the first packet of the exporter, and again after it has timed
+// out.
+func (cp *CollectingProcess) handleUDPPacket(ctx context.Context, address string, packet packet, wg *sync.WaitGroup) {
+	for {
+		client := cp.getOrCreateUDPClient(ctx, address, wg)
+		select {
+		case client.packetChan <- packet:
+			return
+		case <-client.doneChan: // the worker has timed out
+		case <-ctx.Done():
+			cp.putPacketBuffer(packet.buffer)
+			return
+		}
+	}
+}
+
+// getOrCreateUDPClient returns the client of the exporter, and starts its worker
+// if it does not exist. The client of an exporter usually exists, so it is looked
+// up with a read lock first, as the lock is shared with the template lookups.
+func (cp *CollectingProcess) getOrCreateUDPClient(ctx context.Context, address string, wg *sync.WaitGroup) *clientHandler {
+	cp.mutex.RLock()
+	client, exist := cp.clients[address]
+	cp.mutex.RUnlock()
+	if exist {
+		return client
+	}
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if client, exist := cp.clients[address]; exist {
+		return client
+	}
+	client = cp.createClient()
+	cp.clients[address] = client
+	wg.Add(1)
+	go cp.handleUDPClient(ctx, address, client, wg)
+	return client
+}
+
+// handleUDPClient decodes the packets of an exporter until it is idle for the
+// idle timeout, or the collecting process is stopped. The sequence number states
+// of the exporter are deleted with its client, as udp exporters may keep sending
+// from new source ports.
+func (cp *CollectingProcess) handleUDPClient(ctx context.Context, address string, client *clientHandler, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(client.doneChan)
+	idleTimer := time.NewTimer(cp.idleTimeout)
+	defer idleTimer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Infof("Collecting process from %s has stopped.", address)
+			cp.deleteSessionSequenceStates(address)
+			cp.deleteClient(address)
+			return
+		case <-idleTimer.C: // set timeout for udp connection
+			klog.Errorf("UDP connection from %s timed out.", address)
+			// The client is deleted before it is done, so that new packets
+			// start a new worker.
+			cp.deleteSessionSequenceStates(address)
+			cp.deleteClient(address)
+			return
+		case packet := <-client.packetChan:
+			cp.decodeClientPacket(packet, address)
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(cp.idleTimeout)
+		}
 	}
 }
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"time"
 )
 
 type IEDataType uint8
@@ -110,6 +111,16 @@ func NewInfoElement(name string, ieID uint16, ieType IEDataType, entID uint32, l
 	}
 }
 
+// NewReducedSizeInfoElement returns a copy of the information element with the
+// given length for reduced-size encoding as per RFC7011 section 6.2. The given
+// element, which is usually shared through the registry, is not modified.
+func NewReducedSizeInfoElement(element *InfoElement, length uint16) (*InfoElement, error) {
+	if !isReducedSizeAllowed(element.DataType, length) {
+		return nil, fmt.Errorf("reduced-size encoding with length %d is not supported for element %s", length, element.Name)
+	}
+	return NewInfoElement(element.Name, element.ElementId, element.DataType, element.EnterpriseId, length), nil
+}
+
 func NewInfoElementWithValue(element *InfoElement, value interface{}) *InfoElementWithValue {
 	return &InfoElementWithValue{
 		element, value, 0,
@@ -174,11 +185,39 @@ func IsValidDataType(tp IEDataType) bool {
 
 // DecodeToIEDataType is to decode to specific type
 func DecodeToIEDataType(dataType IEDataType, val interface{}) (interface{}, error) {
+	// Values of structured data types need the template cache to be decoded, so
+	// they are decoded by DecodeStructuredValue beforehand.
+	switch val.(type) {
+	case *BasicListValue, *SubTemplateListValue, *SubTemplateMultiListValue:
+		if IsStructuredDataType(dataType) {
+			return val, nil
+		}
+	}
 	value, ok := val.([]byte)
 	if !ok {
 		return nil, fmt.Errorf("error when converting value to []bytes for decoding")
 	}
+	if dataType == OctetArray {
+		// The value is returned as is, so that it is not boxed again.
+		return val, nil
+	}
+	return DecodeBytesToIEDataType(dataType, value)
+}
+
+// DecodeBytesToIEDataType decodes the raw bytes of a field to the specific
+// type. Unlike DecodeToIEDataType, it takes the bytes without boxing them, so
+// that the only allocation is the decoded value, if it does not fit in an
+// interface value.
+func DecodeBytesToIEDataType(dataType IEDataType, value []byte) (interface{}, error) {
+	if fullLen := InfoElementLength[dataType]; fullLen != VariableLength && len(value) != int(fullLen) {
+		if len(value) > int(fullLen) || !isReducedSizeAllowed(dataType, uint16(len(value))) {
+			return nil, fmt.Errorf("value of length %d is invalid for data type %d", len(value), dataType)
+		}
+		return decodeReducedSizeValue(dataType, value), nil
+	}
 	switch dataType {
+	case OctetArray:
+		return value, nil
 	case Unsigned8:
 		return value[0], nil
 	case Unsigned16:
@@ -211,8 +250,10 @@ func DecodeToIEDataType(dataType IEDataType, val interface{}) (interface{}, erro
 	case DateTimeMilliseconds:
 		v := binary.BigEndian.Uint64(value)
 		return v, nil
-	case DateTimeMicroseconds, DateTimeNanoseconds:
-		return nil, fmt.Errorf("API does not support micro and nano seconds types yet")
+	case DateTimeMicroseconds:
+		return decodeNTPTimestamp(binary.BigEndian.Uint64(value), true), nil
+	case DateTimeNanoseconds:
+		return decodeNTPTimestamp(binary.BigEndian.Uint64(value), false), nil
 	case MacAddress:
 		return net.HardwareAddr(value), nil
 	case Ipv4Address, Ipv6Address:
@@ -227,6 +268,15 @@ func DecodeToIEDataType(dataType IEDataType, val interface{}) (interface{}, erro
 // EncodeToIEDataType is to encode data to specific type to the buff
 func EncodeToIEDataType(dataType IEDataType, val interface{}) ([]byte, error) {
 	switch dataType {
+	case OctetArray:
+		v, ok := val.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type []byte for this element", val)
+		}
+		if len(v) >= 65535 {
+			return nil, fmt.Errorf("octetArray of length %d exceeds the maximum variable length", len(v))
+		}
+		return addVariableLengthPrefix(v), nil
 	case Unsigned8:
 		v, ok := val.(uint8)
 		if !ok {
@@ -332,10 +382,14 @@ func EncodeToIEDataType(dataType IEDataType, val interface{}) ([]byte, error) {
 		b := make([]byte, 8)
 		binary.BigEndian.PutUint64(b, v)
 		return b, nil
-		// Currently only supporting seconds and milliseconds
 	case DateTimeMicroseconds, DateTimeNanoseconds:
-		// TODO: RFC 7011 has extra spec for these data types. Need to follow that
-		return nil, fmt.Errorf("API does not support micro and nano seconds types yet")
+		v, ok := val.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type time.Time", val)
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, encodeNTPTimestamp(v, dataType == DateTimeMicroseconds))
+		return b, nil
 	case MacAddress:
 		// Expects net.Hardware type
 		v, ok := val.(net.HardwareAddr)
@@ -386,6 +440,15 @@ func EncodeToIEDataType(dataType IEDataType, val interface{}) ([]byte, error) {
 			}
 		}
 		return encodedBytes, nil
+	case BasicList, SubTemplateList, SubTemplateMultiList:
+		v, err := encodeStructuredValue(dataType, val)
+		if err != nil {
+			return nil, err
+		}
+		if len(v) >= 65535 {
+			return nil, fmt.Errorf("encoded value of length %d exceeds the maximum variable length", len(v))
+		}
+		return addVariableLengthPrefix(v), nil
 	}
 	return nil, fmt.Errorf("API supports only valid information elements with datatypes given in RFC7011")
 }
@@ -395,7 +458,28 @@ func encodeToBuff(dataType IEDataType, val interface{}, length int, buffer []byt
 	if index+length > len(buffer) {
 		return fmt.Errorf("buffer size is not enough for encoding")
 	}
+	if fullLen := InfoElementLength[dataType]; fullLen != VariableLength && length < int(fullLen) {
+		v, err := encodeReducedSizeValue(dataType, val, length)
+		if err != nil {
+			return err
+		}
+		copy(buffer[index:], v)
+		return nil
+	}
 	switch dataType {
+	case OctetArray:
+		v, ok := val.([]byte)
+		if !ok {
+			return fmt.Errorf("val argument %v is not of type []byte for this element", val)
+		}
+		// The value is prefixed with its length unless the element has fixed length.
+		if len(v) != length {
+			v = addVariableLengthPrefix(v)
+		}
+		if len(v) != length {
+			return fmt.Errorf("octetArray of length %d does not match the element length %d", len(v), length)
+		}
+		copy(buffer[index:], v)
 	case Unsigned8:
 		v, ok := val.(uint8)
 		if !ok {
@@ -479,10 +563,12 @@ func encodeToBuff(dataType IEDataType, val interface{}, length int, buffer []byt
 			return fmt.Errorf("val argument %v is not of type uint64", val)
 		}
 		binary.BigEndian.PutUint64(buffer[index:], v)
-		// Currently only supporting seconds and milliseconds
 	case DateTimeMicroseconds, DateTimeNanoseconds:
-		// TODO: RFC 7011 has extra spec for these data types. Need to follow that
-		return fmt.Errorf("API does not support micro and nano seconds types yet")
+		v, ok := val.(time.Time)
+		if !ok {
+			return fmt.Errorf("val argument %v is not of type time.Time", val)
+		}
+		binary.BigEndian.PutUint64(buffer[index:], encodeNTPTimestamp(v, dataType == DateTimeMicroseconds))
 	case MacAddress:
 		// Expects net.Hardware type
 		v, ok := val.(net.HardwareAddr)
@@ -529,14 +615,170 @@ func encodeToBuff(dataType IEDataType, val interface{}, length int, buffer []byt
 				buffer[i+index+3] = byte(b)
 			}
 		}
+	case BasicList, SubTemplateList, SubTemplateMultiList:
+		v, err := encodeStructuredValue(dataType, val)
+		if err != nil {
+			return err
+		}
+		// The value is prefixed with its length unless the element has fixed length.
+		if len(v) != length {
+			v = addVariableLengthPrefix(v)
+		}
+		if len(v) != length {
+			return fmt.Errorf("encoded value of length %d does not match the element length %d", len(v), length)
+		}
+		copy(buffer[index:], v)
 	default:
 		return fmt.Errorf("API supports only valid information elements with datatypes given in RFC7011")
 	}
 	return nil
 }
 
-func setInfoElementLen(element *InfoElementWithValue) {
-	if element.Element.DataType != String {
+// isReducedSizeAllowed returns whether values of the data type can be encoded
+// with the given length, which is shorter than the full length of the data type.
+// Reduced-size encoding applies to integers, float64 and the timestamps that are
+// encoded as integers (RFC7011 section 6.2).
+func isReducedSizeAllowed(dataType IEDataType, length uint16) bool {
+	switch dataType {
+	case Unsigned16, Unsigned32, Unsigned64, Signed16, Signed32, Signed64, DateTimeSeconds, DateTimeMilliseconds:
+		return length > 0 && length < InfoElementLength[dataType]
+	case Float64:
+		return length == 4
+	default:
+		return false
+	}
+}
+
+func isSigned(dataType IEDataType) bool {
+	return dataType == Signed8 || dataType == Signed16 || dataType == Signed32 || dataType == Signed64
+}
+
+// decodeReducedSizeValue decodes the reduced-size value of the data type
+// directly from its bytes. Signed integers are sign-extended and float32 values
+// are converted to float64.
+func decodeReducedSizeValue(dataType IEDataType, value []byte) interface{} {
+	if dataType == Float64 {
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+	}
+	var v uint64
+	if isSigned(dataType) && value[0]&0x80 != 0 {
+		v = math.MaxUint64
+	}
+	for _, octet := range value {
+		v = v<<8 | uint64(octet)
+	}
+	switch dataType {
+	case Unsigned16:
+		return uint16(v)
+	case Unsigned32, DateTimeSeconds:
+		return uint32(v)
+	case Signed16:
+		return int16(v)
+	case Signed32:
+		return int32(v)
+	case Signed64:
+		return int64(v)
+	default:
+		// Unsigned64 and DateTimeMilliseconds
+		return v
+	}
+}
+
+// encodeReducedSizeValue encodes the value with the given length, which is
+// shorter than the full length of the data type. It returns an error if the
+// value does not fit in the given length.
+func encodeReducedSizeValue(dataType IEDataType, val interface{}, length int) ([]byte, error) {
+	if !isReducedSizeAllowed(dataType, uint16(length)) {
+		return nil, fmt.Errorf("reduced-size encoding with length %d is not supported for data type %d", length, dataType)
+	}
+	if dataType == Float64 {
+		v, ok := val.(float64)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type float64", val)
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(v)))
+		return b, nil
+	}
+	b, err := EncodeToIEDataType(dataType, val)
+	if err != nil {
+		return nil, err
+	}
+	// The value fits if the truncated bytes only hold zero or sign extension.
+	truncatedLen := len(b) - length
+	extension := byte(0)
+	if isSigned(dataType) && b[truncatedLen]&0x80 != 0 {
+		extension = 0xff
+	}
+	for _, octet := range b[:truncatedLen] {
+		if octet != extension {
+			return nil, fmt.Errorf("val argument %v does not fit in %d bytes", val, length)
+		}
+	}
+	return b[truncatedLen:], nil
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900-01-01)
+// and the Unix epoch (1970-01-01).
+const ntpEpochOffset = 2208988800
+
+// encodeNTPTimestamp encodes the time in NTP timestamp format as per RFC7011
+// sections 6.1.9 and 6.1.10: seconds since the NTP epoch in the upper 32 bits
+// and the fraction of second in the lower 32 bits. For microseconds, the lower
+// 11 bits of the fraction are set to zero.
+func encodeNTPTimestamp(t time.Time, isMicroseconds bool) uint64 {
+	seconds := uint64(t.Unix()+ntpEpochOffset) & 0xffffffff
+	var fraction uint64
+	if isMicroseconds {
+		microseconds := uint64(t.Nanosecond() / 1000)
+		fraction = ((microseconds << 32) + 500000) / 1000000
+		fraction = fraction &^ 0x7ff
+	} else {
+		fraction = ((uint64(t.Nanosecond()) << 32) + 500000000) / 1000000000
+	}
+	return seconds<<32 | fraction
+}
+
+// decodeNTPTimestamp decodes the NTP timestamp to time in UTC. Timestamps with
+// the most significant bit of seconds set to 0 are considered to be after 2036
+// (NTP era 1) as per RFC4330 section 3.
+func decodeNTPTimestamp(timestamp uint64, isMicroseconds bool) time.Time {
+	seconds := timestamp >> 32
+	if seconds&0x80000000 == 0 {
+		seconds += 1 << 32
+	}
+	fraction := timestamp & 0xffffffff
+	var nanoseconds int64
+	if isMicroseconds {
+		// The lower 11 bits of the fraction must be ignored for microseconds.
+		fraction &^= 0x7ff
+		nanoseconds = int64((fraction*1000000+(1<<31))>>32) * 1000
+	} else {
+		nanoseconds = int64((fraction*1000000000 + (1 << 31)) >> 32)
+	}
+	return time.Unix(int64(seconds)-ntpEpochOffset, nanoseconds).UTC()
+}
+
+func setInfoElementLen(element *InfoElementWithValue) error {
+	if element.Element.DataType == OctetArray && element.Element.Len != VariableLength {
+		v, ok := element.Value.([]byte)
+		if !ok || len(v) != int(element.Element.Len) {
+			return fmt.Errorf("val argument %v is not an octetArray of length %d", element.Value, element.Element.Len)
+		}
+		element.Length = len(v)
+	} else if (element.Element.DataType == OctetArray || IsStructuredDataType(element.Element.DataType)) && element.Element.Len == VariableLength {
+		v, err := EncodeToIEDataType(element.Element.DataType, element.Value)
+		if err != nil {
+			return err
+		}
+		element.Length = len(v)
+	} else if fullLen := InfoElementLength[element.Element.DataType]; fullLen != VariableLength && element.Element.Len < fullLen {
+		// Make sure that the value fits in the reduced size.
+		if _, err := encodeReducedSizeValue(element.Element.DataType, element.Value, int(element.Element.Len)); err != nil {
+			return err
+		}
+		element.Length = int(element.Element.Len)
+	} else if element.Element.DataType != String {
 		element.Length = int(element.Element.Len)
 	} else {
 		v := element.Value.(string)
@@ -546,4 +788,5 @@ func setInfoElementLen(element *InfoElementWithValue) {
 			element.Length = len(v) + 3
 		}
 	}
+	return nil
 }
@@ -3,11 +3,13 @@ package entities
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 var macAddress, _ = net.ParseMAC("aa:bb:cc:dd:ee:ff")
+var timestamp = time.Date(2020, 11, 10, 12, 30, 45, 123456789, time.UTC)
 var valData = []struct {
 	value          interface{}
 	length         int
@@ -29,6 +31,8 @@ var valData = []struct {
 	{false, 1, Boolean, false, []byte{0x2}},
 	{macAddress, 6, MacAddress, net.HardwareAddr([]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}), []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}},
 	{uint32(1257894000), 4, DateTimeSeconds, uint32(1257894000), []byte{0x4a, 0xf9, 0xf0, 0x70}},
+	{timestamp, 8, DateTimeMicroseconds, timestamp.Truncate(time.Microsecond), []byte{0xe3, 0x55, 0x6, 0x75, 0x1f, 0x9a, 0xc8, 0x0}},
+	{timestamp, 8, DateTimeNanoseconds, timestamp, []byte{0xe3, 0x55, 0x6, 0x75, 0x1f, 0x9a, 0xdd, 0x37}},
 	{net.ParseIP("1.2.3.4"), 4, Ipv4Address, net.IP([]byte{0x1, 0x2, 0x3, 0x4}), []byte{0x1, 0x2, 0x3, 0x4}},
 	{net.ParseIP("2001:0:3238:DFE1:63::FEFB"), 16, Ipv6Address, net.IP([]byte{0x20, 0x1, 0x0, 0x0, 0x32, 0x38, 0xdf, 0xe1, 0x0, 0x63, 0x0, 0x0, 0x0, 0x0, 0xfe, 0xfb}), []byte{0x20, 0x1, 0x0, 0x0, 0x32, 0x38, 0xdf, 0xe1, 0x0, 0x63, 0x0, 0x0, 0x0, 0x0, 0xfe, 0xfb}},
 }
@@ -40,12 +44,18 @@ func TestDecodeToIEDataType(t *testing.T) {
 		v, err := DecodeToIEDataType(data.dataType, buff)
 		assert.Nil(t, err)
 		assert.Equal(t, data.expectedDecode, v)
+		v, err = DecodeBytesToIEDataType(data.dataType, buff)
+		assert.Nil(t, err)
+		assert.Equal(t, data.expectedDecode, v)
 	}
 	// Handle string differently since it cannot be directly write to buffer
 	s := "Test String"
 	v, err := DecodeToIEDataType(String, []byte(s))
 	assert.Nil(t, err)
 	assert.Equal(t, s, v)
+	v, err = DecodeToIEDataType(OctetArray, []byte{0x1, 0x2, 0x3})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1, 0x2, 0x3}, v)
 }
 
 func TestEncodeToIEDataType(t *testing.T) {
@@ -64,6 +74,16 @@ func TestEncodeToIEDataType(t *testing.T) {
 	buff, err := EncodeToIEDataType(String, s)
 	assert.Nil(t, err)
 	assert.Equal(t, []byte{0x4, 0x54, 0x65, 0x73, 0x74}, buff)
+	buff, err = EncodeToIEDataType(OctetArray, []byte{0x1, 0x2, 0x3})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x3, 0x1, 0x2, 0x3}, buff)
+	// octetArray of 300 bytes uses the 3-byte length prefix
+	buff, err = EncodeToIEDataType(OctetArray, make([]byte, 300))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xff, 0x1, 0x2c}, buff[:3])
+	assert.Equal(t, 303, len(buff))
+	_, err = EncodeToIEDataType(OctetArray, "Test")
+	assert.NotNil(t, err)
 }
 
 func TestEncodeToBuff(t *testing.T) {
@@ -83,6 +103,18 @@ func TestEncodeToBuff(t *testing.T) {
 	err := encodeToBuff(String, s, 5, buff, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, []byte{0x4, 0x54, 0x65, 0x73, 0x74}, buff)
+	// octetArray of fixed length
+	buff = make([]byte, 3)
+	err = encodeToBuff(OctetArray, []byte{0x1, 0x2, 0x3}, 3, buff, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1, 0x2, 0x3}, buff)
+	// octetArray of variable length
+	buff = make([]byte, 4)
+	err = encodeToBuff(OctetArray, []byte{0x1, 0x2, 0x3}, 4, buff, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x3, 0x1, 0x2, 0x3}, buff)
+	err = encodeToBuff(OctetArray, []byte{0x1, 0x2, 0x3}, 2, buff, 0)
+	assert.NotNil(t, err)
 }
 
 func TestNewInfoElementWithValue(t *testing.T) {
@@ -91,3 +123,88 @@ func TestNewInfoElementWithValue(t *testing.T) {
 	assert.Equal(t, element.Element.Name, "sourceIPv4Address")
 	assert.Equal(t, element.Value, ip)
 }
+
+func TestNTPTimestamp(t *testing.T) {
+	// Microseconds and nanoseconds are kept after encoding and decoding.
+	for i := 0; i < 1000; i++ {
+		ts := time.Unix(1605011445, int64(i)*999999).UTC()
+		assert.Equal(t, ts.Truncate(time.Microsecond), decodeNTPTimestamp(encodeNTPTimestamp(ts, true), true))
+		assert.Equal(t, ts, decodeNTPTimestamp(encodeNTPTimestamp(ts, false), false))
+	}
+	// Lower 11 bits of the fraction are zero for microseconds.
+	assert.Equal(t, uint64(0), encodeNTPTimestamp(timestamp, true)&0x7ff)
+	// Lower 11 bits of the fraction are ignored when decoding microseconds: a
+	// fraction of 0x800 is less than half a microsecond, but 0xfff is not.
+	ts := time.Unix(1605011445, 0).UTC()
+	assert.Equal(t, ts, decodeNTPTimestamp(encodeNTPTimestamp(ts, true)|0xfff, true))
+	assert.Equal(t, ts.Add(time.Microsecond), decodeNTPTimestamp(encodeNTPTimestamp(ts, false)|0xfff, false).Round(time.Microsecond))
+	// Most significant bit of seconds is set from 1968 until 2036 in NTP era 0.
+	assert.Equal(t, uint64(0x80000000)<<32, encodeNTPTimestamp(time.Date(1968, 1, 20, 3, 14, 8, 0, time.UTC), false))
+	// Time after the NTP era 0 wraps around in 2036.
+	ts = time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, ts, decodeNTPTimestamp(encodeNTPTimestamp(ts, false), false))
+}
+
+func TestReducedSizeEncoding(t *testing.T) {
+	tests := []struct {
+		dataType IEDataType
+		value    interface{}
+		encoded  []byte
+	}{
+		{Unsigned64, uint64(123456), []byte{0x0, 0x1, 0xe2, 0x40}},
+		{Unsigned32, uint32(443), []byte{0x1, 0xbb}},
+		{Unsigned16, uint16(80), []byte{0x50}},
+		{Signed64, int64(-12345), []byte{0xcf, 0xc7}},
+		{Signed32, int32(12345), []byte{0x0, 0x30, 0x39}},
+		{Float64, float64(10.5), []byte{0x41, 0x28, 0x0, 0x0}},
+		{DateTimeMilliseconds, uint64(1605011445000), []byte{0x1, 0x75, 0xb2, 0x23, 0x15, 0x8}},
+	}
+	for _, test := range tests {
+		buff := make([]byte, len(test.encoded))
+		err := encodeToBuff(test.dataType, test.value, len(test.encoded), buff, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, test.encoded, buff)
+		v, err := DecodeToIEDataType(test.dataType, test.encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, test.value, v)
+		v, err = DecodeBytesToIEDataType(test.dataType, test.encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, test.value, v)
+	}
+	// Reduced-size values are decoded without expanding them to a new slice.
+	encoded := []byte{0x0, 0x50}
+	allocs := testing.AllocsPerRun(100, func() {
+		DecodeBytesToIEDataType(Unsigned64, encoded)
+	})
+	assert.Equal(t, float64(0), allocs)
+	// Values that do not fit in the reduced size
+	buff := make([]byte, 2)
+	assert.NotNil(t, encodeToBuff(Unsigned64, uint64(65536), 2, buff, 0))
+	assert.NotNil(t, encodeToBuff(Signed32, int32(-32769), 2, buff, 0))
+	assert.NotNil(t, encodeToBuff(Signed32, int32(32768), 2, buff, 0))
+	// Data types that do not support reduced-size encoding
+	assert.NotNil(t, encodeToBuff(Ipv4Address, net.ParseIP("1.2.3.4"), 2, buff, 0))
+	_, err := DecodeToIEDataType(Ipv4Address, []byte{0x1, 0x2})
+	assert.NotNil(t, err)
+	_, err = DecodeToIEDataType(Float64, []byte{0x1, 0x2})
+	assert.NotNil(t, err)
+	_, err = DecodeToIEDataType(Unsigned32, []byte{0x1, 0x2, 0x3, 0x4, 0x5})
+	assert.NotNil(t, err)
+}
+
+func TestNewReducedSizeInfoElement(t *testing.T) {
+	element := NewInfoElement("octetDeltaCount", 1, Unsigned64, 0, 8)
+	reducedElement, err := NewReducedSizeInfoElement(element, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(4), reducedElement.Len)
+	assert.Equal(t, uint16(8), element.Len, "Original element should not be modified")
+	_, err = NewReducedSizeInfoElement(element, 9)
+	assert.NotNil(t, err)
+	_, err = NewReducedSizeInfoElement(NewInfoElement("sourceIPv4Address", 8, Ipv4Address, 0, 4), 2)
+	assert.NotNil(t, err)
+	// Value of a data record should fit in the reduced size.
+	record := NewDataRecord(uniqueTemplateID, 1, false)
+	assert.NotNil(t, record.AddInfoElement(NewInfoElementWithValue(reducedElement, uint64(1)<<32)))
+	assert.Nil(t, record.AddInfoElement(NewInfoElementWithValue(reducedElement, uint64(1)<<31)))
+	assert.Equal(t, []byte{0x80, 0x0, 0x0, 0x0}, record.GetBuffer())
+}
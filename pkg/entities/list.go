@@ -0,0 +1,395 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package entities
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// This file contains the structured data types basicList, subTemplateList and
+// subTemplateMultiList as specified in RFC6313.
+
+// Semantic of the list as per RFC6313 section 4.4.
+const (
+	SemanticNoneOf       uint8 = 0x00
+	SemanticExactlyOneOf uint8 = 0x01
+	SemanticOneOrMoreOf  uint8 = 0x02
+	SemanticAllOf        uint8 = 0x03
+	SemanticOrdered      uint8 = 0x04
+	SemanticUndefined    uint8 = 0xFF
+)
+
+const (
+	// semantic, field ID and element length; enterprise number is optional
+	basicListHeaderLen = 5
+	// semantic and template ID
+	subTemplateListHeaderLen = 3
+	// template ID and data records length
+	subTemplateMultiListEntryHeaderLen = 4
+)
+
+// BasicListValue is the value of an information element of basicList type. It holds
+// zero or more values of the same information element.
+type BasicListValue struct {
+	Semantic uint8
+	Element  *InfoElement
+	Values   []interface{}
+}
+
+// SubTemplateListValue is the value of an information element of subTemplateList
+// type. It holds zero or more data records of the same template. Each record is
+// the list of elements in template order.
+type SubTemplateListValue struct {
+	Semantic   uint8
+	TemplateID uint16
+	Records    [][]*InfoElementWithValue
+}
+
+// SubTemplateMultiListValue is the value of an information element of
+// subTemplateMultiList type. It holds data records of one or more templates.
+type SubTemplateMultiListValue struct {
+	Semantic uint8
+	Entries  []SubTemplateMultiListEntry
+}
+
+// SubTemplateMultiListEntry holds the data records of one template in a
+// subTemplateMultiList.
+type SubTemplateMultiListEntry struct {
+	TemplateID uint16
+	Records    [][]*InfoElementWithValue
+}
+
+// ElementResolver returns the information element given the element ID,
+// enterprise ID and field length of the field specifier in a basicList.
+type ElementResolver func(elementID uint16, enterpriseID uint32, length uint16) (*InfoElement, error)
+
+// TemplateResolver returns the elements of the template referred to by a
+// subTemplateList or subTemplateMultiList.
+type TemplateResolver func(templateID uint16) ([]*InfoElement, error)
+
+// IsStructuredDataType returns whether the data type is one of the structured
+// data types from RFC6313.
+func IsStructuredDataType(dataType IEDataType) bool {
+	return dataType == BasicList || dataType == SubTemplateList || dataType == SubTemplateMultiList
+}
+
+// DecodeStructuredValue decodes the value of an information element of a
+// structured data type. The value does not include the variable length prefix.
+// Elements of basicLists and templates of subTemplateLists and
+// subTemplateMultiLists are resolved with the given resolvers.
+func DecodeStructuredValue(dataType IEDataType, value []byte, getElement ElementResolver, getTemplate TemplateResolver) (interface{}, error) {
+	decoder := listDecoder{getElement, getTemplate}
+	switch dataType {
+	case BasicList:
+		return decoder.decodeBasicList(value)
+	case SubTemplateList:
+		return decoder.decodeSubTemplateList(value)
+	case SubTemplateMultiList:
+		return decoder.decodeSubTemplateMultiList(value)
+	default:
+		return nil, fmt.Errorf("data type %d is not a structured data type", dataType)
+	}
+}
+
+type listDecoder struct {
+	getElement  ElementResolver
+	getTemplate TemplateResolver
+}
+
+func (d *listDecoder) decodeBasicList(value []byte) (*BasicListValue, error) {
+	if len(value) < basicListHeaderLen {
+		return nil, fmt.Errorf("basicList of length %d is shorter than its header", len(value))
+	}
+	elementID := binary.BigEndian.Uint16(value[1:3])
+	length := binary.BigEndian.Uint16(value[3:5])
+	offset := basicListHeaderLen
+	var enterpriseID uint32
+	if elementID&0x8000 != 0 {
+		if len(value) < basicListHeaderLen+4 {
+			return nil, fmt.Errorf("basicList of length %d is shorter than its header", len(value))
+		}
+		elementID = elementID ^ 0x8000
+		enterpriseID = binary.BigEndian.Uint32(value[5:9])
+		offset += 4
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("element %d in basicList has length 0", elementID)
+	}
+	element, err := d.getElement(elementID, enterpriseID, length)
+	if err != nil {
+		return nil, err
+	}
+	if element.Len != VariableLength && element.Len != length {
+		// Reduced-size encoding
+		element, err = NewReducedSizeInfoElement(element, length)
+		if err != nil {
+			return nil, err
+		}
+	}
+	list := &BasicListValue{
+		Semantic: value[0],
+		Element:  element,
+		Values:   make([]interface{}, 0),
+	}
+	for offset < len(value) {
+		var field []byte
+		field, offset, err = readField(value, offset, length)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decodeValue(element, field)
+		if err != nil {
+			return nil, err
+		}
+		list.Values = append(list.Values, v)
+	}
+	return list, nil
+}
+
+func (d *listDecoder) decodeSubTemplateList(value []byte) (*SubTemplateListValue, error) {
+	if len(value) < subTemplateListHeaderLen {
+		return nil, fmt.Errorf("subTemplateList of length %d is shorter than its header", len(value))
+	}
+	list := &SubTemplateListValue{
+		Semantic:   value[0],
+		TemplateID: binary.BigEndian.Uint16(value[1:3]),
+	}
+	records, err := d.decodeRecords(list.TemplateID, value[subTemplateListHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	list.Records = records
+	return list, nil
+}
+
+func (d *listDecoder) decodeSubTemplateMultiList(value []byte) (*SubTemplateMultiListValue, error) {
+	if len(value) < 1 {
+		return nil, fmt.Errorf("subTemplateMultiList does not have semantic")
+	}
+	list := &SubTemplateMultiListValue{
+		Semantic: value[0],
+		Entries:  make([]SubTemplateMultiListEntry, 0),
+	}
+	offset := 1
+	for len(value)-offset >= subTemplateMultiListEntryHeaderLen {
+		templateID := binary.BigEndian.Uint16(value[offset : offset+2])
+		// Data records length includes the template ID and the length fields.
+		length := int(binary.BigEndian.Uint16(value[offset+2 : offset+4]))
+		if length < subTemplateMultiListEntryHeaderLen || offset+length > len(value) {
+			return nil, fmt.Errorf("data records length %d of template %d in subTemplateMultiList is invalid", length, templateID)
+		}
+		records, err := d.decodeRecords(templateID, value[offset+subTemplateMultiListEntryHeaderLen:offset+length])
+		if err != nil {
+			return nil, err
+		}
+		list.Entries = append(list.Entries, SubTemplateMultiListEntry{templateID, records})
+		offset += length
+	}
+	return list, nil
+}
+
+func (d *listDecoder) decodeRecords(templateID uint16, buffer []byte) ([][]*InfoElementWithValue, error) {
+	elements, err := d.getTemplate(templateID)
+	if err != nil {
+		return nil, err
+	}
+	minRecordLen := 0
+	for _, element := range elements {
+		if element.Len == VariableLength {
+			minRecordLen = minRecordLen + 1
+		} else {
+			minRecordLen = minRecordLen + int(element.Len)
+		}
+	}
+	records := make([][]*InfoElementWithValue, 0)
+	offset := 0
+	for minRecordLen > 0 && len(buffer)-offset >= minRecordLen {
+		record := make([]*InfoElementWithValue, len(elements))
+		for i, element := range elements {
+			var field []byte
+			field, offset, err = readField(buffer, offset, element.Len)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.decodeValue(element, field)
+			if err != nil {
+				return nil, err
+			}
+			record[i] = NewInfoElementWithValue(element, v)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (d *listDecoder) decodeValue(element *InfoElement, value []byte) (interface{}, error) {
+	if IsStructuredDataType(element.DataType) {
+		return DecodeStructuredValue(element.DataType, value, d.getElement, d.getTemplate)
+	}
+	return DecodeToIEDataType(element.DataType, value)
+}
+
+// readField returns the field at the offset of the buffer and the offset after
+// the field. Fields of variable length are prefixed with their length
+// (encoding reference: https://tools.ietf.org/html/rfc7011#section-7).
+func readField(buffer []byte, offset int, length uint16) ([]byte, int, error) {
+	fieldLen := int(length)
+	if length == VariableLength {
+		if offset >= len(buffer) {
+			return nil, 0, fmt.Errorf("buffer is too short to read the field length")
+		}
+		fieldLen = int(buffer[offset])
+		offset++
+		if fieldLen == 255 {
+			if offset+2 > len(buffer) {
+				return nil, 0, fmt.Errorf("buffer is too short to read the field length")
+			}
+			fieldLen = int(binary.BigEndian.Uint16(buffer[offset : offset+2]))
+			offset += 2
+		}
+	}
+	if offset+fieldLen > len(buffer) {
+		return nil, 0, fmt.Errorf("field length %d is more than the remaining %d bytes", fieldLen, len(buffer)-offset)
+	}
+	return buffer[offset : offset+fieldLen], offset + fieldLen, nil
+}
+
+// encodeStructuredValue encodes the value of an information element of a
+// structured data type without the variable length prefix.
+func encodeStructuredValue(dataType IEDataType, val interface{}) ([]byte, error) {
+	switch dataType {
+	case BasicList:
+		v, ok := val.(*BasicListValue)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type *BasicListValue", val)
+		}
+		return v.encode()
+	case SubTemplateList:
+		v, ok := val.(*SubTemplateListValue)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type *SubTemplateListValue", val)
+		}
+		return v.encode()
+	case SubTemplateMultiList:
+		v, ok := val.(*SubTemplateMultiListValue)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type *SubTemplateMultiListValue", val)
+		}
+		return v.encode()
+	default:
+		return nil, fmt.Errorf("data type %d is not a structured data type", dataType)
+	}
+}
+
+func (l *BasicListValue) encode() ([]byte, error) {
+	if l.Element == nil {
+		return nil, fmt.Errorf("element of basicList is not defined")
+	}
+	buffer := make([]byte, basicListHeaderLen)
+	buffer[0] = l.Semantic
+	binary.BigEndian.PutUint16(buffer[1:3], l.Element.ElementId)
+	binary.BigEndian.PutUint16(buffer[3:5], l.Element.Len)
+	if l.Element.EnterpriseId != 0 {
+		// Set the MSB of elementID to 1 as per RFC7011
+		buffer[1] = buffer[1] | 0x80
+		enterpriseID := make([]byte, 4)
+		binary.BigEndian.PutUint32(enterpriseID, l.Element.EnterpriseId)
+		buffer = append(buffer, enterpriseID...)
+	}
+	for _, value := range l.Values {
+		b, err := encodeFieldValue(l.Element, value)
+		if err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, b...)
+	}
+	return buffer, nil
+}
+
+func (l *SubTemplateListValue) encode() ([]byte, error) {
+	buffer := make([]byte, subTemplateListHeaderLen)
+	buffer[0] = l.Semantic
+	binary.BigEndian.PutUint16(buffer[1:3], l.TemplateID)
+	return appendRecords(buffer, l.Records)
+}
+
+func (l *SubTemplateMultiListValue) encode() ([]byte, error) {
+	buffer := []byte{l.Semantic}
+	for _, entry := range l.Entries {
+		header := make([]byte, subTemplateMultiListEntryHeaderLen)
+		binary.BigEndian.PutUint16(header[0:2], entry.TemplateID)
+		entryBuffer, err := appendRecords(header, entry.Records)
+		if err != nil {
+			return nil, err
+		}
+		if len(entryBuffer) > 65535 {
+			return nil, fmt.Errorf("data records of template %d in subTemplateMultiList are too long", entry.TemplateID)
+		}
+		binary.BigEndian.PutUint16(entryBuffer[2:4], uint16(len(entryBuffer)))
+		buffer = append(buffer, entryBuffer...)
+	}
+	return buffer, nil
+}
+
+func appendRecords(buffer []byte, records [][]*InfoElementWithValue) ([]byte, error) {
+	for _, record := range records {
+		for _, element := range record {
+			b, err := encodeFieldValue(element.Element, element.Value)
+			if err != nil {
+				return nil, err
+			}
+			buffer = append(buffer, b...)
+		}
+	}
+	return buffer, nil
+}
+
+// encodeFieldValue encodes the value of the element in a list, taking reduced-size
+// encoding of the element into account.
+func encodeFieldValue(element *InfoElement, val interface{}) ([]byte, error) {
+	if element.DataType == OctetArray && element.Len != VariableLength {
+		// Octet arrays of fixed length are not prefixed with their length.
+		v, ok := val.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("val argument %v is not of type []byte for this element", val)
+		}
+		if len(v) != int(element.Len) {
+			return nil, fmt.Errorf("octetArray of length %d does not match the element length %d", len(v), element.Len)
+		}
+		return v, nil
+	}
+	if fullLen := InfoElementLength[element.DataType]; fullLen != VariableLength && element.Len < fullLen {
+		return encodeReducedSizeValue(element.DataType, val, int(element.Len))
+	}
+	return EncodeToIEDataType(element.DataType, val)
+}
+
+// addVariableLengthPrefix prefixes the value with its length as per RFC7011
+// section 7.
+func addVariableLengthPrefix(value []byte) []byte {
+	var encodedBytes []byte
+	if len(value) < 255 {
+		encodedBytes = make([]byte, len(value)+1)
+		encodedBytes[0] = uint8(len(value))
+		copy(encodedBytes[1:], value)
+	} else {
+		encodedBytes = make([]byte, len(value)+3)
+		encodedBytes[0] = byte(255)
+		binary.BigEndian.PutUint16(encodedBytes[1:3], uint16(len(value)))
+		copy(encodedBytes[3:], value)
+	}
+	return encodedBytes
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package entities
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	sourceTransportPort = NewInfoElement("sourceTransportPort", 7, Unsigned16, 0, 2)
+	sourceIPv4Address   = NewInfoElement("sourceIPv4Address", 8, Ipv4Address, 0, 4)
+	interfaceName       = NewInfoElement("interfaceName", 82, String, 0, VariableLength)
+	basicListElement    = NewInfoElement("basicList", 291, BasicList, 0, VariableLength)
+	antreaPort          = NewInfoElement("antreaPort", 1, Unsigned16, 56506, 2)
+	mplsLabelStack      = NewInfoElement("mplsTopLabelStackSection", 70, OctetArray, 0, 3)
+	testTemplates       = map[uint16][]*InfoElement{
+		257: {sourceIPv4Address, interfaceName},
+		258: {sourceTransportPort},
+		259: {sourceIPv4Address, basicListElement},
+		260: {mplsLabelStack, sourceTransportPort},
+	}
+)
+
+func getTestElement(elementID uint16, enterpriseID uint32, length uint16) (*InfoElement, error) {
+	for _, element := range []*InfoElement{sourceTransportPort, sourceIPv4Address, interfaceName, antreaPort, mplsLabelStack} {
+		if element.ElementId == elementID && element.EnterpriseId == enterpriseID {
+			return element, nil
+		}
+	}
+	return nil, fmt.Errorf("element %d with enterprise ID %d is not found", elementID, enterpriseID)
+}
+
+func getTestTemplate(templateID uint16) ([]*InfoElement, error) {
+	if template, exist := testTemplates[templateID]; exist {
+		return template, nil
+	}
+	return nil, fmt.Errorf("template %d is not found", templateID)
+}
+
+func TestStructuredDataTypes(t *testing.T) {
+	tests := []struct {
+		dataType       IEDataType
+		value          interface{}
+		expectedEncode []byte
+	}{
+		{
+			BasicList,
+			&BasicListValue{SemanticAllOf, sourceTransportPort, []interface{}{uint16(80), uint16(443)}},
+			[]byte{0x9, 0x3, 0x0, 0x7, 0x0, 0x2, 0x0, 0x50, 0x1, 0xbb},
+		},
+		{
+			BasicList,
+			&BasicListValue{SemanticOrdered, interfaceName, []interface{}{"eth0", "lo"}},
+			[]byte{0xd, 0x4, 0x0, 0x52, 0xff, 0xff, 0x4, 0x65, 0x74, 0x68, 0x30, 0x2, 0x6c, 0x6f},
+		},
+		{
+			BasicList,
+			&BasicListValue{SemanticNoneOf, antreaPort, []interface{}{uint16(1)}},
+			[]byte{0xb, 0x0, 0x80, 0x1, 0x0, 0x2, 0x0, 0x0, 0xdc, 0xba, 0x0, 0x1},
+		},
+		{
+			// octetArray of fixed length is not prefixed with its length
+			BasicList,
+			&BasicListValue{SemanticAllOf, mplsLabelStack, []interface{}{[]byte{1, 2, 3}, []byte{4, 5, 6}}},
+			[]byte{0xb, 0x3, 0x0, 0x46, 0x0, 0x3, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6},
+		},
+		{
+			SubTemplateList,
+			&SubTemplateListValue{SemanticAllOf, 257, [][]*InfoElementWithValue{
+				{NewInfoElementWithValue(sourceIPv4Address, net.IP{1, 2, 3, 4}), NewInfoElementWithValue(interfaceName, "eth0")},
+				{NewInfoElementWithValue(sourceIPv4Address, net.IP{5, 6, 7, 8}), NewInfoElementWithValue(interfaceName, "lo")},
+			}},
+			[]byte{0x13, 0x3, 0x1, 0x1, 0x1, 0x2, 0x3, 0x4, 0x4, 0x65, 0x74, 0x68, 0x30, 0x5, 0x6, 0x7, 0x8, 0x2, 0x6c, 0x6f},
+		},
+		{
+			// subTemplateList with a basicList in its records
+			SubTemplateList,
+			&SubTemplateListValue{SemanticUndefined, 259, [][]*InfoElementWithValue{
+				{NewInfoElementWithValue(sourceIPv4Address, net.IP{1, 2, 3, 4}), NewInfoElementWithValue(basicListElement, &BasicListValue{SemanticAllOf, sourceTransportPort, []interface{}{uint16(80)}})},
+			}},
+			[]byte{0xf, 0xff, 0x1, 0x3, 0x1, 0x2, 0x3, 0x4, 0x7, 0x3, 0x0, 0x7, 0x0, 0x2, 0x0, 0x50},
+		},
+		{
+			SubTemplateList,
+			&SubTemplateListValue{SemanticAllOf, 260, [][]*InfoElementWithValue{
+				{NewInfoElementWithValue(mplsLabelStack, []byte{1, 2, 3}), NewInfoElementWithValue(sourceTransportPort, uint16(80))},
+			}},
+			[]byte{0x8, 0x3, 0x1, 0x4, 0x1, 0x2, 0x3, 0x0, 0x50},
+		},
+		{
+			SubTemplateMultiList,
+			&SubTemplateMultiListValue{SemanticExactlyOneOf, []SubTemplateMultiListEntry{
+				{257, [][]*InfoElementWithValue{{NewInfoElementWithValue(sourceIPv4Address, net.IP{1, 2, 3, 4}), NewInfoElementWithValue(interfaceName, "lo")}}},
+				{258, [][]*InfoElementWithValue{{NewInfoElementWithValue(sourceTransportPort, uint16(80))}, {NewInfoElementWithValue(sourceTransportPort, uint16(443))}}},
+			}},
+			[]byte{0x14, 0x1, 0x1, 0x1, 0x0, 0xb, 0x1, 0x2, 0x3, 0x4, 0x2, 0x6c, 0x6f, 0x1, 0x2, 0x0, 0x8, 0x0, 0x50, 0x1, 0xbb},
+		},
+		{
+			SubTemplateMultiList,
+			&SubTemplateMultiListValue{SemanticExactlyOneOf, []SubTemplateMultiListEntry{
+				{260, [][]*InfoElementWithValue{{NewInfoElementWithValue(mplsLabelStack, []byte{1, 2, 3}), NewInfoElementWithValue(sourceTransportPort, uint16(80))}}},
+			}},
+			[]byte{0xa, 0x1, 0x1, 0x4, 0x0, 0x9, 0x1, 0x2, 0x3, 0x0, 0x50},
+		},
+	}
+	for _, test := range tests {
+		buff, err := EncodeToIEDataType(test.dataType, test.value)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedEncode, buff)
+		// Decode the value without the variable length prefix.
+		v, err := DecodeStructuredValue(test.dataType, buff[1:], getTestElement, getTestTemplate)
+		assert.NoError(t, err)
+		assert.Equal(t, test.value, v)
+		// Decoded values are kept when added to a data record.
+		v, err = DecodeToIEDataType(test.dataType, v)
+		assert.NoError(t, err)
+		assert.Equal(t, test.value, v)
+	}
+	// octetArray of fixed length must have the length of the element
+	_, err := EncodeToIEDataType(BasicList, &BasicListValue{SemanticAllOf, mplsLabelStack, []interface{}{[]byte{1, 2}}})
+	assert.Error(t, err)
+}
+
+func TestDecodeStructuredValueErrors(t *testing.T) {
+	tests := []struct {
+		dataType IEDataType
+		value    []byte
+	}{
+		// basicList header is too short
+		{BasicList, []byte{0x3, 0x0, 0x7, 0x0}},
+		// basicList element does not exist
+		{BasicList, []byte{0x3, 0x0, 0x9, 0x0, 0x2, 0x0, 0x50}},
+		// basicList element length does not match the registry
+		{BasicList, []byte{0x3, 0x0, 0x7, 0x0, 0x4, 0x0, 0x0, 0x0, 0x50}},
+		// basicList value is truncated
+		{BasicList, []byte{0x3, 0x0, 0x7, 0x0, 0x2, 0x0, 0x50, 0x1}},
+		// subTemplateList template does not exist
+		{SubTemplateList, []byte{0x3, 0x1, 0x5, 0x0, 0x50}},
+		// subTemplateList record is truncated
+		{SubTemplateList, []byte{0x3, 0x1, 0x1, 0x1, 0x2, 0x3, 0x4, 0x4, 0x65}},
+		// subTemplateMultiList data records length exceeds the value
+		{SubTemplateMultiList, []byte{0x1, 0x1, 0x2, 0x0, 0x9, 0x0, 0x50}},
+		{OctetArray, []byte{0x1}},
+	}
+	for _, test := range tests {
+		_, err := DecodeStructuredValue(test.dataType, test.value, getTestElement, getTestTemplate)
+		assert.Error(t, err)
+	}
+}
+
+func TestDataRecordWithStructuredDataType(t *testing.T) {
+	record := NewDataRecord(uniqueTemplateID, 2, false)
+	element := NewInfoElementWithValue(sourceIPv4Address, net.IP{1, 2, 3, 4})
+	assert.NoError(t, record.AddInfoElement(element))
+	list := &BasicListValue{SemanticAllOf, sourceTransportPort, []interface{}{uint16(80), uint16(443)}}
+	element = NewInfoElementWithValue(basicListElement, list)
+	assert.NoError(t, record.AddInfoElement(element))
+	assert.Equal(t, 10, element.Length)
+	assert.Equal(t, 14, record.GetRecordLength())
+	assert.Equal(t, []byte{0x1, 0x2, 0x3, 0x4, 0x9, 0x3, 0x0, 0x7, 0x0, 0x2, 0x0, 0x50, 0x1, 0xbb}, record.GetBuffer())
+	// Value of wrong type
+	element = NewInfoElementWithValue(basicListElement, []uint16{80})
+	assert.Error(t, record.AddInfoElement(element))
+}
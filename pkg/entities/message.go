@@ -16,6 +16,7 @@ package entities
 
 import (
 	"encoding/binary"
+	"sync"
 )
 
 const (
@@ -25,9 +26,24 @@ const (
 	MsgHeaderLength     int = 16
 )
 
-// Message represents IPFIX message.
-// TODO: Currently, it supports only one set. This will be extended to support multiple
-// sets.
+const (
+	// IPFIXVersion is the version in the header of IPFIX messages.
+	IPFIXVersion uint16 = 10
+	// NetFlowV9Version is the version in the header of NetFlow v9 messages,
+	// which can be decoded by the collecting process.
+	NetFlowV9Version uint16 = 9
+	// NetFlowV5Version is the version in the header of NetFlow v5 messages,
+	// which can be decoded by the collecting process.
+	NetFlowV5Version uint16 = 5
+	// SFlowV5Version is the version of messages decoded from sFlow v5
+	// datagrams by the collecting process. sFlow datagrams have a 32-bit
+	// version, so a value that is not used by IPFIX or NetFlow is used instead.
+	SFlowV5Version uint16 = 0x8005
+)
+
+// Message represents IPFIX message, or NetFlow or sFlow message decoded by the
+// collecting process as told by its version. A message carries an ordered list of sets as
+// they appear on the wire.
 type Message struct {
 	msgHeader     []byte
 	version       uint16
@@ -35,15 +51,28 @@ type Message struct {
 	seqNumber     uint32
 	obsDomainID   uint32
 	exportTime    uint32
+	sysUpTime     uint32
 	exportAddress string
+	sessionID     string
 	isDecoding    bool
-	set           Set
+	sets          []Set
+	// packetBuffer is the buffer the message was decoded from, which is put
+	// back to bufferPool when the message is released.
+	packetBuffer *[]byte
+	bufferPool   *sync.Pool
+	released     bool
 }
 
+// NewMessage returns a new message. A message for decoding is taken from the
+// pool of decoded messages, which it is put back to by Release.
 func NewMessage(isDecoding bool) *Message {
+	if isDecoding {
+		return getDecodingMessage()
+	}
 	return &Message{
 		msgHeader:  make([]byte, MsgHeaderLength),
 		isDecoding: isDecoding,
+		sets:       make([]Set, 0),
 	}
 }
 
@@ -102,6 +131,17 @@ func (m *Message) SetExportTime(exportTime uint32) {
 	}
 }
 
+// GetSysUpTime returns the time in milliseconds since the exporter booted, which
+// is only in the header of NetFlow v5, NetFlow v9 and sFlow messages. Relative
+// timestamps in the records, such as flowStartSysUpTime, are based on it.
+func (m *Message) GetSysUpTime() uint32 {
+	return m.sysUpTime
+}
+
+func (m *Message) SetSysUpTime(sysUpTime uint32) {
+	m.sysUpTime = sysUpTime
+}
+
 func (m *Message) GetExportAddress() string {
 	return m.exportAddress
 }
@@ -110,12 +150,44 @@ func (m *Message) SetExportAddress(ipAddr string) {
 	m.exportAddress = ipAddr
 }
 
+// GetSessionID returns the identity of the transport session in which the
+// message was received, which is the address and port of the exporter.
+// Templates are scoped to the session and the observation domain.
+func (m *Message) GetSessionID() string {
+	return m.sessionID
+}
+
+func (m *Message) SetSessionID(sessionID string) {
+	m.sessionID = sessionID
+}
+
+// GetSet returns the first set in the message, or nil if the message does not
+// have any set. Use GetSets to access all the sets in the message.
 func (m *Message) GetSet() Set {
-	return m.set
+	if len(m.sets) == 0 {
+		return nil
+	}
+	return m.sets[0]
+}
+
+// GetSets returns all the sets in the message in the order they were added.
+func (m *Message) GetSets() []Set {
+	return m.sets
 }
 
+// AddSet appends the set to the list of sets in the message.
 func (m *Message) AddSet(set Set) {
-	m.set = set
+	m.sets = append(m.sets, set)
+}
+
+// GetNumberOfRecords returns the total number of records across all the sets
+// in the message.
+func (m *Message) GetNumberOfRecords() uint32 {
+	var numRecords uint32
+	for _, set := range m.sets {
+		numRecords += set.GetNumberOfRecords()
+	}
+	return numRecords
 }
 
 func (m *Message) GetMsgHeader() []byte {
@@ -126,3 +198,47 @@ func (m *Message) ResetMsgHeader() {
 	m.msgHeader = nil
 	m.msgHeader = make([]byte, MsgHeaderLength)
 }
+
+// SetPacketBuffer sets the buffer of the packet the message was decoded from,
+// which is put back to the pool when the message is released. Values of the
+// decoded elements may refer to the buffer.
+func (m *Message) SetPacketBuffer(buffer *[]byte, pool *sync.Pool) {
+	m.packetBuffer = buffer
+	m.bufferPool = pool
+}
+
+// Release puts a decoded message back to the pools of the collecting process,
+// together with its sets, data records and the buffer of its packet, so that
+// they are reused for the next messages. Releasing messages is optional, as
+// messages which are not released are garbage collected. Release must only be
+// called once the message is not needed anymore: the message, its sets, its
+// records and their elements must not be used after Release, as they are
+// overwritten when they are reused. Release does nothing for messages created
+// for encoding, and for messages which are already released.
+func (m *Message) Release() {
+	if !m.isDecoding || m.released {
+		return
+	}
+	m.released = true
+	for i, s := range m.sets {
+		if decodingSet, ok := s.(*set); ok && decodingSet.isDecoding {
+			decodingSet.release()
+		}
+		m.sets[i] = nil
+	}
+	m.sets = m.sets[:0]
+	if m.bufferPool != nil {
+		m.bufferPool.Put(m.packetBuffer)
+	}
+	m.packetBuffer = nil
+	m.bufferPool = nil
+	m.version = 0
+	m.length = 0
+	m.seqNumber = 0
+	m.obsDomainID = 0
+	m.exportTime = 0
+	m.sysUpTime = 0
+	m.exportAddress = ""
+	m.sessionID = ""
+	messagePool.Put(m)
+}
@@ -16,6 +16,8 @@ package entities
 
 import (
 	"encoding/binary"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -46,8 +48,51 @@ func TestMessage_SetAndGetFunctions(t *testing.T) {
 	assert.Equal(t, binary.BigEndian.Uint32(message.GetMsgHeader()[4:8]), currTimeInUnixSecs)
 	message.SetExportAddress("127.0.0.1")
 	assert.Equal(t, message.GetExportAddress(), "127.0.0.1")
+	message.SetSessionID("127.0.0.1:4739")
+	assert.Equal(t, message.GetSessionID(), "127.0.0.1:4739")
 	message.AddSet(newSet)
 	assert.Equal(t, message.GetSet(), newSet)
+	anotherSet := NewSet(false)
+	anotherSet.PrepareSet(Template, testTemplateID)
+	message.AddSet(anotherSet)
+	assert.Equal(t, []Set{newSet, anotherSet}, message.GetSets())
+	assert.Equal(t, message.GetSet(), newSet)
 	message.ResetMsgHeader()
 	assert.Equal(t, len(message.GetMsgHeader()), MsgHeaderLength)
 }
+
+func TestMessage_Release(t *testing.T) {
+	var bufferPool sync.Pool
+	packetBuffer := []byte{10, 0, 0, 1, 0, 0, 0, 100}
+	element := NewInfoElementWithValue(NewInfoElement("sourceIPv4Address", 8, Ipv4Address, 0, 4), packetBuffer[0:4])
+	dataSet := NewSet(true)
+	dataSet.PrepareSet(Data, testTemplateID)
+	err := dataSet.AddRecord([]*InfoElementWithValue{element}, testTemplateID)
+	assert.NoError(t, err)
+	// Data records for decoding keep a copy of the elements, so that the
+	// elements can be reused for the next record.
+	element.Value = packetBuffer[4:8]
+	record := dataSet.GetRecords()[0].(*dataRecord)
+	assert.Equal(t, net.IP(packetBuffer[0:4]), record.GetOrderedElementList()[0].Value)
+
+	message := NewMessage(true)
+	message.SetSessionID("127.0.0.1:4739")
+	message.AddSet(dataSet)
+	message.SetPacketBuffer(&packetBuffer, &bufferPool)
+	message.Release()
+	assert.Empty(t, message.GetSets())
+	assert.Empty(t, message.GetSessionID())
+	assert.Nil(t, message.packetBuffer)
+	assert.Empty(t, record.GetOrderedElementList())
+	assert.Equal(t, uint16(0), record.GetFieldCount())
+	// Releasing the message again does nothing.
+	message.Release()
+
+	// Messages for encoding are not released.
+	encodingSet := NewSet(false)
+	encodingSet.PrepareSet(Data, testTemplateID)
+	encodingMessage := NewMessage(false)
+	encodingMessage.AddSet(encodingSet)
+	encodingMessage.Release()
+	assert.Equal(t, []Set{encodingSet}, encodingMessage.GetSets())
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 VMware, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package entities
+
+import (
+	"sync"
+)
+
+// Pools of the messages, sets and data records created for decoding. They are
+// put back to the pools by Message.Release, so that the collecting process
+// reuses them for the next messages instead of allocating new ones.
+var (
+	messagePool        sync.Pool
+	setPool            sync.Pool
+	dataRecordPool     sync.Pool
+	lazyDataRecordPool sync.Pool
+)
+
+func getDecodingMessage() *Message {
+	if m, ok := messagePool.Get().(*Message); ok {
+		m.released = false
+		return m
+	}
+	return &Message{
+		msgHeader:  make([]byte, MsgHeaderLength),
+		isDecoding: true,
+		sets:       make([]Set, 0),
+	}
+}
+
+func getDecodingSet() *set {
+	if s, ok := setPool.Get().(*set); ok {
+		return s
+	}
+	return &set{
+		records:    make([]Record, 0),
+		isDecoding: true,
+	}
+}
+
+// getDecodingDataRecord returns a data record for decoding with room for the
+// given number of elements, so that adding them does not allocate.
+func getDecodingDataRecord(id uint16, numElements int) *dataRecord {
+	d, ok := dataRecordPool.Get().(*dataRecord)
+	if !ok {
+		d = &dataRecord{baseRecord: baseRecord{isDecoding: true}}
+	}
+	d.templateID = id
+	if cap(d.orderedElementList) < numElements || cap(d.elements) < numElements {
+		d.orderedElementList = make([]*InfoElementWithValue, numElements)
+		d.elements = make([]InfoElementWithValue, 0, numElements)
+	} else {
+		d.orderedElementList = d.orderedElementList[:numElements]
+	}
+	return d
+}
+
+// release puts the decoded set and its data records back to the pools.
+func (s *set) release() {
+	for i, record := range s.records {
+		switch r := record.(type) {
+		case *dataRecord:
+			if r.isDecoding {
+				r.release()
+			}
+		case *lazyDataRecord:
+			r.release()
+		}
+		s.records[i] = nil
+	}
+	s.records = s.records[:0]
+	s.setType = Undefined
+	setPool.Put(s)
+}
+
+// release clears the decoded data record, so that it does not keep the values
+// of its elements alive, and puts it back to the pool.
+func (d *dataRecord) release() {
+	for i := range d.elements {
+		d.elements[i] = InfoElementWithValue{}
+	}
+	for i := range d.orderedElementList {
+		d.orderedElementList[i] = nil
+	}
+	d.elements = d.elements[:0]
+	d.orderedElementList = d.orderedElementList[:0]
+	d.fieldCount = 0
+	d.scopeFieldCount = 0
+	d.templateID = 0
+	dataRecordPool.Put(d)
+}
+
+func getLazyDataRecord() *lazyDataRecord {
+	if r, ok := lazyDataRecordPool.Get().(*lazyDataRecord); ok {
+		return r
+	}
+	return &lazyDataRecord{}
+}
+
+// release clears the lazily decoded data record, so that it does not keep the
+// packet buffer alive, and puts it back to the pool.
+func (r *lazyDataRecord) release() {
+	for i := range r.elements {
+		r.elements[i] = InfoElementWithValue{}
+	}
+	r.elements = r.elements[:0]
+	r.offsets = r.offsets[:0]
+	r.buffer = nil
+	r.template = nil
+	r.orderedElementList = nil
+	r.templateID = 0
+	r.scopeFieldCount = 0
+	lazyDataRecordPool.Put(r)
+}
@@ -36,15 +36,31 @@ type Record interface {
 	GetBuffer() []byte
 	GetTemplateID() uint16
 	GetFieldCount() uint16
+	// GetScopeFieldCount returns the number of scope fields for options template
+	// records and data records of options templates. Scope fields are always the
+	// first elements of the record. It is 0 for other records.
+	GetScopeFieldCount() uint16
 	GetOrderedElementList() []*InfoElementWithValue
 	GetInfoElementWithValue(name string) (*InfoElementWithValue, bool)
 	GetRecordLength() int
 	GetMinDataRecordLen() uint16
 }
 
+// LazyRecord is a data record decoded lazily by the collecting process. It
+// keeps the raw bytes of the record with the offsets of its fields from the
+// template, and decodes a field only when it is requested. Decoded fields are
+// cached in the record, so a lazy record is not safe for concurrent use.
+type LazyRecord interface {
+	Record
+	// GetRawValue returns the raw bytes of the field with the given name without
+	// decoding it. Fields of variable length do not include the length prefix.
+	GetRawValue(name string) ([]byte, bool)
+}
+
 type baseRecord struct {
 	buffer             []byte
 	fieldCount         uint16
+	scopeFieldCount    uint16
 	templateID         uint16
 	orderedElementList []*InfoElementWithValue
 	isDecoding         bool
@@ -54,9 +70,18 @@ type baseRecord struct {
 
 type dataRecord struct {
 	baseRecord
+	// elements has a copy of the elements added to a data record for decoding,
+	// which are reused with the record once the message is released.
+	elements []InfoElementWithValue
 }
 
+// NewDataRecord returns a data record with room for the given number of
+// elements. A data record for decoding is taken from the pool of decoded data
+// records, which it is put back to by Message.Release.
 func NewDataRecord(id uint16, numElements int, isDecoding bool) *dataRecord {
+	if isDecoding {
+		return getDecodingDataRecord(id, numElements)
+	}
 	return &dataRecord{
 		baseRecord{
 			fieldCount:         0,
@@ -64,6 +89,7 @@ func NewDataRecord(id uint16, numElements int, isDecoding bool) *dataRecord {
 			isDecoding:         isDecoding,
 			orderedElementList: make([]*InfoElementWithValue, numElements),
 		},
+		nil,
 	}
 }
 
@@ -79,7 +105,7 @@ type templateRecord struct {
 func NewTemplateRecord(id uint16, numElements int, isDecoding bool) *templateRecord {
 	return &templateRecord{
 		baseRecord{
-			buffer:             make([]byte, 4),
+			buffer:             make([]byte, TemplateRecordHeaderLen),
 			fieldCount:         uint16(numElements),
 			templateID:         id,
 			isDecoding:         isDecoding,
@@ -90,6 +116,27 @@ func NewTemplateRecord(id uint16, numElements int, isDecoding bool) *templateRec
 	}
 }
 
+type optionsTemplateRecord struct {
+	templateRecord
+}
+
+func NewOptionsTemplateRecord(id uint16, numElements int, scopeFieldCount uint16, isDecoding bool) *optionsTemplateRecord {
+	return &optionsTemplateRecord{
+		templateRecord{
+			baseRecord{
+				buffer:             make([]byte, OptionsTemplateRecordHeaderLen),
+				fieldCount:         uint16(numElements),
+				scopeFieldCount:    scopeFieldCount,
+				templateID:         id,
+				isDecoding:         isDecoding,
+				orderedElementList: make([]*InfoElementWithValue, numElements),
+			},
+			0,
+			0,
+		},
+	}
+}
+
 func (b *baseRecord) GetTemplateID() uint16 {
 	return b.templateID
 }
@@ -98,6 +145,10 @@ func (b *baseRecord) GetFieldCount() uint16 {
 	return b.fieldCount
 }
 
+func (b *baseRecord) GetScopeFieldCount() uint16 {
+	return b.scopeFieldCount
+}
+
 func (b *baseRecord) GetOrderedElementList() []*InfoElementWithValue {
 	return b.orderedElementList
 }
@@ -140,13 +191,22 @@ func (d *dataRecord) AddInfoElement(element *InfoElementWithValue) error {
 	var value interface{}
 	var err error
 	if d.isDecoding {
-		value, err = DecodeToIEDataType(element.Element.DataType, element.Value)
-		if err != nil {
-			return err
+		// Values which are not raw bytes are already decoded, e.g. by
+		// DecodeBytesToIEDataType, so that they are not boxed twice.
+		if _, isRaw := element.Value.([]byte); isRaw {
+			value, err = DecodeToIEDataType(element.Element.DataType, element.Value)
+			if err != nil {
+				return err
+			}
+			element.Value = value
 		}
-		element.Value = value
+		// The record keeps a copy of the element, so that the caller can reuse
+		// the element for the next record.
+		element = d.copyElement(element)
 	} else {
-		setInfoElementLen(element)
+		if err = setInfoElementLen(element); err != nil {
+			return err
+		}
 		d.len += element.Length
 	}
 	if len(d.orderedElementList) <= int(d.fieldCount) {
@@ -158,6 +218,17 @@ func (d *dataRecord) AddInfoElement(element *InfoElementWithValue) error {
 	return nil
 }
 
+// copyElement copies the element to the elements of the data record, unless
+// there is no room left for it.
+func (d *dataRecord) copyElement(element *InfoElementWithValue) *InfoElementWithValue {
+	if len(d.elements) == cap(d.elements) {
+		elementCopy := *element
+		return &elementCopy
+	}
+	d.elements = append(d.elements, *element)
+	return &d.elements[len(d.elements)-1]
+}
+
 func (t *templateRecord) PrepareRecord() error {
 	// Add Template Record Header
 	binary.BigEndian.PutUint16(t.buffer[0:2], t.templateID)
@@ -165,6 +236,14 @@ func (t *templateRecord) PrepareRecord() error {
 	return nil
 }
 
+func (o *optionsTemplateRecord) PrepareRecord() error {
+	// Add Options Template Record Header
+	binary.BigEndian.PutUint16(o.buffer[0:2], o.templateID)
+	binary.BigEndian.PutUint16(o.buffer[2:4], o.fieldCount)
+	binary.BigEndian.PutUint16(o.buffer[4:6], o.scopeFieldCount)
+	return nil
+}
+
 func (t *templateRecord) AddInfoElement(element *InfoElementWithValue) error {
 	// val could be used to specify smaller length than default? For now assert it to be nil
 	if element.Value != nil {
@@ -205,3 +284,135 @@ func (t *templateRecord) GetRecordLength() int {
 func (t *templateRecord) GetMinDataRecordLen() uint16 {
 	return t.minDataRecLength
 }
+
+// lazyDataRecord is a data record which is decoded lazily.
+type lazyDataRecord struct {
+	// buffer has the raw bytes of the record, which refer to the buffer of the
+	// packet the record is decoded from.
+	buffer          []byte
+	templateID      uint16
+	scopeFieldCount uint16
+	template        []*InfoElement
+	// offsets are the start and end offsets of the value of each field in
+	// the buffer.
+	offsets []fieldOffset
+	// elements are the decoded fields, whose Element is nil until the field
+	// is decoded.
+	elements []InfoElementWithValue
+	// orderedElementList is set once all the fields are decoded.
+	orderedElementList []*InfoElementWithValue
+}
+
+type fieldOffset struct {
+	start int
+	end   int
+}
+
+// initLazyDataRecord reads the offsets of the fields of the template in the
+// data record at the beginning of the buffer, and returns the length of the
+// record.
+func (r *lazyDataRecord) initLazyDataRecord(buffer []byte, template []*InfoElement, scopeFieldCount uint16, templateID uint16) (int, error) {
+	if int(scopeFieldCount) > len(template) {
+		return 0, fmt.Errorf("scope field count %d is more than the number of elements %d", scopeFieldCount, len(template))
+	}
+	r.templateID = templateID
+	r.scopeFieldCount = scopeFieldCount
+	r.template = template
+	offset := 0
+	for _, element := range template {
+		field, next, err := readField(buffer, offset, element.Len)
+		if err != nil {
+			return 0, fmt.Errorf("data record of template %d is shorter than the length of element %s: %v", templateID, element.Name, err)
+		}
+		r.offsets = append(r.offsets, fieldOffset{next - len(field), next})
+		offset = next
+	}
+	r.buffer = buffer[:offset]
+	if cap(r.elements) < len(template) {
+		r.elements = make([]InfoElementWithValue, len(template))
+	} else {
+		r.elements = r.elements[:len(template)]
+	}
+	return offset, nil
+}
+
+func (r *lazyDataRecord) PrepareRecord() error {
+	return nil
+}
+
+func (r *lazyDataRecord) AddInfoElement(element *InfoElementWithValue) error {
+	return fmt.Errorf("cannot add element %s to a lazily decoded data record", element.Element.Name)
+}
+
+// GetBuffer returns the raw bytes of the record.
+func (r *lazyDataRecord) GetBuffer() []byte {
+	return r.buffer
+}
+
+func (r *lazyDataRecord) GetTemplateID() uint16 {
+	return r.templateID
+}
+
+func (r *lazyDataRecord) GetFieldCount() uint16 {
+	return uint16(len(r.template))
+}
+
+func (r *lazyDataRecord) GetScopeFieldCount() uint16 {
+	return r.scopeFieldCount
+}
+
+// GetOrderedElementList decodes all the fields of the record which are not
+// decoded yet.
+func (r *lazyDataRecord) GetOrderedElementList() []*InfoElementWithValue {
+	if r.orderedElementList == nil && len(r.template) > 0 {
+		r.orderedElementList = make([]*InfoElementWithValue, len(r.template))
+		for i := range r.template {
+			r.orderedElementList[i] = r.getElement(i)
+		}
+	}
+	return r.orderedElementList
+}
+
+// GetInfoElementWithValue decodes the field with the given name only.
+func (r *lazyDataRecord) GetInfoElementWithValue(name string) (*InfoElementWithValue, bool) {
+	for i, element := range r.template {
+		if element.Name == name {
+			return r.getElement(i), true
+		}
+	}
+	return nil, false
+}
+
+func (r *lazyDataRecord) GetRawValue(name string) ([]byte, bool) {
+	for i, element := range r.template {
+		if element.Name == name {
+			return r.buffer[r.offsets[i].start:r.offsets[i].end], true
+		}
+	}
+	return nil, false
+}
+
+func (r *lazyDataRecord) GetRecordLength() int {
+	return len(r.buffer)
+}
+
+func (r *lazyDataRecord) GetMinDataRecordLen() uint16 {
+	return 0
+}
+
+// getElement returns the field at the index, and decodes it if it is not
+// decoded yet. The value of a field which cannot be decoded is its raw bytes.
+func (r *lazyDataRecord) getElement(i int) *InfoElementWithValue {
+	element := &r.elements[i]
+	if element.Element == nil {
+		value := r.buffer[r.offsets[i].start:r.offsets[i].end]
+		decodedValue, err := DecodeToIEDataType(r.template[i].DataType, value)
+		if err != nil {
+			klog.Errorf("Error in decoding element %s of data record of template %d: %v", r.template[i].Name, r.templateID, err)
+			decodedValue = value
+		}
+		element.Element = r.template[i]
+		element.Value = decodedValue
+	}
+	return element
+}
@@ -113,6 +113,38 @@ func TestAddInfoElements(t *testing.T) {
 	}
 }
 
+func TestAddOctetArrayElements(t *testing.T) {
+	fixedElement := NewInfoElement("ipHeaderPacketSection", 313, OctetArray, 0, 2)
+	variableElement := NewInfoElement("dataLinkFrameSection", 315, OctetArray, 0, VariableLength)
+	longValue := make([]byte, 256)
+	record := NewDataRecord(uniqueTemplateID, 3, false)
+	assert.NoError(t, record.AddInfoElement(NewInfoElementWithValue(fixedElement, []byte{0x45, 0x0})))
+	assert.NoError(t, record.AddInfoElement(NewInfoElementWithValue(variableElement, []byte{0x1})))
+	assert.NoError(t, record.AddInfoElement(NewInfoElementWithValue(variableElement, longValue)))
+	assert.Equal(t, 2+2+259, record.GetRecordLength())
+	buff := record.GetBuffer()
+	assert.Equal(t, []byte{0x45, 0x0, 0x1, 0x1, 0xff, 0x1, 0x0}, buff[:7])
+	assert.Equal(t, longValue, buff[7:])
+	// Value of fixed length element should have the same length.
+	err := record.AddInfoElement(NewInfoElementWithValue(fixedElement, []byte{0x45}))
+	assert.Error(t, err)
+}
+
+func TestAddDecodedInfoElements(t *testing.T) {
+	portElement := NewInfoElement("sourceTransportPort", 7, Unsigned16, 0, 2)
+	ipElement := NewInfoElement("sourceIPv4Address", 8, Ipv4Address, 0, 4)
+	record := NewDataRecord(uniqueTemplateID, 2, true)
+	// Raw bytes are decoded, and values which are already decoded are kept.
+	assert.NoError(t, record.AddInfoElement(NewInfoElementWithValue(portElement, []byte{0x1, 0xbb})))
+	assert.NoError(t, record.AddInfoElement(NewInfoElementWithValue(ipElement, net.IP{0x1, 0x2, 0x3, 0x4})))
+	element, _ := record.GetInfoElementWithValue("sourceTransportPort")
+	assert.Equal(t, uint16(443), element.Value)
+	element, _ = record.GetInfoElementWithValue("sourceIPv4Address")
+	assert.Equal(t, net.IP{0x1, 0x2, 0x3, 0x4}, element.Value)
+	// Raw bytes of the wrong length are not decoded.
+	assert.Error(t, record.AddInfoElement(NewInfoElementWithValue(ipElement, []byte{0x1, 0x2, 0x3, 0x4, 0x5})))
+}
+
 func TestGetInfoElementWithValue(t *testing.T) {
 	templateRec := NewTemplateRecord(256, 1, true)
 	templateRec.orderedElementList = make([]*InfoElementWithValue, 0)
@@ -28,7 +28,15 @@ const (
 	TemplateTTL = TemplateRefreshTimeOut * 3
 	// TemplateSetID is the setID for template record
 	TemplateSetID uint16 = 2
-	SetHeaderLen  int    = 4
+	// OptionsTemplateSetID is the setID for options template record
+	OptionsTemplateSetID uint16 = 3
+	SetHeaderLen         int    = 4
+	// TemplateRecordHeaderLen is the length of template ID and field count in
+	// a template record
+	TemplateRecordHeaderLen int = 4
+	// OptionsTemplateRecordHeaderLen is the length of template ID, field count
+	// and scope field count in an options template record
+	OptionsTemplateRecordHeaderLen int = 6
 )
 
 type ContentType uint8
@@ -36,7 +44,7 @@ type ContentType uint8
 const (
 	Template ContentType = iota
 	Data
-	// Add OptionsTemplate too when it is supported
+	OptionsTemplate
 	Undefined = 255
 )
 
@@ -48,6 +56,9 @@ type Set interface {
 	GetSetType() ContentType
 	UpdateLenInHeader()
 	AddRecord(elements []*InfoElementWithValue, templateID uint16) error
+	// AddRecordWithScope adds an options template record, or a data record of
+	// an options template. The first scopeFieldCount elements are scope fields.
+	AddRecordWithScope(elements []*InfoElementWithValue, scopeFieldCount uint16, templateID uint16) error
 	GetRecords() []Record
 	GetNumberOfRecords() uint32
 }
@@ -60,12 +71,11 @@ type set struct {
 	length       int
 }
 
+// NewSet returns a new set. A set for decoding is taken from the pool of
+// decoded sets, which it is put back to by Message.Release.
 func NewSet(isDecoding bool) Set {
 	if isDecoding {
-		return &set{
-			records:    make([]Record, 0),
-			isDecoding: isDecoding,
-		}
+		return getDecodingSet()
 	} else {
 		return &set{
 			headerBuffer: make([]byte, SetHeaderLen),
@@ -121,15 +131,45 @@ func (s *set) UpdateLenInHeader() {
 }
 
 func (s *set) AddRecord(elements []*InfoElementWithValue, templateID uint16) error {
+	return s.AddRecordWithScope(elements, 0, templateID)
+}
+
+func (s *set) AddRecordWithScope(elements []*InfoElementWithValue, scopeFieldCount uint16, templateID uint16) error {
+	if int(scopeFieldCount) > len(elements) {
+		return fmt.Errorf("scope field count %d is more than the number of elements %d", scopeFieldCount, len(elements))
+	}
 	var record Record
 	if s.setType == Data {
-		record = NewDataRecord(templateID, len(elements), s.isDecoding)
+		dataRecord := NewDataRecord(templateID, len(elements), s.isDecoding)
+		dataRecord.scopeFieldCount = scopeFieldCount
+		record = dataRecord
 	} else if s.setType == Template {
+		if scopeFieldCount != 0 {
+			return fmt.Errorf("template record cannot have scope fields")
+		}
 		record = NewTemplateRecord(templateID, len(elements), s.isDecoding)
 		err := record.PrepareRecord()
 		if err != nil {
 			return err
 		}
+	} else if s.setType == OptionsTemplate && len(elements) == 0 {
+		// An options template withdrawal record has no scope field count as per
+		// RFC7011 section 8.1, so it is encoded as a template record.
+		record = NewTemplateRecord(templateID, 0, s.isDecoding)
+		err := record.PrepareRecord()
+		if err != nil {
+			return err
+		}
+	} else if s.setType == OptionsTemplate {
+		// Scope field count must not be zero as per RFC7011 section 3.4.2.2.
+		if scopeFieldCount == 0 {
+			return fmt.Errorf("options template record should have at least one scope field")
+		}
+		record = NewOptionsTemplateRecord(templateID, len(elements), scopeFieldCount, s.isDecoding)
+		err := record.PrepareRecord()
+		if err != nil {
+			return err
+		}
 	} else {
 		return fmt.Errorf("set type is not supported")
 	}
@@ -145,6 +185,26 @@ func (s *set) AddRecord(elements []*InfoElementWithValue, templateID uint16) err
 	return nil
 }
 
+// AddLazyRecord adds the data record of the template at the beginning of the
+// buffer to a data set for decoding, and returns the length of the record. The
+// record is a LazyRecord, which keeps the raw bytes of the record and decodes
+// its fields when they are requested. It is not part of the Set interface, so
+// that other implementations of Set do not need it; the collector reaches it
+// through the sets returned by NewSet.
+func (s *set) AddLazyRecord(buffer []byte, template []*InfoElement, scopeFieldCount uint16, templateID uint16) (int, error) {
+	if !s.isDecoding || s.setType != Data {
+		return 0, fmt.Errorf("lazy records can only be added to data sets for decoding")
+	}
+	record := getLazyDataRecord()
+	recordLen, err := record.initLazyDataRecord(buffer, template, scopeFieldCount, templateID)
+	if err != nil {
+		record.release()
+		return 0, err
+	}
+	s.records = append(s.records, record)
+	return recordLen, nil
+}
+
 func (s *set) GetRecords() []Record {
 	return s.records
 }
@@ -156,6 +216,8 @@ func (s *set) GetNumberOfRecords() uint32 {
 func (s *set) createHeader(setType ContentType, templateID uint16) {
 	if setType == Template {
 		binary.BigEndian.PutUint16(s.headerBuffer[0:2], TemplateSetID)
+	} else if setType == OptionsTemplate {
+		binary.BigEndian.PutUint16(s.headerBuffer[0:2], OptionsTemplateSetID)
 	} else if setType == Data {
 		binary.BigEndian.PutUint16(s.headerBuffer[0:2], templateID)
 	}
@@ -128,3 +128,102 @@ func TestSet_UpdateLenInHeader(t *testing.T) {
 	// Check the bytes in the header for set length
 	assert.Equal(t, uint16(setForEncoding.GetSetLength()), binary.BigEndian.Uint16(setForEncoding.GetHeaderBuffer()[2:4]))
 }
+
+func TestAddRecordWithScope(t *testing.T) {
+	elements := make([]*InfoElementWithValue, 0)
+	ie1 := NewInfoElementWithValue(NewInfoElement("observationDomainId", 149, 3, 0, 4), nil)
+	ie2 := NewInfoElementWithValue(NewInfoElement("samplingInterval", 34, 3, 0, 4), nil)
+	elements = append(elements, ie1, ie2)
+	encodingSet := NewSet(false)
+	err := encodingSet.PrepareSet(OptionsTemplate, testTemplateID)
+	assert.NoError(t, err)
+	assert.Equal(t, OptionsTemplateSetID, binary.BigEndian.Uint16(encodingSet.GetHeaderBuffer()[0:2]))
+	// Options template record needs at least one scope field.
+	err = encodingSet.AddRecord(elements, testTemplateID)
+	assert.Error(t, err)
+	err = encodingSet.AddRecordWithScope(elements, 3, testTemplateID)
+	assert.Error(t, err)
+	err = encodingSet.AddRecordWithScope(elements, 1, testTemplateID)
+	assert.NoError(t, err)
+	record := encodingSet.GetRecords()[0]
+	assert.Equal(t, uint16(1), record.GetScopeFieldCount())
+	assert.Equal(t, []byte{0x1, 0x0, 0x0, 0x2, 0x0, 0x1, 0x0, 0x95, 0x0, 0x4, 0x0, 0x22, 0x0, 0x4}, record.GetBuffer())
+	assert.Equal(t, uint16(8), record.GetMinDataRecordLen())
+	assert.Equal(t, SetHeaderLen+14, encodingSet.GetSetLength())
+	// Options template withdrawal record has no scope field count.
+	err = encodingSet.AddRecordWithScope(nil, 0, testTemplateID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1, 0x0, 0x0, 0x0}, encodingSet.GetRecords()[1].GetBuffer())
+	assert.Equal(t, SetHeaderLen+18, encodingSet.GetSetLength())
+	// Template record cannot have scope fields.
+	encodingSet.ResetSet()
+	err = encodingSet.PrepareSet(Template, testTemplateID)
+	assert.NoError(t, err)
+	err = encodingSet.AddRecordWithScope(elements, 1, testTemplateID)
+	assert.Error(t, err)
+	// Data record of options template keeps the scope field count.
+	decodingSet := NewSet(true)
+	err = decodingSet.PrepareSet(Data, testTemplateID)
+	assert.NoError(t, err)
+	elements = []*InfoElementWithValue{
+		NewInfoElementWithValue(NewInfoElement("observationDomainId", 149, 3, 0, 4), []byte{0x0, 0x0, 0x0, 0x1}),
+		NewInfoElementWithValue(NewInfoElement("samplingInterval", 34, 3, 0, 4), []byte{0x0, 0x0, 0x0, 0x64}),
+	}
+	err = decodingSet.AddRecordWithScope(elements, 1, testTemplateID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), decodingSet.GetRecords()[0].GetScopeFieldCount())
+}
+
+func TestAddLazyRecord(t *testing.T) {
+	template := []*InfoElement{
+		NewInfoElement("sourceIPv4Address", 8, Ipv4Address, 0, 4),
+		NewInfoElement("destinationTransportPort", 11, Unsigned16, 0, 2),
+		NewInfoElement("interfaceName", 82, String, 0, VariableLength),
+	}
+	record := []byte{10, 0, 0, 1, 0, 80, 4, 112, 111, 100, 49}
+	// the buffer has the next record after the first one
+	buffer := append(append([]byte{}, record...), 10, 0, 0, 2)
+	decodingSet := NewSet(true).(*set)
+	err := decodingSet.PrepareSet(Data, testTemplateID)
+	assert.NoError(t, err)
+	recordLen, err := decodingSet.AddLazyRecord(buffer, template, 0, testTemplateID)
+	assert.NoError(t, err)
+	assert.Equal(t, len(record), recordLen)
+	lazyRecord, ok := decodingSet.GetRecords()[0].(LazyRecord)
+	assert.True(t, ok)
+	assert.Equal(t, testTemplateID, lazyRecord.GetTemplateID())
+	assert.Equal(t, uint16(3), lazyRecord.GetFieldCount())
+	assert.Equal(t, record, lazyRecord.GetBuffer())
+
+	rawValue, exist := lazyRecord.GetRawValue("interfaceName")
+	assert.True(t, exist)
+	assert.Equal(t, []byte("pod1"), rawValue)
+	element, exist := lazyRecord.GetInfoElementWithValue("destinationTransportPort")
+	assert.True(t, exist)
+	assert.Equal(t, uint16(80), element.Value)
+	// Only the requested field is decoded.
+	elements := lazyRecord.(*lazyDataRecord).elements
+	assert.Nil(t, elements[0].Element)
+	assert.Nil(t, elements[2].Element)
+	_, exist = lazyRecord.GetInfoElementWithValue("sourceIPv6Address")
+	assert.False(t, exist)
+
+	orderedElements := lazyRecord.GetOrderedElementList()
+	assert.Len(t, orderedElements, 3)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, orderedElements[0].Value)
+	assert.Equal(t, element, orderedElements[1])
+	assert.Equal(t, "pod1", orderedElements[2].Value)
+	assert.Error(t, lazyRecord.AddInfoElement(NewInfoElementWithValue(template[0], nil)))
+
+	// The record is shorter than the template.
+	_, err = decodingSet.AddLazyRecord(record[:8], template, 0, testTemplateID)
+	assert.Error(t, err)
+	_, err = decodingSet.AddLazyRecord(record, template, 4, testTemplateID)
+	assert.Error(t, err)
+	assert.Equal(t, uint32(1), decodingSet.GetNumberOfRecords())
+	// Lazy records are only added to data sets for decoding.
+	encodingSet := NewSet(false).(*set)
+	encodingSet.PrepareSet(Data, testTemplateID)
+	_, err = encodingSet.AddLazyRecord(record, template, 0, testTemplateID)
+	assert.Error(t, err)
+}
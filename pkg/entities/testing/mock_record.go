@@ -146,6 +146,20 @@ func (mr *MockRecordMockRecorder) GetRecordLength() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRecordLength", reflect.TypeOf((*MockRecord)(nil).GetRecordLength))
 }
 
+// GetScopeFieldCount mocks base method
+func (m *MockRecord) GetScopeFieldCount() uint16 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetScopeFieldCount")
+	ret0, _ := ret[0].(uint16)
+	return ret0
+}
+
+// GetScopeFieldCount indicates an expected call of GetScopeFieldCount
+func (mr *MockRecordMockRecorder) GetScopeFieldCount() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetScopeFieldCount", reflect.TypeOf((*MockRecord)(nil).GetScopeFieldCount))
+}
+
 // GetTemplateID mocks base method
 func (m *MockRecord) GetTemplateID() uint16 {
 	m.ctrl.T.Helper()
@@ -61,6 +61,20 @@ func (mr *MockSetMockRecorder) AddRecord(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddRecord", reflect.TypeOf((*MockSet)(nil).AddRecord), arg0, arg1)
 }
 
+// AddRecordWithScope mocks base method
+func (m *MockSet) AddRecordWithScope(arg0 []*entities.InfoElementWithValue, arg1, arg2 uint16) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddRecordWithScope", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddRecordWithScope indicates an expected call of AddRecordWithScope
+func (mr *MockSetMockRecorder) AddRecordWithScope(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddRecordWithScope", reflect.TypeOf((*MockSet)(nil).AddRecordWithScope), arg0, arg1, arg2)
+}
+
 // GetHeaderBuffer mocks base method
 func (m *MockSet) GetHeaderBuffer() []byte {
 	m.ctrl.T.Helper()
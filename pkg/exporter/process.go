@@ -15,6 +15,7 @@
 package exporter
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -33,6 +34,12 @@ const startTemplateID uint16 = 255
 type templateValue struct {
 	elements      []*entities.InfoElement
 	minDataRecLen uint16
+	// scopeFieldCount is the number of scope fields for options templates,
+	// and 0 for templates.
+	scopeFieldCount uint16
+	// hasReducedSizeElements indicates whether the template has elements with
+	// reduced-size encoding, whose data records are encoded again.
+	hasReducedSizeElements bool
 }
 
 // 1. Tested one exportingProcess process per exporter. Can support multiple collector scenario by
@@ -48,8 +55,18 @@ type ExportingProcess struct {
 	templateID      uint16
 	pathMTU         int
 	templatesMap    map[uint16]templateValue
-	templateRefCh   chan struct{}
-	mutex           sync.Mutex
+	// templateRefCh is closed when the connection to the collector is closed,
+	// which stops the template refresh and Start.
+	templateRefCh chan struct{}
+	closeOnce     sync.Once
+	// refreshErr is the error which closed the connection when sending the
+	// refreshed templates failed, and isStarted indicates whether Start has
+	// been called.
+	refreshErr error
+	isStarted  bool
+	mutex      sync.Mutex
+	// reducedSizeLengths maps element names to the lengths used in templates
+	reducedSizeLengths map[string]uint16
 }
 
 type ExporterInput struct {
@@ -66,6 +83,11 @@ type ExporterInput struct {
 	ClientCert          []byte
 	ClientKey           []byte
 	IsIPv6              bool
+	// ReducedSizeLengths is optional and maps names of information elements to
+	// shorter lengths to declare in templates, for reduced-size encoding as per
+	// RFC7011 section 6.2. Values of these elements in data records must fit in
+	// the reduced lengths.
+	ReducedSizeLengths map[string]uint16
 }
 
 // InitExportingProcess takes in collector address(net.Addr format), obsID(observation ID)
@@ -125,6 +147,8 @@ func InitExportingProcess(input ExporterInput) (*ExportingProcess, error) {
 		pathMTU:         input.PathMTU,
 		templatesMap:    make(map[uint16]templateValue),
 		templateRefCh:   make(chan struct{}),
+
+		reducedSizeLengths: input.ReducedSizeLengths,
 	}
 
 	// Template refresh logic is only for UDP transport.
@@ -142,12 +166,15 @@ func InitExportingProcess(input ExporterInput) (*ExportingProcess, error) {
 			for {
 				select {
 				case <-expProc.templateRefCh:
-					break
+					return
 				case <-ticker.C:
 					err := expProc.sendRefreshedTemplates()
 					if err != nil {
-						// Other option is sending messages through channel to library consumers
+						// The error is also returned by Start.
 						klog.Errorf("Error when sending refreshed templates: %v. Closing the connection to IPFIX controller", err)
+						expProc.mutex.Lock()
+						expProc.refreshErr = err
+						expProc.mutex.Unlock()
 						expProc.CloseConnToCollector()
 					}
 				}
@@ -163,9 +190,22 @@ func (ep *ExportingProcess) SendSet(set entities.Set) (int, error) {
 	if setType == entities.Undefined {
 		return 0, fmt.Errorf("set type is not properly defined")
 	}
+	if len(ep.reducedSizeLengths) > 0 {
+		var err error
+		set, err = ep.applyReducedSizeEncoding(set)
+		if err != nil {
+			return 0, fmt.Errorf("error when applying reduced-size encoding: %v", err)
+		}
+	}
 	for _, record := range set.GetRecords() {
-		if setType == entities.Template {
-			ep.updateTemplate(record.GetTemplateID(), record.GetOrderedElementList(), record.GetMinDataRecordLen())
+		if (setType == entities.Template || setType == entities.OptionsTemplate) && record.GetFieldCount() == 0 {
+			// Template withdrawal record
+			err := ep.deleteWithdrawnTemplate(record.GetTemplateID(), setType == entities.OptionsTemplate)
+			if err != nil {
+				return 0, err
+			}
+		} else if setType == entities.Template || setType == entities.OptionsTemplate {
+			ep.updateTemplate(record.GetTemplateID(), record.GetOrderedElementList(), record.GetMinDataRecordLen(), record.GetScopeFieldCount())
 		} else if setType == entities.Data {
 			err := ep.dataRecSanityCheck(record)
 			if err != nil {
@@ -191,17 +231,49 @@ func (ep *ExportingProcess) GetMsgSizeLimit() int {
 	}
 }
 
+// Start blocks until ctx is done, Stop is called, or the connection to the
+// collector is closed because sending the refreshed templates failed, in which
+// case it returns the error. The connection is closed when it returns. Sets can
+// be sent whether or not the exporting process is started, which only ties its
+// connection to ctx. It cannot be started more than once.
+func (ep *ExportingProcess) Start(ctx context.Context) error {
+	ep.mutex.Lock()
+	if ep.isStarted {
+		ep.mutex.Unlock()
+		return fmt.Errorf("exporting process has already been started")
+	}
+	ep.isStarted = true
+	ep.mutex.Unlock()
+	select {
+	case <-ctx.Done():
+		ep.CloseConnToCollector()
+		return nil
+	case <-ep.templateRefCh:
+		ep.mutex.Lock()
+		defer ep.mutex.Unlock()
+		return ep.refreshErr
+	}
+}
+
+// Stop closes the connection to the collector without waiting for Start to
+// return. It can be called more than once, and before Start.
+func (ep *ExportingProcess) Stop() {
+	ep.CloseConnToCollector()
+}
+
+// CloseConnToCollector stops the template refresh and closes the connection to
+// the collector. It can be called more than once.
 func (ep *ExportingProcess) CloseConnToCollector() {
-	if !isChanClosed(ep.templateRefCh) {
+	ep.closeOnce.Do(func() {
 		close(ep.templateRefCh) // Close template refresh channel
-	}
 
-	err := ep.connToCollector.Close()
-	// Just log the error that happened when closing the connection. Not returning error as we do not expect library
-	// consumers to exit their programs with this error.
-	if err != nil {
-		klog.Errorf("Error when closing connection to collector: %v", err)
-	}
+		err := ep.connToCollector.Close()
+		// Just log the error that happened when closing the connection. Not returning error as we do not expect library
+		// consumers to exit their programs with this error.
+		if err != nil {
+			klog.Errorf("Error when closing connection to collector: %v", err)
+		}
+	})
 }
 
 // NewTemplateID is called to get ID when creating new template record.
@@ -210,6 +282,49 @@ func (ep *ExportingProcess) NewTemplateID() uint16 {
 	return ep.templateID
 }
 
+// WithdrawTemplate withdraws the template with the given ID, so that it is no
+// longer refreshed. Over TCP, a template withdrawal message is sent to the
+// collector. Over UDP, template withdrawal messages must not be sent as per
+// RFC7011 section 8.4, and the template expires at the collector instead.
+func (ep *ExportingProcess) WithdrawTemplate(id uint16) error {
+	ep.mutex.Lock()
+	template, exist := ep.templatesMap[id]
+	ep.mutex.Unlock()
+	if !exist {
+		return fmt.Errorf("process: template %d does not exist in exporting process", id)
+	}
+	setType := entities.Template
+	if template.scopeFieldCount > 0 {
+		setType = entities.OptionsTemplate
+	}
+	return ep.sendTemplateWithdrawal(setType, id)
+}
+
+// WithdrawAllTemplates withdraws all the templates and options templates. Same
+// as WithdrawTemplate, withdrawal messages are only sent over TCP.
+func (ep *ExportingProcess) WithdrawAllTemplates() error {
+	if err := ep.sendTemplateWithdrawal(entities.Template, entities.TemplateSetID); err != nil {
+		return err
+	}
+	return ep.sendTemplateWithdrawal(entities.OptionsTemplate, entities.OptionsTemplateSetID)
+}
+
+func (ep *ExportingProcess) sendTemplateWithdrawal(setType entities.ContentType, id uint16) error {
+	if ep.connToCollector.LocalAddr().Network() != "tcp" {
+		return ep.deleteWithdrawnTemplate(id, setType == entities.OptionsTemplate)
+	}
+	withdrawalSet := entities.NewSet(false)
+	if err := withdrawalSet.PrepareSet(setType, id); err != nil {
+		return err
+	}
+	// Template withdrawal record has a field count of 0.
+	if err := withdrawalSet.AddRecord(nil, id); err != nil {
+		return err
+	}
+	_, err := ep.SendSet(withdrawalSet)
+	return err
+}
+
 // createAndSendMsg takes in a set as input, creates the message, and sends it out.
 // TODO: This method will change when we support sending multiple sets.
 func (ep *ExportingProcess) createAndSendMsg(set entities.Set) (int, error) {
@@ -236,10 +351,12 @@ func (ep *ExportingProcess) createAndSendMsg(set entities.Set) (int, error) {
 	msg.SetObsDomainID(ep.obsDomainID)
 	msg.SetMessageLen(uint16(msgLen))
 	msg.SetExportTime(uint32(time.Now().Unix()))
+	// The sequence number is the number of data records sent before this
+	// message (RFC7011 section 3.1).
+	msg.SetSequenceNum(ep.seqNumber)
 	if set.GetSetType() == entities.Data {
 		ep.seqNumber = ep.seqNumber + set.GetNumberOfRecords()
 	}
-	msg.SetSequenceNum(ep.seqNumber)
 
 	bytesSlice := make([]byte, msgLen)
 	copy(bytesSlice[:entities.MsgHeaderLength], msg.GetMsgHeader())
@@ -261,20 +378,25 @@ func (ep *ExportingProcess) createAndSendMsg(set entities.Set) (int, error) {
 	return bytesSent, nil
 }
 
-func (ep *ExportingProcess) updateTemplate(id uint16, elements []*entities.InfoElementWithValue, minDataRecLen uint16) {
+func (ep *ExportingProcess) updateTemplate(id uint16, elements []*entities.InfoElementWithValue, minDataRecLen uint16, scopeFieldCount uint16) {
 	ep.mutex.Lock()
 	defer ep.mutex.Unlock()
 
 	if _, exist := ep.templatesMap[id]; exist {
 		return
 	}
-	ep.templatesMap[id] = templateValue{
-		make([]*entities.InfoElement, len(elements)),
-		minDataRecLen,
+	template := templateValue{
+		elements:        make([]*entities.InfoElement, len(elements)),
+		minDataRecLen:   minDataRecLen,
+		scopeFieldCount: scopeFieldCount,
 	}
 	for i, elem := range elements {
-		ep.templatesMap[id].elements[i] = elem.Element
+		template.elements[i] = elem.Element
+		if fullLen := entities.InfoElementLength[elem.Element.DataType]; fullLen != entities.VariableLength && elem.Element.Len < fullLen {
+			template.hasReducedSizeElements = true
+		}
 	}
+	ep.templatesMap[id] = template
 	return
 }
 
@@ -289,21 +411,43 @@ func (ep *ExportingProcess) deleteTemplate(id uint16) error {
 	return nil
 }
 
+// deleteWithdrawnTemplate deletes the template withdrawn by a template
+// withdrawal record. A template ID equal to the template set ID (or options
+// template set ID) withdraws all templates (or all options templates).
+func (ep *ExportingProcess) deleteWithdrawnTemplate(id uint16, isOptions bool) error {
+	if id != entities.TemplateSetID && id != entities.OptionsTemplateSetID {
+		return ep.deleteTemplate(id)
+	}
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+
+	for templateID, tempValue := range ep.templatesMap {
+		if (tempValue.scopeFieldCount > 0) == isOptions {
+			delete(ep.templatesMap, templateID)
+		}
+	}
+	return nil
+}
+
 func (ep *ExportingProcess) sendRefreshedTemplates() error {
 	// Send refreshed template for every template in template map
 	templateSets := make([]entities.Set, 0)
 
 	ep.mutex.Lock()
 	for templateID, tempValue := range ep.templatesMap {
+		setType := entities.Template
+		if tempValue.scopeFieldCount > 0 {
+			setType = entities.OptionsTemplate
+		}
 		tempSet := entities.NewSet(false)
-		if err := tempSet.PrepareSet(entities.Template, templateID); err != nil {
+		if err := tempSet.PrepareSet(setType, templateID); err != nil {
 			return err
 		}
 		elements := make([]*entities.InfoElementWithValue, len(tempValue.elements))
 		for i, element := range tempValue.elements {
 			elements[i] = entities.NewInfoElementWithValue(element, nil)
 		}
-		err := tempSet.AddRecord(elements, templateID)
+		err := tempSet.AddRecordWithScope(elements, tempValue.scopeFieldCount, templateID)
 		if err != nil {
 			return err
 		}
@@ -319,6 +463,62 @@ func (ep *ExportingProcess) sendRefreshedTemplates() error {
 	return nil
 }
 
+// applyReducedSizeEncoding returns a set in which the elements of template
+// records are declared with the reduced lengths given in ExporterInput, and the
+// values of data records are encoded with the reduced lengths of their template.
+func (ep *ExportingProcess) applyReducedSizeEncoding(set entities.Set) (entities.Set, error) {
+	setType := set.GetSetType()
+	records := set.GetRecords()
+	if len(records) == 0 {
+		return set, nil
+	}
+	if setType == entities.Data {
+		// Data sets of templates without reduced-size elements are sent as they are.
+		ep.mutex.Lock()
+		template, exist := ep.templatesMap[records[0].GetTemplateID()]
+		ep.mutex.Unlock()
+		if !exist || !template.hasReducedSizeElements {
+			return set, nil
+		}
+	}
+	reducedSet := entities.NewSet(false)
+	if err := reducedSet.PrepareSet(setType, records[0].GetTemplateID()); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		templateID := record.GetTemplateID()
+		elements := make([]*entities.InfoElementWithValue, len(record.GetOrderedElementList()))
+		if setType == entities.Data {
+			ep.mutex.Lock()
+			template, exist := ep.templatesMap[templateID]
+			ep.mutex.Unlock()
+			if !exist || len(template.elements) != len(elements) {
+				// Leave it to the sanity check of data records.
+				return set, nil
+			}
+			for i, element := range record.GetOrderedElementList() {
+				elements[i] = entities.NewInfoElementWithValue(template.elements[i], element.Value)
+			}
+		} else {
+			for i, element := range record.GetOrderedElementList() {
+				reducedElement := element.Element
+				if length, exist := ep.reducedSizeLengths[element.Element.Name]; exist && length != element.Element.Len {
+					var err error
+					reducedElement, err = entities.NewReducedSizeInfoElement(element.Element, length)
+					if err != nil {
+						return nil, err
+					}
+				}
+				elements[i] = entities.NewInfoElementWithValue(reducedElement, nil)
+			}
+		}
+		if err := reducedSet.AddRecordWithScope(elements, record.GetScopeFieldCount(), templateID); err != nil {
+			return nil, err
+		}
+	}
+	return reducedSet, nil
+}
+
 func (ep *ExportingProcess) dataRecSanityCheck(rec entities.Record) error {
 	templateID := rec.GetTemplateID()
 
@@ -337,15 +537,6 @@ func (ep *ExportingProcess) dataRecSanityCheck(rec entities.Record) error {
 	return nil
 }
 
-func isChanClosed(ch <-chan struct{}) bool {
-	select {
-	case <-ch:
-		return true
-	default:
-	}
-	return false
-}
-
 func createClientConfig(caCert, clientCert, clientKey []byte) (*tls.Config, error) {
 	roots := x509.NewCertPool()
 	ok := roots.AppendCertsFromPEM(caCert)
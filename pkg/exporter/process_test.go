@@ -15,8 +15,11 @@
 package exporter
 
 import (
+	"context"
 	"crypto/tls"
+	"io"
 	"net"
+	"runtime"
 	"testing"
 	"time"
 
@@ -251,7 +254,7 @@ func TestExportingProcess_SendingDataRecordToLocalTCPServer(t *testing.T) {
 	}
 	element2 := entities.NewInfoElementWithValue(element, nil)
 	// Hardcoding 8-bytes min data record length for testing purposes instead of creating template record
-	exporter.updateTemplate(templateID, []*entities.InfoElementWithValue{element1, element2}, 8)
+	exporter.updateTemplate(templateID, []*entities.InfoElementWithValue{element1, element2}, 8, 0)
 
 	// Create data set with 1 data record
 	dataSet := entities.NewSet(false)
@@ -351,7 +354,7 @@ func TestExportingProcess_SendingDataRecordToLocalUDPServer(t *testing.T) {
 	}
 	element2 := entities.NewInfoElementWithValue(element, nil)
 	// Hardcoding 8-bytes min data record length for testing purposes instead of creating template record
-	exporter.updateTemplate(templateID, []*entities.InfoElementWithValue{element1, element2}, 8)
+	exporter.updateTemplate(templateID, []*entities.InfoElementWithValue{element1, element2}, 8, 0)
 
 	// Create data set with 1 data record
 	dataSet := entities.NewSet(false)
@@ -563,6 +566,430 @@ func TestExportingProcessWithDTLS(t *testing.T) {
 	exporter.CloseConnToCollector()
 }
 
+func TestExportingProcess_SendingOptionsTemplateAndDataRecordToLocalTCPServer(t *testing.T) {
+	// Create local server for testing
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error when creating a local server: %v", err)
+	}
+	t.Log("Created local server on random available port for testing")
+
+	buffCh := make(chan []byte)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		t.Log("Accept the connection from exporter")
+		// Options template message (34 bytes) and data message (28 bytes)
+		for _, size := range []int{34, 28} {
+			buff := make([]byte, size)
+			_, err = io.ReadFull(conn, buff)
+			if err != nil {
+				t.Error(err)
+			}
+			// Remove message header and set header.
+			buffCh <- buff[20:]
+		}
+	}()
+
+	// Create exporter using local server info
+	input := ExporterInput{
+		CollectorAddress:    listener.Addr().String(),
+		CollectorProtocol:   listener.Addr().Network(),
+		ObservationDomainID: 1,
+		TempRefTimeout:      0,
+		PathMTU:             0,
+	}
+	exporter, err := InitExportingProcess(input)
+	if err != nil {
+		t.Fatalf("Got error when connecting to local server %s: %v", listener.Addr().String(), err)
+	}
+	t.Logf("Created exporter connecting to local server with address: %s", listener.Addr().String())
+
+	// Create options template record with one scope field and one option field
+	templateID := exporter.NewTemplateID()
+	optionsTemplateSet := entities.NewSet(false)
+	err = optionsTemplateSet.PrepareSet(entities.OptionsTemplate, templateID)
+	assert.NoError(t, err)
+	scopeElement, err := registry.GetInfoElement("observationDomainId", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+	optionElement, err := registry.GetInfoElement("samplingInterval", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+	elements := []*entities.InfoElementWithValue{
+		entities.NewInfoElementWithValue(scopeElement, nil),
+		entities.NewInfoElementWithValue(optionElement, nil),
+	}
+	err = optionsTemplateSet.AddRecordWithScope(elements, 1, templateID)
+	assert.NoError(t, err)
+	bytesSent, err := exporter.SendSet(optionsTemplateSet)
+	assert.NoError(t, err)
+	assert.Equal(t, 34, bytesSent)
+	assert.Equal(t, []byte{0x1, 0x0, 0x0, 0x2, 0x0, 0x1, 0x0, 0x95, 0x0, 0x4, 0x0, 0x22, 0x0, 0x4}, <-buffCh)
+	assert.Equal(t, uint16(1), exporter.templatesMap[templateID].scopeFieldCount)
+
+	// Create data set with options data record
+	dataSet := entities.NewSet(false)
+	err = dataSet.PrepareSet(entities.Data, templateID)
+	assert.NoError(t, err)
+	elements = []*entities.InfoElementWithValue{
+		entities.NewInfoElementWithValue(scopeElement, uint32(1)),
+		entities.NewInfoElementWithValue(optionElement, uint32(100)),
+	}
+	err = dataSet.AddRecord(elements, templateID)
+	assert.NoError(t, err)
+	bytesSent, err = exporter.SendSet(dataSet)
+	assert.NoError(t, err)
+	assert.Equal(t, 28, bytesSent)
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x64}, <-buffCh)
+	assert.Equal(t, uint32(1), exporter.seqNumber)
+	exporter.CloseConnToCollector()
+}
+
+func TestExportingProcess_WithdrawTemplateToLocalTCPServer(t *testing.T) {
+	// Create local server for testing
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error when creating a local server: %v", err)
+	}
+	t.Log("Created local server on random available port for testing")
+
+	buffCh := make(chan []byte)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		t.Log("Accept the connection from exporter")
+		// Template withdrawal, all templates withdrawal and all options
+		// templates withdrawal messages (24 bytes each)
+		for i := 0; i < 3; i++ {
+			buff := make([]byte, 24)
+			_, err = io.ReadFull(conn, buff)
+			if err != nil {
+				t.Error(err)
+			}
+			// Remove message header.
+			buffCh <- buff[16:]
+		}
+	}()
+
+	// Create exporter using local server info
+	input := ExporterInput{
+		CollectorAddress:    listener.Addr().String(),
+		CollectorProtocol:   listener.Addr().Network(),
+		ObservationDomainID: 1,
+		TempRefTimeout:      0,
+		PathMTU:             0,
+	}
+	exporter, err := InitExportingProcess(input)
+	if err != nil {
+		t.Fatalf("Got error when connecting to local server %s: %v", listener.Addr().String(), err)
+	}
+	t.Logf("Created exporter connecting to local server with address: %s", listener.Addr().String())
+
+	element, err := registry.GetInfoElement("sourceIPv4Address", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+	elements := []*entities.InfoElementWithValue{entities.NewInfoElementWithValue(element, nil)}
+	exporter.updateTemplate(256, elements, 4, 0)
+	exporter.updateTemplate(257, elements, 4, 0)
+	exporter.updateTemplate(258, elements, 4, 1)
+
+	err = exporter.WithdrawTemplate(256)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x0, 0x2, 0x0, 0x8, 0x1, 0x0, 0x0, 0x0}, <-buffCh)
+	assert.NotContains(t, exporter.templatesMap, uint16(256))
+	err = exporter.WithdrawTemplate(256)
+	assert.Error(t, err, "Withdrawing a template which does not exist should fail")
+
+	err = exporter.WithdrawAllTemplates()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x0, 0x2, 0x0, 0x8, 0x0, 0x2, 0x0, 0x0}, <-buffCh)
+	assert.Equal(t, []byte{0x0, 0x3, 0x0, 0x8, 0x0, 0x3, 0x0, 0x0}, <-buffCh)
+	assert.Empty(t, exporter.templatesMap)
+	exporter.CloseConnToCollector()
+}
+
+func TestExportingProcess_ReducedSizeEncodingToLocalTCPServer(t *testing.T) {
+	// Create local server for testing
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error when creating a local server: %v", err)
+	}
+	t.Log("Created local server on random available port for testing")
+
+	buffCh := make(chan []byte)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		t.Log("Accept the connection from exporter")
+		// Template message (32 bytes) and data message (26 bytes)
+		for _, length := range []int{32, 26} {
+			buff := make([]byte, length)
+			_, err = io.ReadFull(conn, buff)
+			if err != nil {
+				t.Error(err)
+			}
+			// Remove message header.
+			buffCh <- buff[16:]
+		}
+	}()
+
+	// Create exporter using local server info
+	input := ExporterInput{
+		CollectorAddress:    listener.Addr().String(),
+		CollectorProtocol:   listener.Addr().Network(),
+		ObservationDomainID: 1,
+		TempRefTimeout:      0,
+		PathMTU:             0,
+		ReducedSizeLengths:  map[string]uint16{"octetDeltaCount": 4},
+	}
+	exporter, err := InitExportingProcess(input)
+	if err != nil {
+		t.Fatalf("Got error when connecting to local server %s: %v", listener.Addr().String(), err)
+	}
+	t.Logf("Created exporter connecting to local server with address: %s", listener.Addr().String())
+
+	octetDeltaCount, err := registry.GetInfoElement("octetDeltaCount", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+	sourceTransportPort, err := registry.GetInfoElement("sourceTransportPort", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+
+	templateID := exporter.NewTemplateID()
+	templateSet := entities.NewSet(false)
+	err = templateSet.PrepareSet(entities.Template, templateID)
+	assert.NoError(t, err)
+	elements := []*entities.InfoElementWithValue{
+		entities.NewInfoElementWithValue(octetDeltaCount, nil),
+		entities.NewInfoElementWithValue(sourceTransportPort, nil),
+	}
+	err = templateSet.AddRecord(elements, templateID)
+	assert.NoError(t, err)
+	_, err = exporter.SendSet(templateSet)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x0, 0x2, 0x0, 0x10, 0x1, 0x0, 0x0, 0x2, 0x0, 0x1, 0x0, 0x4, 0x0, 0x7, 0x0, 0x2}, <-buffCh)
+	assert.Equal(t, uint16(8), octetDeltaCount.Len, "Element in the registry should not be modified")
+
+	dataSet := entities.NewSet(false)
+	err = dataSet.PrepareSet(entities.Data, templateID)
+	assert.NoError(t, err)
+	elements = []*entities.InfoElementWithValue{
+		entities.NewInfoElementWithValue(octetDeltaCount, uint64(65536)),
+		entities.NewInfoElementWithValue(sourceTransportPort, uint16(80)),
+	}
+	err = dataSet.AddRecord(elements, templateID)
+	assert.NoError(t, err)
+	bytesSent, err := exporter.SendSet(dataSet)
+	assert.NoError(t, err)
+	assert.Equal(t, 26, bytesSent)
+	assert.Equal(t, []byte{0x1, 0x0, 0x0, 0xa, 0x0, 0x1, 0x0, 0x0, 0x0, 0x50}, <-buffCh)
+	assert.True(t, exporter.templatesMap[templateID].hasReducedSizeElements)
+
+	// Data sets of templates without reduced-size elements are not encoded again.
+	otherTemplateID := exporter.NewTemplateID()
+	exporter.updateTemplate(otherTemplateID, []*entities.InfoElementWithValue{entities.NewInfoElementWithValue(sourceTransportPort, nil)}, 2, 0)
+	assert.False(t, exporter.templatesMap[otherTemplateID].hasReducedSizeElements)
+	otherDataSet := entities.NewSet(false)
+	err = otherDataSet.PrepareSet(entities.Data, otherTemplateID)
+	assert.NoError(t, err)
+	err = otherDataSet.AddRecord([]*entities.InfoElementWithValue{entities.NewInfoElementWithValue(sourceTransportPort, uint16(80))}, otherTemplateID)
+	assert.NoError(t, err)
+	reducedSet, err := exporter.applyReducedSizeEncoding(otherDataSet)
+	assert.NoError(t, err)
+	assert.Same(t, otherDataSet, reducedSet)
+
+	// Value which does not fit in the reduced size
+	dataSet.ResetSet()
+	err = dataSet.PrepareSet(entities.Data, templateID)
+	assert.NoError(t, err)
+	elements = []*entities.InfoElementWithValue{
+		entities.NewInfoElementWithValue(octetDeltaCount, uint64(1)<<32),
+		entities.NewInfoElementWithValue(sourceTransportPort, uint16(80)),
+	}
+	err = dataSet.AddRecord(elements, templateID)
+	assert.NoError(t, err)
+	_, err = exporter.SendSet(dataSet)
+	assert.Error(t, err)
+	exporter.CloseConnToCollector()
+}
+
+func TestExportingProcess_WithdrawTemplateToLocalUDPServer(t *testing.T) {
+	// Create local server for testing
+	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error when resolving UDP address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("Got error when creating a local server: %v", err)
+	}
+	defer conn.Close()
+
+	// Create exporter using local server info
+	input := ExporterInput{
+		CollectorAddress:    conn.LocalAddr().String(),
+		CollectorProtocol:   conn.LocalAddr().Network(),
+		ObservationDomainID: 1,
+		TempRefTimeout:      1,
+		PathMTU:             0,
+	}
+	exporter, err := InitExportingProcess(input)
+	if err != nil {
+		t.Fatalf("Got error when connecting to local server %s: %v", conn.LocalAddr().String(), err)
+	}
+
+	element, err := registry.GetInfoElement("sourceIPv4Address", registry.IANAEnterpriseID)
+	assert.NoError(t, err)
+	elements := []*entities.InfoElementWithValue{entities.NewInfoElementWithValue(element, nil)}
+	exporter.updateTemplate(256, elements, 4, 0)
+	exporter.updateTemplate(257, elements, 4, 1)
+
+	// Withdrawn templates are removed without sending any message, and are not
+	// refreshed anymore.
+	err = exporter.WithdrawTemplate(256)
+	assert.NoError(t, err)
+	exporter.mutex.Lock()
+	assert.NotContains(t, exporter.templatesMap, uint16(256))
+	assert.Contains(t, exporter.templatesMap, uint16(257))
+	exporter.mutex.Unlock()
+	err = exporter.WithdrawAllTemplates()
+	assert.NoError(t, err)
+	exporter.mutex.Lock()
+	assert.Empty(t, exporter.templatesMap)
+	exporter.mutex.Unlock()
+	conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 512))
+	assert.Error(t, err, "No template should be sent after all templates are withdrawn")
+	exporter.CloseConnToCollector()
+}
+
+func TestExportingProcess_CloseConnToCollector(t *testing.T) {
+	numGoroutines := runtime.NumGoroutine()
+	// Create local server for testing
+	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error when resolving UDP address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("Got error when creating a local server: %v", err)
+	}
+	defer conn.Close()
+	// Create exporter using local server info
+	input := ExporterInput{
+		CollectorAddress:    conn.LocalAddr().String(),
+		CollectorProtocol:   conn.LocalAddr().Network(),
+		ObservationDomainID: 1,
+		TempRefTimeout:      1,
+		PathMTU:             0,
+	}
+	exporter, err := InitExportingProcess(input)
+	if err != nil {
+		t.Fatalf("Got error when connecting to local server %s: %v", conn.LocalAddr().String(), err)
+	}
+	// The connection can be closed more than once, and concurrently, and the
+	// template refresh goroutine stops.
+	done := make(chan bool)
+	go func() {
+		exporter.CloseConnToCollector()
+		close(done)
+	}()
+	exporter.CloseConnToCollector()
+	<-done
+	exporter.CloseConnToCollector()
+	for start := time.Now(); runtime.NumGoroutine() > numGoroutines; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Goroutines are leaked, %d goroutines are running instead of %d", runtime.NumGoroutine(), numGoroutines)
+		}
+	}
+}
+
+func TestExportingProcess_Start(t *testing.T) {
+	numGoroutines := runtime.NumGoroutine()
+	// Create local server for testing
+	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error when resolving UDP address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("Got error when creating a local server: %v", err)
+	}
+	defer conn.Close()
+	input := ExporterInput{
+		CollectorAddress:    conn.LocalAddr().String(),
+		CollectorProtocol:   conn.LocalAddr().Network(),
+		ObservationDomainID: 1,
+		TempRefTimeout:      1,
+		PathMTU:             0,
+	}
+	startExporter := func(ctx context.Context) (*ExportingProcess, chan error) {
+		exporter, err := InitExportingProcess(input)
+		if err != nil {
+			t.Fatalf("Got error when connecting to local server %s: %v", conn.LocalAddr().String(), err)
+		}
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- exporter.Start(ctx)
+		}()
+		return exporter, errChan
+	}
+	waitForStart := func(errChan chan error) error {
+		select {
+		case err := <-errChan:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Start should return when the exporting process is stopped")
+		}
+		return nil
+	}
+
+	// The connection is closed when ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter, errChan := startExporter(ctx)
+	cancel()
+	assert.NoError(t, waitForStart(errChan))
+	assert.Error(t, exporter.Start(context.Background()), "Start should not be called more than once")
+	_, err = exporter.connToCollector.Write([]byte{0})
+	assert.Error(t, err, "The connection should be closed")
+
+	// Stop can be called more than once.
+	exporter, errChan = startExporter(context.Background())
+	exporter.Stop()
+	exporter.Stop()
+	assert.NoError(t, waitForStart(errChan))
+
+	// Start returns the error of sending the refreshed templates.
+	exporter, errChan = startExporter(context.Background())
+	templateID := exporter.NewTemplateID()
+	templateSet := entities.NewSet(false)
+	err = templateSet.PrepareSet(entities.Template, templateID)
+	assert.NoError(t, err)
+	element, err := registry.GetInfoElement("sourceIPv4Address", registry.IANAEnterpriseID)
+	if err != nil {
+		t.Fatalf("Did not find the element with name sourceIPv4Address")
+	}
+	templateSet.AddRecord([]*entities.InfoElementWithValue{entities.NewInfoElementWithValue(element, nil)}, templateID)
+	_, err = exporter.SendSet(templateSet)
+	assert.NoError(t, err)
+	exporter.connToCollector.Close()
+	assert.Error(t, waitForStart(errChan))
+
+	for start := time.Now(); runtime.NumGoroutine() > numGoroutines; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Goroutines are leaked, %d goroutines are running instead of %d", runtime.NumGoroutine(), numGoroutines)
+		}
+	}
+}
+
 func TestExportingProcess_GetMsgSizeLimit(t *testing.T) {
 	// Create local server for testing
 	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
@@ -16,6 +16,7 @@ package intermediate
 
 import (
 	"container/heap"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -46,8 +47,6 @@ type AggregationProcess struct {
 	messageChan chan *entities.Message
 	// workerNum is the number of workers to process the messages
 	workerNum int
-	// workerList is the list of workers
-	workerList []*worker
 	// correlateFields are the fields to be filled when correlating records of the
 	// flow whose type is registry.InterNode(pkg/registry/registry.go).
 	correlateFields []string
@@ -66,8 +65,11 @@ type AggregationProcess struct {
 	// time a new record is received for the existing record in the aggregation
 	// record map.
 	inactiveExpiryTimeout time.Duration
-	// stopChan is the channel to receive stop message
-	stopChan chan bool
+	// stopChan is closed when the aggregation process is stopped
+	stopChan chan struct{}
+	stopOnce sync.Once
+	// isStarted indicates whether Start has been called
+	isStarted bool
 }
 
 type AggregationInput struct {
@@ -99,43 +101,70 @@ func InitAggregationProcess(input AggregationInput) (*AggregationProcess, error)
 		sync.RWMutex{},
 		input.MessageChan,
 		input.WorkerNum,
-		make([]*worker, 0),
 		input.CorrelateFields,
 		input.AggregateElements,
 		input.ActiveExpiryTimeout,
 		input.InactiveExpiryTimeout,
-		make(chan bool),
+		make(chan struct{}),
+		sync.Once{},
+		false,
 	}, nil
 }
 
-func (a *AggregationProcess) Start() {
+// Start starts the workers, and blocks until ctx is done, Stop is called, or the
+// message channel is closed and all its messages have been aggregated. It cannot
+// be started more than once. The workers have exited when it returns.
+func (a *AggregationProcess) Start(ctx context.Context) error {
 	a.mutex.Lock()
-	for i := 0; i < a.workerNum; i++ {
-		w := createWorker(i, a.messageChan, a.AggregateMsgByFlowKey)
-		w.start()
-		a.workerList = append(a.workerList, w)
+	if a.isStarted {
+		a.mutex.Unlock()
+		return fmt.Errorf("aggregation process has already been started")
 	}
+	a.isStarted = true
 	a.mutex.Unlock()
-	<-a.stopChan
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < a.workerNum; i++ {
+		w := createWorker(i, a.messageChan, a.AggregateMsgByFlowKey)
+		w.start(ctx, &wg)
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-ctx.Done():
+	case <-a.stopChan:
+	case <-workersDone:
+	}
+	cancel()
+	<-workersDone
+	return nil
 }
 
+// Stop stops the aggregation process without waiting for Start to return. It
+// can be called more than once, and before Start.
 func (a *AggregationProcess) Stop() {
-	a.mutex.Lock()
-	for _, worker := range a.workerList {
-		worker.stop()
-	}
-	a.mutex.Unlock()
-	a.stopChan <- true
+	a.stopOnce.Do(func() {
+		close(a.stopChan)
+	})
 }
 
 // AggregateMsgByFlowKey gets flow key from records in message and stores in cache
 func (a *AggregationProcess) AggregateMsgByFlowKey(message *entities.Message) error {
-	set := message.GetSet()
-	if set.GetSetType() != entities.Data { // only process data records
+	records := make([]entities.Record, 0)
+	for _, set := range message.GetSets() {
+		if set.GetSetType() != entities.Data { // only process data records
+			continue
+		}
+		records = append(records, set.GetRecords()...)
+	}
+	if len(records) == 0 {
 		return nil
 	}
 
-	records := set.GetRecords()
 	invalidRecs := 0
 	for _, record := range records {
 		// Validate the data record. If invalid, we log the error and move to the next
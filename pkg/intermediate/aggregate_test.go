@@ -16,7 +16,9 @@ package intermediate
 
 import (
 	"container/heap"
+	"context"
 	"net"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -477,9 +479,11 @@ func TestAggregationProcess(t *testing.T) {
 		close(messageChan)
 		aggregationProcess.Stop()
 	}()
-	// the Start() function is blocking until above goroutine with Stop() finishes
+	// the Start() function is blocking until the message channel is closed or
+	// Stop() is called in above goroutine
 	// Proper usage of aggregation process is to have Start() in a goroutine with external channel
-	aggregationProcess.Start()
+	err := aggregationProcess.Start(context.Background())
+	assert.NoError(t, err)
 	flowKey := FlowKey{
 		"10.0.0.1", "10.0.0.2", 6, 1234, 5678,
 	}
@@ -487,6 +491,34 @@ func TestAggregationProcess(t *testing.T) {
 	assert.Equalf(t, aggRecord.Record, dataMsg.GetSet().GetRecords()[0], "records should be equal")
 }
 
+func TestAggregationProcess_StartStop(t *testing.T) {
+	numGoroutines := runtime.NumGoroutine()
+	input := AggregationInput{
+		MessageChan:     make(chan *entities.Message),
+		WorkerNum:       2,
+		CorrelateFields: fields,
+	}
+	aggregationProcess, _ := InitAggregationProcess(input)
+	// Stop can be called before Start and more than once
+	aggregationProcess.Stop()
+	aggregationProcess.Stop()
+	assert.NoError(t, aggregationProcess.Start(context.Background()))
+	assert.Error(t, aggregationProcess.Start(context.Background()), "Aggregation process should not be started twice")
+	waitForGoroutines(t, numGoroutines)
+
+	input.MessageChan = make(chan *entities.Message)
+	aggregationProcess, _ = InitAggregationProcess(input)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- aggregationProcess.Start(ctx)
+	}()
+	input.MessageChan <- createMsgwithTemplateSet(false)
+	cancel()
+	assert.NoError(t, <-errCh)
+	waitForGoroutines(t, numGoroutines)
+}
+
 func TestCorrelateRecordsForInterNodeFlow(t *testing.T) {
 	messageChan := make(chan *entities.Message)
 	input := AggregationInput{
@@ -929,3 +961,15 @@ func runAggregationAndCheckResult(t *testing.T, ap *AggregationProcess, srcRecor
 		assert.Equalf(t, latestRecord.Value, ieWithValue.Value, "values should be equal for element %v", e)
 	}
 }
+
+// waitForGoroutines waits until the number of goroutines is back to at most
+// numGoroutines, so that a stopped process does not leak any goroutine.
+func waitForGoroutines(t *testing.T, numGoroutines int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if runtime.NumGoroutine() <= numGoroutines {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Errorf("Goroutines are leaked, %d goroutines are running instead of %d:\n%s", runtime.NumGoroutine(), numGoroutines, buf[:runtime.Stack(buf, true)])
+}
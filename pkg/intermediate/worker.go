@@ -1,6 +1,9 @@
 package intermediate
 
 import (
+	"context"
+	"sync"
+
 	"k8s.io/klog/v2"
 
 	"github.com/vmware/go-ipfix/pkg/entities"
@@ -9,7 +12,6 @@ import (
 type worker struct {
 	id          int
 	messageChan chan *entities.Message
-	errChan     chan bool
 	job         func(*entities.Message) error
 }
 
@@ -17,32 +19,31 @@ func createWorker(id int, messageChan chan *entities.Message, job func(*entities
 	return &worker{
 		id,
 		messageChan,
-		make(chan bool),
 		job,
 	}
 }
 
-func (w *worker) start() {
+// start starts the worker, which processes messages until ctx is done or the
+// message channel is closed and empty.
+func (w *worker) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
-			case <-w.errChan:
+			case <-ctx.Done():
 				return
 			case message, ok := <-w.messageChan:
 				if !ok { // messageChan is closed and empty
-					break
+					return
 				}
 				err := w.job(message)
 				if err != nil {
 					klog.Error(err)
 				}
 				klog.V(4).Infof("Processed message from collector %v, number of records: %v, observation domain ID: %v",
-					message.GetExportAddress(), message.GetSet().GetNumberOfRecords(), message.GetObsDomainID())
+					message.GetExportAddress(), message.GetNumberOfRecords(), message.GetObsDomainID())
 			}
 		}
 	}()
 }
-
-func (w *worker) stop() {
-	w.errChan <- true
-}
@@ -44,14 +44,17 @@ func (c *convertRecordToFlowType2) ConvertIPFIXMsgToFlowMsgs(msg *entities.Messa
 		addAllFieldsToFlowType2(flowType2, record)
 		return flowType2.ProtoReflect()
 	}
-	set := msg.GetSet()
-	if set.GetSetType() == entities.Template {
-		return nil
+	flowMsgs := make([]protoreflect.Message, 0)
+	for _, set := range msg.GetSets() {
+		if set.GetSetType() != entities.Data {
+			continue
+		}
+		for _, record := range set.GetRecords() {
+			flowMsgs = append(flowMsgs, convertRecordToFlowMsg(msg, record))
+		}
 	}
-	records := set.GetRecords()
-	flowMsgs := make([]protoreflect.Message, len(records))
-	for i, record := range records {
-		flowMsgs[i] = convertRecordToFlowMsg(msg, record)
+	if len(flowMsgs) == 0 {
+		return nil
 	}
 	return flowMsgs
 }
@@ -132,17 +132,19 @@ FaU0IQHwImuqwIjbsJtnj6XgozycBwTPGPkuQeyKp3k3ADE7UOCqsSOH
 -----END PRIVATE KEY-----
 `
 	FakeCert2 = `-----BEGIN CERTIFICATE-----
-MIIB+jCCAaCgAwIBAgIJALfqenQRnGoHMAoGCCqGSM49BAMCMHgxCzAJBgNVBAYT
-AlhYMQwwCgYDVQQIDANOL0ExDDAKBgNVBAcMA04vQTEgMB4GA1UECgwXU2VsZi1z
-aWduZWQgY2VydGlmaWNhdGUxKzApBgNVBAMMIjEyMC4wLjAuMTogU2VsZi1zaWdu
-ZWQgY2VydGlmaWNhdGUwHhcNMjAxMTA4MDgwNjQ2WhcNMjIxMTA4MDgwNjQ2WjB4
-MQswCQYDVQQGEwJYWDEMMAoGA1UECAwDTi9BMQwwCgYDVQQHDANOL0ExIDAeBgNV
-BAoMF1NlbGYtc2lnbmVkIGNlcnRpZmljYXRlMSswKQYDVQQDDCIxMjAuMC4wLjE6
-IFNlbGYtc2lnbmVkIGNlcnRpZmljYXRlMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcD
-QgAEJyAlxk8nO9idpqSIG2c95r4JqlMxiRWlNCEB8CJrqsCI27CbZ4+l4KM8nAcE
-zxj5LkHsiqd5NwAxO1DgqrEjh6MTMBEwDwYDVR0RBAgwBocEfwAAATAKBggqhkjO
-PQQDAgNIADBFAiEAzUT2hG3WChJh8cBo7EMQan2eJiF96OlSB+rWKKMaoGACIGOp
-RVaPKj9ad0Z/3GiwaxtW+74bvc2vF3JS9cRU6DhY
+MIICVjCCAfygAwIBAgIUFrd9ousl9xDeUgxWIlmGHrLasrkwCgYIKoZIzj0EAwIw
+eDELMAkGA1UEBhMCWFgxDDAKBgNVBAgMA04vQTEMMAoGA1UEBwwDTi9BMSAwHgYD
+VQQKDBdTZWxmLXNpZ25lZCBjZXJ0aWZpY2F0ZTErMCkGA1UEAwwiMTIwLjAuMC4x
+OiBTZWxmLXNpZ25lZCBjZXJ0aWZpY2F0ZTAeFw0yNjEwMTcwMTM5MDRaFw0zNjEw
+MTQwMTM5MDRaMHgxCzAJBgNVBAYTAlhYMQwwCgYDVQQIDANOL0ExDDAKBgNVBAcM
+A04vQTEgMB4GA1UECgwXU2VsZi1zaWduZWQgY2VydGlmaWNhdGUxKzApBgNVBAMM
+IjEyMC4wLjAuMTogU2VsZi1zaWduZWQgY2VydGlmaWNhdGUwWTATBgcqhkjOPQIB
+BggqhkjOPQMBBwNCAAQnICXGTyc72J2mpIgbZz3mvgmqUzGJFaU0IQHwImuqwIjb
+sJtnj6XgozycBwTPGPkuQeyKp3k3ADE7UOCqsSOHo2QwYjAdBgNVHQ4EFgQUj5YD
+AODHfFYvF9L83CO0K1oThmEwHwYDVR0jBBgwFoAUj5YDAODHfFYvF9L83CO0K1oT
+hmEwDwYDVR0TAQH/BAUwAwEB/zAPBgNVHREECDAGhwR/AAABMAoGCCqGSM49BAMC
+A0gAMEUCIQDrdAaSTXKZ9JG96Y+RQYywSt5aFiZ2WUxJjK6GVkfo9wIgIkDLnCm3
+xzuhDa5XOwxKJa98GnuXjc73vBOO4nwsNUU=
 -----END CERTIFICATE-----
 `
 )
@@ -17,6 +17,7 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -135,7 +136,7 @@ func testCollectorToIntermediate(t *testing.T, address net.Addr, isIPv6 bool) {
 		AggregateElements: aggregatedFields,
 	}
 	ap, _ := intermediate.InitAggregationProcess(apInput)
-	go cp.Start()
+	go cp.Start(context.Background())
 	waitForCollectorReady(t, cp)
 	go func() {
 		collectorAddr, _ := net.ResolveTCPAddr("tcp", cp.GetAddress().String())
@@ -154,7 +155,7 @@ func testCollectorToIntermediate(t *testing.T, address net.Addr, isIPv6 bool) {
 			conn.Write(dataPacket2IPv4)
 		}
 	}()
-	go ap.Start()
+	go ap.Start(context.Background())
 	if isIPv6 {
 		waitForAggregationToFinish(t, ap, flowKey2)
 	} else {
@@ -258,3 +259,54 @@ func waitForAggregationToFinish(t *testing.T, ap *intermediate.AggregationProces
 		t.Error(err)
 	}
 }
+
+func TestNetFlowV5CollectorToIntermediate(t *testing.T) {
+	cpInput := collector.CollectorInput{
+		Address:       "127.0.0.1:0",
+		Protocol:      "udp",
+		MaxBufferSize: 1024,
+	}
+	cp, _ := collector.InitCollectingProcess(cpInput)
+	apInput := intermediate.AggregationInput{
+		MessageChan: cp.GetMsgChan(),
+		WorkerNum:   aggregationWorkerNum,
+	}
+	ap, _ := intermediate.InitAggregationProcess(apInput)
+	go cp.Start(context.Background())
+	waitForCollectorReady(t, cp)
+	go ap.Start(context.Background())
+	// NetFlow v5 packet with a record of the flow 10.0.0.1:1234 -> 10.0.0.2:80 (tcp)
+	header := []byte{0, 5, 0, 1, 0, 0, 3, 232, 95, 154, 107, 127, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	flowRecord := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0, 0, 0, 0, 0, 1, 0, 2,
+		0, 0, 0, 10, 0, 0, 5, 220, 0, 0, 1, 0, 0, 0, 2, 0,
+		4, 210, 0, 80, 0, 0x12, 6, 0, 0, 0, 0, 0, 24, 24, 0, 0}
+	go func() {
+		conn, err := net.Dial("udp", cp.GetAddress().String())
+		if err != nil {
+			t.Errorf("UDP Collecting Process does not start correctly.")
+			return
+		}
+		defer conn.Close()
+		conn.Write(append(header, flowRecord...))
+	}()
+	flowKey := intermediate.FlowKey{SourceAddress: "10.0.0.1", DestinationAddress: "10.0.0.2", Protocol: 6, SourcePort: 1234, DestinationPort: 80}
+	var record entities.Record
+	err := wait.Poll(100*time.Millisecond, time.Second, func() (bool, error) {
+		ap.ForAllRecordsDo(func(key intermediate.FlowKey, aggregationFlowRecord *intermediate.AggregationFlowRecord) error {
+			if key == flowKey {
+				record = aggregationFlowRecord.Record
+			}
+			return nil
+		})
+		return record != nil, nil
+	})
+	cp.Stop()
+	ap.Stop()
+	if err != nil {
+		t.Fatalf("NetFlow v5 records are not aggregated: %v", err)
+	}
+	ie, _ := record.GetInfoElementWithValue("packetDeltaCount")
+	assert.Equal(t, uint64(10), ie.Value)
+	ie, _ = record.GetInfoElementWithValue("flowEndSysUpTime")
+	assert.Equal(t, uint32(512), ie.Value)
+}
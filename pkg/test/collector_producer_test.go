@@ -17,6 +17,7 @@
 package test
 
 import (
+	"context"
 	"net"
 	"testing"
 
@@ -85,7 +86,7 @@ func TestCollectorToProducer(t *testing.T) {
 	kafkaProducer := producer.NewKafkaProducer(testInput)
 	kafkaProducer.SetSaramaProducer(mockSaramaProducer)
 
-	go cp.Start()
+	go cp.Start(context.Background())
 	waitForCollectorReady(t, cp)
 	go func() {
 		conn, err := net.DialUDP("udp", nil, address)
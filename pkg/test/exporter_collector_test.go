@@ -17,8 +17,11 @@
 package test
 
 import (
+	"context"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -158,6 +161,202 @@ func TestDTLSTransport(t *testing.T) {
 	testExporterToCollector(address, true, false, false, true, t)
 }
 
+func TestDTLSTransportMultipleExporters(t *testing.T) {
+	const exporterNum = 5
+	cpInput := collector.CollectorInput{
+		Address:       "127.0.0.1:0",
+		Protocol:      "udp",
+		MaxBufferSize: 1024,
+		IsEncrypted:   true,
+		ServerCert:    []byte(FakeCert2),
+		ServerKey:     []byte(FakeKey2),
+	}
+	cp, _ := collector.InitCollectingProcess(cpInput)
+	go cp.Start(context.Background())
+	waitForCollectorReady(t, cp)
+	// The exporters are connected to the collector at the same time.
+	exporters := make([]*exporter.ExportingProcess, exporterNum)
+	var wg sync.WaitGroup
+	for i := range exporters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			epInput := exporter.ExporterInput{
+				CollectorAddress:    cp.GetAddress().String(),
+				CollectorProtocol:   cp.GetAddress().Network(),
+				ObservationDomainID: uint32(i + 1),
+				IsEncrypted:         true,
+				CACert:              []byte(FakeCert2),
+			}
+			export, err := exporter.InitExportingProcess(epInput)
+			if err != nil {
+				t.Errorf("Got error when connecting to %s: %v", cp.GetAddress().String(), err)
+				return
+			}
+			exporters[i] = export
+			templateID := export.NewTemplateID()
+			if _, err = export.SendSet(createTemplateSet(templateID, false)); err != nil {
+				t.Errorf("Got error when sending template set: %v", err)
+			}
+			if _, err = export.SendSet(createDataSet(templateID, true, false, false)); err != nil {
+				t.Errorf("Got error when sending data set: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	defer func() {
+		for _, export := range exporters {
+			if export != nil {
+				export.CloseConnToCollector()
+			}
+		}
+		cp.Stop()
+	}()
+	if t.Failed() {
+		return
+	}
+	sessions := make(map[string]uint32)
+	for i := 0; i < 2*exporterNum; i++ {
+		select {
+		case message := <-cp.GetMsgChan():
+			// Messages of an association are received in order.
+			if message.GetSet().GetSetType() == entities.Template {
+				sessions[message.GetSessionID()] = message.GetObsDomainID()
+			} else {
+				obsDomainID, exist := sessions[message.GetSessionID()]
+				assert.True(t, exist, "Template should be received before data from %s", message.GetSessionID())
+				assert.Equal(t, obsDomainID, message.GetObsDomainID())
+				assert.Equal(t, uint32(1), message.GetNumberOfRecords())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received %d messages from %d exporters", i, len(sessions))
+		}
+	}
+	assert.Equal(t, exporterNum, len(sessions), "Each exporter should have its own dtls association")
+}
+
+func TestOctetArrayTCPTransport(t *testing.T) {
+	variableElement, err := registry.GetInfoElement("dataLinkFrameSection", registry.IANAEnterpriseID)
+	if err != nil {
+		t.Fatalf("Did not find the element with name dataLinkFrameSection")
+	}
+	registryElement, err := registry.GetInfoElement("ipHeaderPacketSection", registry.IANAEnterpriseID)
+	if err != nil {
+		t.Fatalf("Did not find the element with name ipHeaderPacketSection")
+	}
+	// octetArray element exported with fixed length
+	fixedElement := entities.NewInfoElement(registryElement.Name, registryElement.ElementId, registryElement.DataType, registryElement.EnterpriseId, 4)
+	// Value longer than 255 bytes is encoded with the 3-byte length prefix.
+	longValue := make([]byte, 300)
+	for i := range longValue {
+		longValue[i] = byte(i)
+	}
+	elements := []*entities.InfoElementWithValue{
+		entities.NewInfoElementWithValue(fixedElement, []byte{0x45, 0x0, 0x0, 0x54}),
+		entities.NewInfoElementWithValue(variableElement, []byte{0x1, 0x2, 0x3}),
+		entities.NewInfoElementWithValue(variableElement, longValue),
+	}
+	record := exportAndCollectRecord(t, elements)
+	receivedElements := record.GetOrderedElementList()
+	assert.Equal(t, uint16(4), receivedElements[0].Element.Len)
+	assert.Equal(t, []byte{0x45, 0x0, 0x0, 0x54}, receivedElements[0].Value)
+	assert.Equal(t, []byte{0x1, 0x2, 0x3}, receivedElements[1].Value)
+	assert.Equal(t, longValue, receivedElements[2].Value)
+}
+
+func TestTimestampTCPTransport(t *testing.T) {
+	elements := make([]*entities.InfoElementWithValue, 0)
+	for _, name := range []string{"flowStartMicroseconds", "flowEndMicroseconds", "flowStartNanoseconds", "flowEndNanoseconds"} {
+		element, err := registry.GetInfoElement(name, registry.IANAEnterpriseID)
+		if err != nil {
+			t.Fatalf("Did not find the element with name %s", name)
+		}
+		elements = append(elements, entities.NewInfoElementWithValue(element, nil))
+	}
+	flowStart := time.Date(2020, 11, 10, 12, 30, 45, 123456789, time.UTC)
+	flowEnd := time.Now()
+	elements[0].Value = flowStart
+	elements[1].Value = flowEnd
+	elements[2].Value = flowStart
+	elements[3].Value = flowEnd
+	record := exportAndCollectRecord(t, elements)
+	receivedElements := record.GetOrderedElementList()
+	assert.Equal(t, flowStart.Truncate(time.Microsecond), receivedElements[0].Value)
+	assert.Equal(t, flowEnd.UTC().Truncate(time.Microsecond), receivedElements[1].Value)
+	assert.Equal(t, flowStart, receivedElements[2].Value)
+	assert.Equal(t, flowEnd.UTC().Round(0), receivedElements[3].Value)
+}
+
+// exportAndCollectRecord sends a template of the given elements and a data
+// record with their values from an exporting process to a collecting process
+// over TCP, and returns the data record received by the collecting process.
+func exportAndCollectRecord(t *testing.T, elements []*entities.InfoElementWithValue) entities.Record {
+	cpInput := collector.CollectorInput{
+		Address:       "127.0.0.1:0",
+		Protocol:      "tcp",
+		MaxBufferSize: 1024,
+		TemplateTTL:   0,
+	}
+	cp, _ := collector.InitCollectingProcess(cpInput)
+	go cp.Start(context.Background())
+	go func() { // Start exporting process in go routine
+		waitForCollectorReady(t, cp)
+		epInput := exporter.ExporterInput{
+			CollectorAddress:    cp.GetAddress().String(),
+			CollectorProtocol:   cp.GetAddress().Network(),
+			ObservationDomainID: 1,
+			TempRefTimeout:      0,
+			PathMTU:             0,
+		}
+		export, err := exporter.InitExportingProcess(epInput)
+		if err != nil {
+			t.Errorf("Got error when connecting to %s", cp.GetAddress().String())
+			cp.Stop()
+			return
+		}
+		defer export.CloseConnToCollector() // Close exporting process
+		templateID := export.NewTemplateID()
+		templateSet := entities.NewSet(false)
+		templateSet.PrepareSet(entities.Template, templateID)
+		templateElements := make([]*entities.InfoElementWithValue, len(elements))
+		for i, element := range elements {
+			templateElements[i] = entities.NewInfoElementWithValue(element.Element, nil)
+		}
+		templateSet.AddRecord(templateElements, templateID)
+		if _, err = export.SendSet(templateSet); err != nil {
+			t.Errorf("Got error when sending record: %v", err)
+			cp.Stop()
+			return
+		}
+		dataSet := entities.NewSet(false)
+		dataSet.PrepareSet(entities.Data, templateID)
+		if err = dataSet.AddRecord(elements, templateID); err != nil {
+			t.Errorf("Got error when adding record: %v", err)
+			cp.Stop()
+			return
+		}
+		if _, err = export.SendSet(dataSet); err != nil {
+			t.Errorf("Got error when sending record: %v", err)
+			cp.Stop()
+		}
+	}()
+
+	var dataMsg *entities.Message
+	numMessages := 0
+	// The message channel is closed once the collecting process has stopped.
+	for message := range cp.GetMsgChan() {
+		numMessages++
+		if numMessages == 2 {
+			dataMsg = message
+			cp.Stop()
+		}
+	}
+	if dataMsg == nil {
+		t.Fatalf("Data record is not received by the collecting process")
+	}
+	return dataMsg.GetSet().GetRecords()[0]
+}
+
 func testExporterToCollector(address net.Addr, isSrcNode, isIPv6 bool, isMultipleRecord bool, isEncrypted bool, t *testing.T) {
 	// Initialize collecting process
 	messages := make([]*entities.Message, 0)
@@ -182,7 +381,7 @@ func testExporterToCollector(address net.Addr, isSrcNode, isIPv6 bool, isMultipl
 	}
 	cp, _ := collector.InitCollectingProcess(cpInput)
 	// Start collecting process
-	go cp.Start()
+	go cp.Start(context.Background())
 	go func() { // Start exporting process in go routine
 		waitForCollectorReady(t, cp)
 		epInput := exporter.ExporterInput{
@@ -223,13 +422,13 @@ func testExporterToCollector(address net.Addr, isSrcNode, isIPv6 bool, isMultipl
 		export.CloseConnToCollector() // Close exporting process
 	}()
 
+	// The message channel is closed once the collecting process has stopped.
 	for message := range cp.GetMsgChan() {
 		messages = append(messages, message)
 		if len(messages) == 2 {
-			cp.CloseMsgChan()
+			cp.Stop()
 		}
 	}
-	cp.Stop() // Close collecting process
 	templateMsg := messages[0]
 	assert.Equal(t, uint16(10), templateMsg.GetVersion(), "Version of flow record (template) should be 10.")
 	assert.Equal(t, uint32(1), templateMsg.GetObsDomainID(), "ObsDomainID (template) should be 1.")
@@ -258,6 +457,8 @@ func testExporterToCollector(address net.Addr, isSrcNode, isIPv6 bool, isMultipl
 	dataMsg := messages[1]
 	assert.Equal(t, uint16(10), dataMsg.GetVersion(), "Version of flow record (template) should be 10.")
 	assert.Equal(t, uint32(1), dataMsg.GetObsDomainID(), "ObsDomainID (template) should be 1.")
+	assert.Equal(t, uint32(0), dataMsg.GetSequenceNum(), "Sequence number should be the number of data records sent before the message.")
+	assert.Equal(t, collector.SequenceStats{}, cp.GetTotalSequenceStats(), "There should be no sequence number anomaly.")
 	dataSet := dataMsg.GetSet()
 	record := dataSet.GetRecords()[0]
 	matchDataRecordElements(t, record, isSrcNode, isIPv6)